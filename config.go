@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ciena/cord-maas-automation/pkg/maasflow"
+	"gopkg.in/yaml.v2"
+)
+
+// commentStripper a reader that removes any "//" line comments and "/* */"
+// block comments from the JSON read through it, leaving the contents of string
+// values untouched. The newlines within comments are kept so that parse errors
+// still refer to sensible locations.
+type commentStripper struct {
+	r        *bufio.Reader
+	inString bool
+	escaped  bool
+	newlines int
+}
+
+func newCommentStripper(r io.Reader) *commentStripper {
+	return &commentStripper{r: bufio.NewReader(r)}
+}
+
+func (s *commentStripper) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if s.newlines > 0 {
+			p[n] = '\n'
+			n++
+			s.newlines--
+			continue
+		}
+
+		c, err := s.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		switch {
+		case s.inString:
+			// Copy the string value through to its closing quote, skipping
+			// over any escaped characters
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.inString = false
+			}
+		case c == '"':
+			s.inString = true
+		case c == '/':
+			next, err := s.r.Peek(1)
+			if err != nil || (next[0] != '/' && next[0] != '*') {
+				break
+			}
+			s.r.ReadByte()
+			if next[0] == '/' {
+				// Skip to the end of line, keeping the newline
+				if _, err := s.r.ReadString('\n'); err == nil {
+					s.newlines++
+				}
+			} else {
+				// Skip to the end of the block, keeping any newlines
+				var prev byte
+				for {
+					c, err := s.r.ReadByte()
+					if err != nil || (prev == '*' && c == '/') {
+						break
+					}
+					if c == '\n' {
+						s.newlines++
+					}
+					prev = c
+				}
+			}
+			continue
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+// envExpander a reader that expands any environment variable references,
+// i.e. $CLUSTER or ${CLUSTER}, in the contents read through it. The contents
+// are expanded a line at a time so that large files are still streamed, and
+// references cannot span lines.
+type envExpander struct {
+	r       *bufio.Reader
+	pending string
+	err     error
+}
+
+func newEnvExpander(r io.Reader) *envExpander {
+	return &envExpander{r: bufio.NewReader(r)}
+}
+
+func (e *envExpander) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		var line string
+		line, e.err = e.r.ReadString('\n')
+		e.pending = os.ExpandEnv(line)
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// expandVars optionally expand the environment variable references in the
+// contents of a file
+func expandVars(r io.Reader, expand bool) io.Reader {
+	if expand {
+		return newEnvExpander(r)
+	}
+	return r
+}
+
+// decompress transparently decompress files with a ".gz" extension, returning
+// the name of the file without the extension so that its format can still be
+// determined from the name
+func decompress(name string, file io.Reader) (io.Reader, string, error) {
+	if strings.ToLower(filepath.Ext(name)) != ".gz" {
+		return file, name, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, name, err
+	}
+	return reader, strings.TrimSuffix(name, filepath.Ext(name)), nil
+}
+
+// sourceTimeout the maximum time to wait while fetching a filter or mappings
+// from a URL
+const sourceTimeout = 30 * time.Second
+
+// isURL whether the specification is a http or https URL from which a value
+// is fetched
+func isURL(spec string) bool {
+	return strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://")
+}
+
+// openSource open the source of a value specified either as a file reference,
+// a '@' followed by the name of the file, or a http or https URL. The name
+// returned is that of the file, or the URL without any query, from which the
+// format of the contents is determined and which is used in messages.
+func openSource(spec string, what string) (io.ReadCloser, string, error) {
+	if !isURL(spec) {
+		name := os.ExpandEnv(spec[1:])
+		file, err := os.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, name, fmt.Errorf("unable to open file '%s' to load the %s : %s", name, what, err)
+		}
+		return file, name, nil
+	}
+
+	// The query is dropped from the name as it may carry credentials
+	location, err := url.Parse(os.ExpandEnv(spec))
+	if err != nil {
+		return nil, spec, fmt.Errorf("unable to parse the URL '%s' to load the %s : %s", spec, what, err)
+	}
+	name := location.Scheme + "://" + location.Host + location.Path
+	client := http.Client{Timeout: sourceTimeout}
+	resp, err := client.Get(location.String())
+	if err != nil {
+		return nil, name, fmt.Errorf("unable to fetch '%s' to load the %s : %s", name, what, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, name, fmt.Errorf("unable to fetch '%s' to load the %s : %s", name, what, resp.Status)
+	}
+	return resp.Body, name, nil
+}
+
+// describeSource describe the file, or URL, from which a value was loaded
+func describeSource(name string) string {
+	if isURL(name) {
+		return fmt.Sprintf("'%s'", name)
+	}
+	return fmt.Sprintf("file '%s'", name)
+}
+
+// isYAML whether the named file is in the YAML format
+func isYAML(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// jsonCompatible convert the generic maps produced when parsing YAML, which
+// are keyed by interface{}, into maps keyed by string so the value can be
+// handled as if it were parsed from JSON
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			converted, err := jsonCompatible(entry)
+			if err != nil {
+				return nil, err
+			}
+			result[fmt.Sprintf("%v", key)] = converted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, entry := range v {
+			converted, err := jsonCompatible(entry)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+// decodeFile parse the contents of the named file into the given value. Files
+// with a ".yaml" or ".yml" extension are parsed as YAML, all others as JSON,
+// which may contain comments. Files with a further ".gz" extension are
+// decompressed. YAML is converted to JSON before being parsed so that the
+// resulting value is the same regardless of the file format. JSON is decoded
+// as it is read, rather than reading the whole file first.
+func decodeFile(name string, file io.Reader, v interface{}) error {
+	file, name, err := decompress(name, file)
+	if err != nil {
+		return err
+	}
+	if !isYAML(name) {
+		return json.NewDecoder(newCommentStripper(file)).Decode(v)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	generic, err = jsonCompatible(generic)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// loadFilter determine the filter, this can either be specified as a value, a
+// file reference or a URL. If none is specified the default will be used. When
+// lenient, patterns that do not compile are removed from the filter and
+// returned, rather than failing the load. When expanding, environment variable
+// references in the contents of a filter file are expanded before parsing.
+func loadFilter(spec string, anchored bool, lenient bool, expand bool) (maasflow.Filter, []error, error) {
+	filter, skipped, err := readFilter(spec, lenient, expand)
+	if err != nil {
+		return filter, skipped, err
+	}
+	filter.Anchored = anchored
+	if !lenient {
+		return filter, nil, nil
+	}
+	filter, pruned, err := filter.Prune()
+	return filter, append(skipped, pruned...), err
+}
+
+// readFilter read the filter from its specification, a file reference, a URL
+// or a value
+func readFilter(spec string, lenient bool, expand bool) (maasflow.Filter, []error, error) {
+	var filter maasflow.Filter
+	if len(spec) == 0 {
+		if err := json.Unmarshal([]byte(defaultFilter), &filter); err != nil {
+			return filter, nil, fmt.Errorf("unable to parse default filter specificiation: '%s' : %s", defaultFilter, err)
+		}
+		return filter, nil, nil
+	}
+	if spec[0] == '@' || isURL(spec) {
+		file, name, err := openSource(spec, "filter")
+		if err != nil {
+			return filter, nil, err
+		}
+		defer file.Close()
+
+		// Filter files may be large and machine generated, so JSON filters
+		// are decoded as they are read and each pattern is validated as it
+		// is decoded, so that a bad pattern is reported with its location
+		var skipped []error
+		reader, base, err := decompress(name, file)
+		if err == nil {
+			reader = expandVars(reader, expand)
+			if isYAML(base) {
+				err = decodeFile(base, reader, &filter)
+			} else {
+				filter, skipped, err = maasflow.DecodeFilter(newCommentStripper(reader), lenient)
+			}
+		}
+		if err != nil {
+			return filter, skipped, fmt.Errorf("unable to parse filter configuration from %s : %s", describeSource(name), err)
+		}
+		return filter, skipped, nil
+	}
+	if err := json.Unmarshal([]byte(spec), &filter); err != nil {
+		return filter, nil, fmt.Errorf("unable to parse filter specification: '%s' : %s", spec, err)
+	}
+	return filter, nil, nil
+}
+
+// summarizeSkipped a single description of all the filter patterns skipped
+// in lenient mode
+func summarizeSkipped(skipped []error) string {
+	descriptions := make([]string, len(skipped))
+	for i, err := range skipped {
+		descriptions[i] = err.Error()
+	}
+	return fmt.Sprintf("skipped %d invalid filter patterns, continuing with the valid patterns : %s",
+		len(skipped), strings.Join(descriptions, "; "))
+}
+
+// loadMappings determine the mac to name mapping, this can either be
+// specified as a value, a file reference or a URL. If none is specified the
+// default will be used. When expanding, environment variable references in
+// the contents of a mapping file are expanded before parsing.
+func loadMappings(spec string, expand bool) (map[string]interface{}, error) {
+	var mappings map[string]interface{}
+	if len(spec) == 0 {
+		if err := json.Unmarshal([]byte(defaultMapping), &mappings); err != nil {
+			return nil, fmt.Errorf("unable to parse default mac name mappings: '%s' : %s", defaultMapping, err)
+		}
+		return mappings, nil
+	}
+	if spec[0] == '@' || isURL(spec) {
+		file, name, err := openSource(spec, "mac name mapping")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		// Variables are expanded in the decompressed content, not the file
+		reader, base, err := decompress(name, file)
+		if err == nil {
+			err = decodeFile(base, expandVars(reader, expand), &mappings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse mac name mapping from %s : %s", describeSource(name), err)
+		}
+		return mappings, nil
+	}
+	if err := json.Unmarshal([]byte(spec), &mappings); err != nil {
+		return nil, fmt.Errorf("unable to parse mac name mapping: '%s' : %s", spec, err)
+	}
+	return mappings, nil
+}
+
+// loadStatusMap determine the overrides of the names of the MAAS statuses by
+// numeric code, this can either be specified as a value or a file reference.
+// If none is specified the built in names are used.
+func loadStatusMap(spec string) (map[int]string, error) {
+	var names map[string]string
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	if spec[0] == '@' {
+		name := os.ExpandEnv(spec[1:])
+		file, err := os.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open file '%s' to load the status map : %s", name, err)
+		}
+		defer file.Close()
+		if err := decodeFile(name, file, &names); err != nil {
+			return nil, fmt.Errorf("unable to parse status map from file '%s' : %s", name, err)
+		}
+	} else if err := json.Unmarshal([]byte(spec), &names); err != nil {
+		return nil, fmt.Errorf("unable to parse status map: '%s' : %s", spec, err)
+	}
+
+	overrides := make(map[int]string, len(names))
+	for key, name := range names {
+		code, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAAS status code '%s' in the status map, codes must be integers", key)
+		}
+		overrides[code] = name
+	}
+	return overrides, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ciena/cord-maas-automation/pkg/maasflow"
+	maas "github.com/juju/gomaasapi"
+)
+
+// newTestNode a node with the given JSON attributes, as returned by MAAS
+func newTestNode(t *testing.T, attrs string) maasflow.MaasNode {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(attrs), &values); err != nil {
+		t.Fatalf("invalid node attributes %s : %s", attrs, err)
+	}
+	values["resource_uri"] = "/MAAS/api/1.0/nodes/" + values["system_id"].(string) + "/"
+	data, _ := json.Marshal(values)
+
+	client, err := maas.NewAnonymousClient("http://localhost/MAAS/", "1.0")
+	if err != nil {
+		t.Fatalf("unable to create client : %s", err)
+	}
+	parsed, err := maas.Parse(*client, data)
+	if err != nil {
+		t.Fatalf("unable to parse node : %s", err)
+	}
+	obj, err := parsed.GetMAASObject()
+	if err != nil {
+		t.Fatalf("unable to create node : %s", err)
+	}
+	return maasflow.MaasNode{MAASObject: obj}
+}
+
+func TestDefaultFilterZones(t *testing.T) {
+	filter, _, err := loadFilter("", false, false, false)
+	if err != nil {
+		t.Fatalf("unable to load the default filter : %s", err)
+	}
+	tests := []struct {
+		name  string
+		attrs string
+		want  bool
+	}{
+		{"default zone", `{"system_id":"a","hostname":"n1","zone":{"name":"default"}}`, true},
+		{"other zone", `{"system_id":"a","hostname":"n1","zone":{"name":"rack-1"}}`, false},
+		{"no zone", `{"system_id":"a","hostname":"n1"}`, true},
+		{"zone without name", `{"system_id":"a","hostname":"n1","zone":{}}`, true},
+	}
+	for _, test := range tests {
+		if got := filter.Matches(newTestNode(t, test.attrs)); got != test.want {
+			t.Errorf("%s: Matches = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadFilterAnchored(t *testing.T) {
+	spec := `{"hosts":{"include":["compute-1"]}}`
+	node := newTestNode(t, `{"system_id":"a","hostname":"compute-100"}`)
+	for _, anchored := range []bool{false, true} {
+		filter, _, err := loadFilter(spec, anchored, false, false)
+		if err != nil {
+			t.Fatalf("unable to load the filter : %s", err)
+		}
+		if got := filter.Matches(node); got != !anchored {
+			t.Errorf("anchored %t: 'compute-1' matches 'compute-100' = %t, want %t", anchored, got, !anchored)
+		}
+	}
+}
+
+func TestLoadMappingsGzipExpanded(t *testing.T) {
+	os.Setenv("TEST_CLUSTER", "pod-1")
+	defer os.Unsetenv("TEST_CLUSTER")
+	name := filepath.Join(t.TempDir(), "mappings.json.gz")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := gzip.NewWriter(file)
+	writer.Write([]byte(`{"aa:bb:cc:dd:ee:ff":"${TEST_CLUSTER}-compute-1"}`))
+	writer.Close()
+	file.Close()
+
+	mappings, err := loadMappings("@"+name, true)
+	if err != nil {
+		t.Fatalf("unable to load the gzipped mappings : %s", err)
+	}
+	if got := mappings["aa:bb:cc:dd:ee:ff"]; got != "pod-1-compute-1" {
+		t.Errorf("expected the mapping to be expanded to 'pod-1-compute-1', got %v", got)
+	}
+}
+
+func TestLoadFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mappings.json":
+			w.Write([]byte(`{"aa:bb:cc:dd:ee:ff":"compute-1"}`))
+		case "/filter.yaml":
+			w.Write([]byte("hosts:\n  include: [\"compute-1\"]\n"))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	mappings, err := loadMappings(server.URL+"/mappings.json?token=secret", false)
+	if err != nil {
+		t.Fatalf("unable to load the mappings from the URL : %s", err)
+	}
+	if got := mappings["aa:bb:cc:dd:ee:ff"]; got != "compute-1" {
+		t.Errorf("expected the mapping to be 'compute-1', got %v", got)
+	}
+
+	filter, _, err := loadFilter(server.URL+"/filter.yaml", true, false, false)
+	if err != nil {
+		t.Fatalf("unable to load the filter from the URL : %s", err)
+	}
+	if !filter.Matches(newTestNode(t, `{"system_id":"a","hostname":"compute-1"}`)) {
+		t.Errorf("expected the filter fetched as YAML to match 'compute-1'")
+	}
+
+	_, err = loadMappings(server.URL+"/missing.json?token=secret", false)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the missing mappings to fail with the status, got %v", err)
+	} else if strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the query to be left out of the error, got %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// controlRequest a command received on the control listener, which is
+// performed by the processing loop and answered with a single line reply
+type controlRequest struct {
+	command string
+	reply   chan string
+}
+
+// listenControl listen for control connections on the given address, which is
+// either "unix:" followed by the path of a unix socket or a TCP address
+func listenControl(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+
+		// A socket left behind by a previous instance prevents listening, but
+		// a socket another instance is still listening on is left alone
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", path)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("another instance is already listening on '%s'", path)
+			}
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveControl accept control connections, passing each command received to
+// the processing loop
+func serveControl(listener net.Listener, requests chan<- controlRequest) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[warn] no longer accepting control connections : %s", err)
+			return
+		}
+		go handleControl(conn, requests)
+	}
+}
+
+// handleControl read the commands from a control connection, one per line,
+// writing the reply to each
+func handleControl(conn net.Conn, requests chan<- controlRequest) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" {
+			continue
+		}
+		reply := make(chan string, 1)
+		requests <- controlRequest{command: command, reply: reply}
+		fmt.Fprintln(conn, <-reply)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	// A socket left behind by an instance that died is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenControl("unix:" + path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced : %s", err)
+	}
+	defer listener.Close()
+
+	// A socket another instance is listening on is not
+	if _, err := listenControl("unix:" + path); err == nil {
+		t.Fatalf("expected listening on a socket in use to fail")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expected the first instance to still be listening : %s", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile a log file that is rotated once it reaches its maximum size,
+// keeping a number of the previous files as name.1, name.2, etc., with name.1
+// the most recent
+type rotatingFile struct {
+	sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// openRotatingFile open the log file, appending to it if it exists
+func openRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// rotate move the current file aside, discarding the oldest backup, and start
+// a new file. If the file cannot be moved aside logging continues to it.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	var err error
+	if r.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.name, r.backups))
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		}
+		err = os.Rename(r.name, r.name+".1")
+	} else {
+		err = os.Remove(r.name)
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Write write an entry to the file, rotating the file first if the entry
+// would take it over its maximum size. Entries are never split across files.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Report the failure where it will be seen, the entry is then
+			// written to whichever file could be opened
+			fmt.Fprintf(os.Stderr, "[error] unable to rotate log file '%s' : %s\n", r.name, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
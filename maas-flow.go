@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"net/url"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 	"unicode"
 
+	"github.com/ciena/cord-maas-automation/pkg/maasflow"
 	maas "github.com/juju/gomaasapi"
 )
 
@@ -29,13 +39,95 @@ const (
 )
 
 var apiKey = flag.String("apikey", "", "key with which to access MAAS server")
+var consumerKey = flag.String("consumer-key", "", "OAuth consumer key with which to access MAAS server, used with token-key and token-secret instead of apikey")
+var tokenKey = flag.String("token-key", "", "OAuth token key with which to access MAAS server, used with consumer-key and token-secret instead of apikey")
+var tokenSecret = flag.String("token-secret", "", "OAuth token secret with which to access MAAS server, used with consumer-key and token-key instead of apikey")
+var credentialsDir = flag.String("credentials-dir", "", "directory, i.e. a mounted secret, containing the MAAS_URL and API_KEY files, and optionally a CA_CERT file, which override the maas and apikey options")
 var maasURL = flag.String("maas", "http://localhost/MAAS", "url over which to access MAAS")
+var proxyURL = flag.String("proxy", "", "url of the proxy through which to access MAAS, if not specified the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used")
 var apiVersion = flag.String("apiVersion", "1.0", "version of the API to access")
 var queryPeriod = flag.String("period", "15s", "frequency the MAAS service is polled for node states")
 var preview = flag.Bool("preview", false, "displays the action that would be taken, but does not do the action, in this mode the nodes are processed only once")
-var mappings = flag.String("mappings", "{}", "the mac to name mappings")
-var always = flag.Bool("always-rename", true, "attempt to rename at every stage of workflow")
+var mappings = flag.String("mappings", "{}", "the mac to name mappings, as a JSON value, a @ file reference or a http(s) URL")
+var always = flag.Bool("always-rename", true, "deprecated, use rename-mode, when true the same as rename-mode always and when false the same as once")
+var renameMode = flag.String("rename-mode", "", "when a node whose hostname has drifted from its mapping is renamed, one of 'never', 'once', only while the hostname is one generated by MAAS, or 'always', from always-rename if not specified")
+var stateTimeouts = flag.String("state-timeouts", "{}", "the maximum time a node may wait in a state before remediation is attempted, i.e. {\"Deploying\":\"30m\"}")
+var annotate = flag.Bool("annotate-nodes", false, "record a comment on each node describing the action taken by the automation")
+var globalConcurrency = flag.Int("global-concurrency", 0, "the maximum number of mutating actions in flight against MAAS at any one time, 0 for no limit")
+var exportOut = flag.String("out", "", "the file to which export-csv writes the nodes, stdout if not specified")
+var writePlan = flag.String("write-plan", "", "file to which a preview writes the actions it would take, so that they can be reviewed and executed with execute-plan")
+var executePlan = flag.String("execute-plan", "", "file of the reviewed actions, written by write-plan, to execute once before exiting, nodes whose state has drifted since the plan was made are skipped")
+var untilConverged = flag.Bool("until-converged", false, "exit once the matched nodes have converged, i.e. no work remains, in preview mode exit non-zero if they have not converged")
+var skipInitial = flag.Bool("skip-initial-pass", false, "wait one full period before the first processing of the nodes, not valid with preview")
+var metricsAddr = flag.String("metrics", "", "address on which to export metrics at /metrics, and the status of the matched nodes at /status, i.e. :9090, neither is served if not specified")
+var pprofAddr = flag.String("pprof", "", "address on which to serve the Go profiling endpoints at /debug/pprof/, i.e. localhost:6060, not served if not specified")
+var fullFetchEvery = flag.Int("full-fetch-every", 1, "fetch the full list of nodes every Nth pass, in between only the nodes not yet deployed are fetched")
+var resourcePool = flag.String("resource-pool", "", "the resource pool into which nodes are aquired, the default pool if not specified")
+var zoneResourcePools = flag.String("zone-resource-pools", "{}", "per zone overrides of the resource pool into which nodes are aquired, i.e. {\"rack-1\":\"team-a\"}")
+var releaseErase = flag.String("release-erase", "", "how the disks of a node are erased when the automation releases it, one of 'none', 'quick' or 'secure', the MAAS configuration if not specified")
+var zoneReleaseErase = flag.String("zone-release-erase", "{}", "per zone overrides of how the disks of a node are erased when the automation releases it, i.e. {\"secure-rack\":\"secure\"}")
+var readOnly = flag.Bool("read-only", false, "only observe the nodes, never acting on them, so that an anonymous client or a read only API key can be used for the status and metrics, the client is anonymous if no API key is specified")
+var hold = flag.Bool("hold", false, "observe the nodes without acting on them, performing a single real pass each time SIGUSR1 is received")
+var backpressureLatency = flag.String("backpressure-latency", "0s", "the mean latency of the recent responses from MAAS above which it is considered overloaded, halving the concurrency and doubling the poll interval until it recovers, 0s to not consider the latency")
+var backpressureErrorRate = flag.Float64("backpressure-error-rate", 0, "the proportion, between 0 and 1, of the recent responses from MAAS that are transient errors, i.e. 503s, above which it is considered overloaded, 0 to not consider the errors")
+var webhookURL = flag.String("webhook-url", "", "the URL to which a JSON notification of each action taken, or failed, is posted, no notifications are sent if not specified")
+var webhookTimeout = flag.String("webhook-timeout", "10s", "the maximum time to wait for each delivery of a notification to the webhook")
+var webhookRetries = flag.Int("webhook-retries", 3, "the number of times a failed delivery of a notification is retried, with a backoff, before the notification is dropped")
+var notificationWindow = flag.String("notification-window", "1m", "the window within which identical failure notifications, the same action failing with the same error, are coalesced into a single summary, 0s to send every failure")
+var maxRPS = flag.Float64("max-rps", 0, "the maximum number of requests per second made to MAAS, 0 for no limit")
+var strict = flag.Bool("strict-transitions", false, "treat nodes in a state with no transition to the target state as errors, in preview mode the utility exits non-zero if any errors occur")
+var actionCooldown = flag.String("action-cooldown", "0s", "how long to wait after an action for a node fails before attempting it again")
+var rollout = flag.String("rollout", maasflow.RolloutParallel, "how to proceed across zones, either 'parallel' or 'serial-by-zone'")
+var zoneOrder = flag.String("zone-order", "", "comma separated list of the order in which zones are processed in a serial-by-zone rollout")
+var nodeIDs = flag.String("node-ids", "", "comma separated list, or file reference, of the system ids of the only nodes on which to operate, all nodes matching the filter if not specified")
+var skipTestFailed = flag.Bool("skip-test-failed", true, "neither aquire nor deploy nodes that failed their hardware tests, leaving them for manual attention")
+var autoDeployAllocated = flag.Bool("auto-deploy-allocated", true, "deploy allocated nodes regardless of who allocated them, when false nodes allocated by a user other than the automation are left for that user")
+var owner = flag.String("owner", "", "the MAAS user as which the automation aquires nodes, determined from the API key if not specified")
+var deployKernelOpts = flag.String("deploy-kernel-opts", "", "the kernel command line options with which nodes are deployed, i.e. \"hugepages=64 intel_iommu=on\", those configured in MAAS if not specified")
+var zoneDeployKernelOpts = flag.String("zone-deploy-kernel-opts", "{}", "per zone overrides of the kernel command line options with which nodes are deployed, i.e. {\"dpdk\":\"hugepages=64 iommu=pt\"}")
+var acquireParams = flag.String("acquire-params", "{}", "additional parameters passed verbatim when aquiring a node, as a JSON object of string values, i.e. {\"arch\":\"amd64\",\"tags\":\"gpu\"}")
+var agentName = flag.String("agent-name", "maas-flow", "the agent name given when aquiring nodes, which distinguishes the nodes aquired by the automation from those aquired by others, not given if empty")
+var lockNodes = flag.Bool("lock-nodes", false, "lock a node before taking a mutating action on it, so that only one of several instances acts on the node at a time, requires MAAS 2.x")
+var instanceID = flag.String("instance-id", maasflow.DefaultInstanceID(), "identifies this instance of the automation when locking nodes")
+var targetDeployed = flag.Int("target-deployed", 0, "the number of matched nodes to have deployed, only enough ready nodes are aquired to reach it, 0 to deploy every matched node")
+var selectionStrategy = flag.String("selection-strategy", "hostname", "comma separated list, in order of precedence, of how the ready nodes to aquire are chosen with target-deployed: hostname, least-loaded-zone or most-memory")
+var stabilityPasses = flag.Int("stability-passes", 1, "the number of consecutive passes a node must be observed in the same state before a mutating action is taken on it")
+var maxAuthFailures = flag.Int("max-auth-failures", 0, "exit after this many consecutive requests to MAAS fail authentication, so that the process can be restarted with fresh credentials, 0 to never exit")
+var managedTag = flag.String("managed-tag", "", "the MAAS tag a node must carry, as well as match the filter, for the automation to operate on it, i.e. maas-flow-managed, nodes are not required to carry a tag if not specified")
+var nameTemplate = flag.String("name-template", "", "the template from which the names of the nodes the automation aquires are generated, i.e. gpu-pool-%03d, nodes are not renamed if not specified")
+var acquireSetName = flag.Bool("acquire-set-name", true, "name a node from the name-template as it is aquired, when false the node is aquired by its system id alone and named when it is deployed")
+var ensureTag = flag.String("ensure-tag", "", "the MAAS tag added to every node that matches the filter, i.e. maas-flow-managed, nodes are not tagged if not specified")
+var cordon = flag.Bool("cordon", false, "start cordoned, where the nodes already mid-transition are driven to completion but no new work is started, SIGUSR2 toggles the cordon")
+var commissionOptions = flag.String("commission-options", "{}", "the options included when commissioning a node, i.e. {\"enable_ssh\":\"true\",\"skip_storage\":\"false\"}")
+var zoneTestingScripts = flag.String("zone-testing-scripts", "{}", "per zone overrides of the testing scripts run when commissioning a node, i.e. {\"burn-in\":\"memtester,badblocks\"}")
+var transitionGuards = flag.String("transition-guards", "{}", "comma separated list of the validators checked before the action for a state is taken, by state, i.e. {\"Allocated\":\"tests-passed\",\"Ready\":\"power-on\"}")
+var scaleDown = flag.Bool("scale-down", false, "release the deployed nodes in excess of target-deployed, the most recently deployed first, requires arm-destructive")
+var reclaimableTag = flag.String("reclaimable-tag", "", "with scale-down, the MAAS tag a deployed node must carry to be released, any deployed node may be released if not specified")
+var maxReleasesPerPass = flag.Int("max-releases-per-pass", 1, "with scale-down, the maximum number of nodes released in a pass")
+var oscillationPasses = flag.Int("oscillation-passes", 20, "report a node whose states repeat the same cycle twice within this many passes, a sign of a misconfigured filter or transitions, 0 to not report oscillation")
+var noProgressPasses = flag.Int("no-progress-passes", 20, "report when this many passes in a row take actions without the matched nodes advancing towards the target state, 0 to not report the lack of progress")
+var armDestructive = flag.Bool("arm-destructive", false, "allow the actions that are disruptive to a node, i.e. power-cycle-stuck, fast-release, release-failed-erase and releasing nodes past their Deploying timeout, which are otherwise refused")
+var powerCycleStuck = flag.Bool("power-cycle-stuck", false, "power cycle nodes that have been deploying for longer than the stuck-timeout, requires arm-destructive")
+var deployPoll = flag.String("deploy-poll", "0s", "how long to poll the state of a node after it is started, logging its progress and catching an early failure without waiting for the next pass, 0s to not poll")
+var deployPollInterval = flag.String("deploy-poll-interval", "15s", "the time between the polls of a node being deployed, see deploy-poll")
+var stuckTimeout = flag.String("stuck-timeout", "45m", "how long a node may be deploying before it is considered stuck, and the time between power cycles")
+var powerCycleAttempts = flag.Int("power-cycle-attempts", 2, "the maximum number of times a stuck node is power cycled before it is left for manual attention, 0 disables power cycling")
+var fastRelease = flag.Bool("fast-release", false, "release nodes without erasing their disks, overriding the MAAS configuration, so data on the disks survives into the next deployment, requires arm-destructive")
+var releaseFailedErase = flag.Bool("release-failed-erase", false, "release the nodes that failed to erase their disks again, without erasing the disks, rather than leaving them for manual attention, requires arm-destructive")
+var controlAddr = flag.String("control", "", "address on which to accept control commands, either unix:<path> for a unix socket or a TCP address, i.e. localhost:7070, commands are not accepted if not specified")
+var stateFile = flag.String("state-file", "", "file in which to persist the state tracked across passes so that it survives a restart")
+var enlistManifest = flag.String("enlist-manifest", "", "the machines to create in MAAS at start up, if not already present, i.e. [{\"mac\":\"...\",\"hostname\":\"...\",\"power_type\":\"...\",\"power_params\":{}}]")
 var verbose = flag.Bool("verbose", false, "display verbose logging")
+var logFile = flag.String("log-file", "", "file to which to write the log, rotated by size, rather than standard error")
+var logMaxSize = flag.Int("log-max-size", 100, "the size in megabytes at which the log file is rotated")
+var logMaxBackups = flag.Int("log-max-backups", 5, "the number of rotated log files kept")
+var logConsole = flag.Bool("log-console", false, "also write the log to standard error when writing it to a file")
+var traceNodes = flag.String("trace-nodes", "", "comma separated list of the system ids or hostnames of the nodes for which to log in full detail, including the requests made to MAAS and their responses")
+var requireFilter = flag.Bool("require-explicit-filter", false, "refuse to start unless a filter is specified, rather than using the default filter which matches every node in the default zone")
+var filterAnchored = flag.Bool("filter-anchored", false, "match the filter patterns against the whole of the hostname, zone, etc., rather than any part of it, recommended")
+var expandFileVars = flag.Bool("expand-file-vars", false, "expand environment variable references, i.e. $CLUSTER, in the contents of the filter and mapping files before parsing them")
+var filterLenient = flag.Bool("filter-lenient", false, "skip the filter patterns that are not valid regular expressions, with a warning, rather than refusing to start")
+var statusMap = flag.String("status-map", "", "overrides of the names of the MAAS statuses by numeric code, as a value or file reference, i.e. {\"21\":\"Testing\"}, for MAAS releases that number statuses differently")
 var filterSpec = flag.String("filter", strings.Map(func(r rune) rune {
 	if unicode.IsSpace(r) {
 		return -1
@@ -47,7 +139,7 @@ var filterSpec = flag.String("filter", strings.Map(func(r rune) rune {
 // return false.
 func checkError(err error, message string, v ...interface{}) bool {
 	if err != nil {
-		log.Fatalf("[error] "+message, v)
+		log.Fatalf("[error] "+message, v...)
 	}
 	return false
 }
@@ -56,112 +148,819 @@ func checkError(err error, message string, v ...interface{}) bool {
 // return true, else return false.
 func checkWarn(err error, message string, v ...interface{}) bool {
 	if err != nil {
-		log.Printf("[warn] "+message, v)
+		log.Printf("[warn] "+message, v...)
 		return true
 	}
 	return false
 }
 
-// fetchNodes do a HTTP GET to the MAAS server to query all the nodes
-func fetchNodes(client *maas.MAASObject) ([]MaasNode, error) {
-	nodeListing := client.GetSubObject("nodes")
-	listNodeObjects, err := nodeListing.CallGet("list", url.Values{})
-	if checkWarn(err, "unable to get the list of all nodes: %s", err) {
-		return nil, err
-	}
-	listNodes, err := listNodeObjects.GetArray()
-	if checkWarn(err, "unable to get the node objects for the list: %s", err) {
-		return nil, err
+// parseDuration convert the value of a duration option into a Go duration,
+// returning an error that names the option and gives examples of valid values
+func parseDuration(name string, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q is not a valid duration (expected e.g. \"15s\", \"2m\")", name, value)
 	}
+	return d, nil
+}
 
-	var nodes = make([]MaasNode, len(listNodes))
-	for index, nodeObj := range listNodes {
-		node, err := nodeObj.GetMAASObject()
-		if !checkWarn(err, "unable to retrieve object for node: %s", err) {
-			nodes[index] = MaasNode{node}
+// resolveAPIKey determine the API key with which to access MAAS, either as
+// given or assembled from its OAuth consumer key, token key and token secret
+func resolveAPIKey(apiKey string, consumerKey string, tokenKey string, tokenSecret string) (string, error) {
+	parts := []string{consumerKey, tokenKey, tokenSecret}
+	given := 0
+	for _, part := range parts {
+		if part != "" {
+			given++
 		}
 	}
-	return nodes, nil
+	switch {
+	case given == 0:
+		return apiKey, nil
+	case apiKey != "":
+		return "", fmt.Errorf("apikey cannot be used with consumer-key, token-key and token-secret, specify one or the other")
+	case given < len(parts):
+		return "", fmt.Errorf("consumer-key, token-key and token-secret must all be specified")
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// readCredential read the named credential file from the credentials
+// directory, trimming surrounding whitespace. If the file does not exist and
+// is optional an empty value is returned.
+func readCredential(dir string, name string, optional bool) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) && optional {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read credential '%s' from '%s' : %s", name, dir, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// printMappingReport write the result of checking the mappings against the
+// nodes as a table
+func printMappingReport(out io.Writer, report maasflow.MappingReport) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "MATCHED (%d)\nMAC\tMAPPED HOSTNAME\tSYSTEM ID\tCURRENT HOSTNAME\n", len(report.Matched))
+	for _, m := range report.Matched {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.MAC, m.Hostname, m.SystemID, m.NodeHostname)
+	}
+	fmt.Fprintf(w, "\nMAPPED MACS ON NO NODE (%d)\nMAC\n", len(report.Unmatched))
+	for _, mac := range report.Unmatched {
+		fmt.Fprintf(w, "%s\n", mac)
+	}
+	fmt.Fprintf(w, "\nNODES WITHOUT A MAPPING (%d)\nSYSTEM ID\tHOSTNAME\tMACS\n", len(report.Unmapped))
+	for _, n := range report.Unmapped {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", n.SystemID, n.Hostname, strings.Join(n.MACs, ","))
+	}
+	fmt.Fprintf(w, "\nCONFLICTS (%d)\nHOSTNAME\tMACS\tREASON\n", len(report.Conflicts))
+	for _, c := range report.Conflicts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Hostname, strings.Join(c.MACs, ","), c.Reason)
+	}
+	w.Flush()
 }
 
 func main() {
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [help | check | status | check-mappings | export-csv]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  help    display this message\n")
+		fmt.Fprintf(os.Stderr, "  check   validate the configuration without contacting MAAS\n")
+		fmt.Fprintf(os.Stderr, "  status  report the status of each node, as JSON, and how long it has been in that state\n")
+		fmt.Fprintf(os.Stderr, "  check-mappings  report how the mappings match the nodes, exiting non-zero on conflicts\n")
+		fmt.Fprintf(os.Stderr, "  export-csv  write the nodes that match the filter as CSV, to stdout or the file given by -out\n\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	options := ProcessingOptions{
-		Preview:      *preview,
-		Verbose:      *verbose,
-		AlwaysRename: *always,
+	// Write the log to a file, rotated by size, when asked, so the utility
+	// can be run without something collecting its output
+	if *logFile != "" {
+		if *logMaxSize < 1 || *logMaxBackups < 0 {
+			log.Fatalf("[error] invalid options: log-max-size must be at least 1 and log-max-backups must not be negative")
+		}
+		file, err := openRotatingFile(*logFile, int64(*logMaxSize)*1024*1024, *logMaxBackups)
+		checkError(err, "unable to open the log file '%s' : %s", *logFile, err)
+		if *logConsole {
+			log.SetOutput(io.MultiWriter(file, os.Stderr))
+		} else {
+			log.SetOutput(file)
+		}
+	}
+
+	command := flag.Arg(0)
+	switch command {
+	case "", "check", "status", "check-mappings", "export-csv":
+	case "help":
+		flag.Usage()
+		return
+	default:
+		flag.Usage()
+		log.Fatalf("[error] unknown command '%s'", command)
+	}
+
+	// In preview mode the nodes are only processed once, so skipping the
+	// initial pass would mean they are never processed
+	if *skipInitial && *preview {
+		log.Fatalf("[error] invalid options: skip-initial-pass cannot be used with preview")
+	}
+	if *hold && *preview {
+		log.Fatalf("[error] invalid options: hold cannot be used with preview")
+	}
+	if *writePlan != "" && !*preview {
+		log.Fatalf("[error] invalid options: write-plan can only be used with preview")
+	}
+	if *executePlan != "" && (*preview || *hold || *skipInitial) {
+		log.Fatalf("[error] invalid options: execute-plan cannot be used with preview, hold or skip-initial-pass")
+	}
+	if *readOnly && (*hold || *executePlan != "" || *enlistManifest != "") {
+		log.Fatalf("[error] invalid options: read-only cannot be used with hold, execute-plan or enlist-manifest")
+	}
+
+	// The rename mode replaces always-rename, which is only used when no
+	// rename mode is given, so giving both is ambiguous
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "always-rename" && *renameMode != "" {
+			log.Fatalf("[error] invalid options: always-rename cannot be used with rename-mode")
+		}
+	})
+
+	options := maasflow.ProcessingOptions{
+		Preview:                 *preview,
+		ReadOnly:                *readOnly,
+		Verbose:                 *verbose,
+		AlwaysRename:            *always,
+		RenameMode:              *renameMode,
+		AnnotateNodes:           *annotate,
+		StrictTransitions:       *strict,
+		SkipExternallyAllocated: !*autoDeployAllocated,
+		SkipTestFailed:          *skipTestFailed,
+		Owner:                   *owner,
+		AgentName:               *agentName,
+		LockNodes:               *lockNodes,
+		InstanceID:              *instanceID,
+		StabilityPasses:         *stabilityPasses,
+		TargetDeployed:          *targetDeployed,
+		EnsureTag:               *ensureTag,
+		ManagedTag:              *managedTag,
+		NameTemplate:            *nameTemplate,
+		DeferAcquireName:        !*acquireSetName,
+		ArmDestructive:          *armDestructive,
+		ScaleDown:               *scaleDown,
+		ReclaimableTag:          *reclaimableTag,
+		MaxReleasesPerPass:      *maxReleasesPerPass,
+		OscillationPasses:       *oscillationPasses,
+		NoProgressPasses:        *noProgressPasses,
+		PowerCycleStuck:         *powerCycleStuck,
+		PowerCycleAttempts:      *powerCycleAttempts,
+		ReleaseFailedErase:      *releaseFailedErase,
+		FastRelease:             *fastRelease,
+		Rollout:                 *rollout,
+	}
+	if *zoneOrder != "" {
+		options.ZoneOrder = strings.Split(*zoneOrder, ",")
+	}
+	for _, name := range strings.Split(*selectionStrategy, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			options.SelectionStrategy = append(options.SelectionStrategy, name)
+		}
+	}
+
+	// Counting the nodes deployed requires every node to be fetched
+	if *targetDeployed > 0 && *fullFetchEvery != 1 {
+		log.Fatalf("[error] invalid options: target-deployed requires full-fetch-every to be 1, so the deployed nodes are counted")
+	}
+	for _, name := range strings.Split(*traceNodes, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			options.TraceNodes = append(options.TraceNodes, name)
+		}
 	}
 
-	// Determine the filter, this can either be specified on the the command
-	// line as a value or a file reference. If none is specified the default
-	// will be used
-	if len(*filterSpec) > 0 {
-		if (*filterSpec)[0] == '@' {
-			name := os.ExpandEnv((*filterSpec)[1:])
+	// Determine the nodes to which the automation is restricted, this can
+	// either be specified on the command line as a comma separated list or a
+	// file reference to a list
+	if len(*nodeIDs) > 0 {
+		if (*nodeIDs)[0] == '@' {
+			name := os.ExpandEnv((*nodeIDs)[1:])
 			file, err := os.OpenFile(name, os.O_RDONLY, 0)
-			checkError(err, "[error] unable to open file '%s' to load the filter : %s", name, err)
-			decoder := json.NewDecoder(file)
-			err = decoder.Decode(&options.Filter)
-			checkError(err, "[error] unable to parse filter configuration from file '%s' : %s", name, err)
+			checkError(err, "unable to open file '%s' to load the node ids : %s", name, err)
+			err = decodeFile(name, file, &options.NodeIDs)
+			checkError(err, "unable to parse node ids from file '%s' : %s", name, err)
 		} else {
-			err := json.Unmarshal([]byte(*filterSpec), &options.Filter)
-			checkError(err, "[error] unable to parse filter specification: '%s' : %s", *filterSpec, err)
+			for _, id := range strings.Split(*nodeIDs, ",") {
+				if id = strings.TrimSpace(id); id != "" {
+					options.NodeIDs = append(options.NodeIDs, id)
+				}
+			}
 		}
-	} else {
-		err := json.Unmarshal([]byte(defaultFilter), &options.Filter)
-		checkError(err, "[error] unable to parse default filter specificiation: '%s' : %s", defaultFilter, err)
 	}
 
-	// Determine the mac to name mapping, this can either be specified on the the command
-	// line as a value or a file reference. If none is specified the default
-	// will be used
-	if len(*mappings) > 0 {
-		if (*mappings)[0] == '@' {
-			name := os.ExpandEnv((*mappings)[1:])
+	// Determine the filter and the mac to name mapping, each can either be
+	// specified on the the command line as a value or a file reference. If
+	// none is specified the default will be used
+	var err error
+	var skipped []error
+	options.Filter, skipped, err = loadFilter(*filterSpec, *filterAnchored, *filterLenient, *expandFileVars)
+	checkError(err, "%s", err)
+	if len(skipped) > 0 {
+		log.Printf("[warn] %s", summarizeSkipped(skipped))
+	}
+
+	// The default filter matches every node in the default zone, which in a
+	// shared MAAS is rarely what is intended, so make its use obvious
+	explicitFilter := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "filter" {
+			explicitFilter = true
+		}
+	})
+	if !explicitFilter {
+		if *requireFilter {
+			log.Fatalf("[error] no filter specified and require-explicit-filter is set, specify the nodes on which to operate with -filter")
+		}
+		log.Printf("[warn] ******************************************************************")
+		log.Printf("[warn] no filter specified, the default filter matches every node in the default zone")
+		log.Printf("[warn] ******************************************************************")
+	}
+	options.Mappings, err = loadMappings(*mappings, *expandFileVars)
+	checkError(err, "%s", err)
+
+	// Determine any overrides of the names of the MAAS statuses, the names
+	// are validated against the transition table with the rest of the options
+	overrides, err := loadStatusMap(*statusMap)
+	checkError(err, "%s", err)
+	err = maasflow.SetStatusNames(overrides)
+	checkError(err, "invalid status map : %s", err)
+
+	// Determine the machines to enlist, this can either be specified on the
+	// command line as a value or a file reference. If none is specified no
+	// machines are enlisted
+	var manifest []maasflow.EnlistEntry
+	if len(*enlistManifest) > 0 {
+		if (*enlistManifest)[0] == '@' {
+			name := os.ExpandEnv((*enlistManifest)[1:])
 			file, err := os.OpenFile(name, os.O_RDONLY, 0)
-			checkError(err, "[error] unable to open file '%s' to load the mac name mapping : %s", name, err)
-			decoder := json.NewDecoder(file)
-			err = decoder.Decode(&options.Mappings)
-			checkError(err, "[error] unable to parse filter configuration from file '%s' : %s", name, err)
+			checkError(err, "unable to open file '%s' to load the enlist manifest : %s", name, err)
+			err = decodeFile(name, file, &manifest)
+			checkError(err, "unable to parse enlist manifest from file '%s' : %s", name, err)
 		} else {
-			err := json.Unmarshal([]byte(*mappings), &options.Mappings)
-			checkError(err, "[error] unable to parse mac name mapping: '%s' : %s", *mappings, err)
+			err := json.Unmarshal([]byte(*enlistManifest), &manifest)
+			checkError(err, "unable to parse enlist manifest: '%s' : %s", *enlistManifest, err)
 		}
-	} else {
-		err := json.Unmarshal([]byte(defaultMapping), &options.Mappings)
-		checkError(err, "[error] unable to parse default mac name mappings: '%s' : %s", defaultMapping, err)
+		err := maasflow.ValidateManifest(manifest)
+		checkError(err, "%s", err)
 	}
 
-	// Verify the specified period for queries can be converted into a Go duration
-	period, err := time.ParseDuration(*queryPeriod)
-	checkError(err, "[error] unable to parse specified query period duration: '%s': %s", queryPeriod, err)
+	// Load the reviewed plan to execute, only the actions in the plan are
+	// then taken
+	if *executePlan != "" {
+		plan, err := maasflow.LoadPlan(*executePlan)
+		checkError(err, "unable to load the plan : %s", err)
+		options.Plan = &plan
+		log.Printf("[info] executing the plan of %d actions made at %s", len(plan.Nodes), plan.Created.Format(time.RFC3339))
+	}
 
-	authClient, err := maas.NewAuthenticatedClient(*maasURL, *apiKey, *apiVersion)
-	if err != nil {
-		checkError(err, "[error] Unable to use specified client key, '%s', to authenticate to the MAAS server: %s", *apiKey, err)
+	// Determine the resource pools into which nodes are aquired. The
+	// existence of the pools is validated by MAAS when a node is aquired.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "resource-pool" && strings.TrimSpace(*resourcePool) == "" {
+			log.Fatalf("[error] resource-pool must not be empty when specified")
+		}
+	})
+	options.ResourcePool = *resourcePool
+	err = json.Unmarshal([]byte(*zoneResourcePools), &options.ZoneResourcePools)
+	checkError(err, "unable to parse zone resource pools: '%s' : %s", *zoneResourcePools, err)
+	for zone, pool := range options.ZoneResourcePools {
+		if strings.TrimSpace(pool) == "" {
+			log.Fatalf("[error] resource pool for zone '%s' must not be empty", zone)
+		}
+	}
+
+	// Determine the kernel options with which the nodes are deployed
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "deploy-kernel-opts" && strings.TrimSpace(*deployKernelOpts) == "" {
+			log.Fatalf("[error] deploy-kernel-opts must not be empty when specified")
+		}
+	})
+	options.DeployKernelOpts = strings.TrimSpace(*deployKernelOpts)
+	err = json.Unmarshal([]byte(*zoneDeployKernelOpts), &options.ZoneDeployKernelOpts)
+	checkError(err, "unable to parse zone deploy kernel options: '%s' : %s", *zoneDeployKernelOpts, err)
+
+	// Determine the additional parameters with which nodes are aquired. As
+	// they are passed to MAAS verbatim each must be a string, the names are
+	// validated with the rest of the options
+	var params map[string]interface{}
+	err = json.Unmarshal([]byte(*acquireParams), &params)
+	checkError(err, "unable to parse acquire parameters: '%s' : %s", *acquireParams, err)
+	options.AcquireParams = make(map[string]string, len(params))
+	for key, value := range params {
+		s, ok := value.(string)
+		if !ok {
+			log.Fatalf("[error] acquire parameter '%s' must be a string, not %v", key, value)
+		}
+		options.AcquireParams[key] = s
+	}
+
+	// Determine how the disks of the nodes are erased when released, these
+	// are validated with the rest of the options
+	options.ReleaseErase = *releaseErase
+	err = json.Unmarshal([]byte(*zoneReleaseErase), &options.ZoneReleaseErase)
+	checkError(err, "unable to parse zone release erase modes: '%s' : %s", *zoneReleaseErase, err)
+
+	// Determine the options with which nodes are commissioned, these are
+	// validated with the rest of the options
+	err = json.Unmarshal([]byte(*commissionOptions), &options.CommissionOptions)
+	checkError(err, "unable to parse commission options: '%s' : %s", *commissionOptions, err)
+	err = json.Unmarshal([]byte(*zoneTestingScripts), &options.ZoneTestingScripts)
+	checkError(err, "unable to parse zone testing scripts: '%s' : %s", *zoneTestingScripts, err)
+
+	// Determine the validators guarding the transitions, these are
+	// validated with the rest of the options
+	var guards map[string]string
+	err = json.Unmarshal([]byte(*transitionGuards), &guards)
+	checkError(err, "unable to parse transition guards: '%s' : %s", *transitionGuards, err)
+	options.Guards = make(map[string][]string, len(guards))
+	for state, names := range guards {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				options.Guards[state] = append(options.Guards[state], name)
+			}
+		}
+	}
+
+	// Determine the state timeouts, a map of state name to a duration
+	var timeouts map[string]string
+	err = json.Unmarshal([]byte(*stateTimeouts), &timeouts)
+	checkError(err, "unable to parse state timeouts: '%s' : %s", *stateTimeouts, err)
+
+	// Verify all the specified durations can be converted into Go durations
+	period, err := parseDuration("period", *queryPeriod)
+	checkError(err, "%s", err)
+	options.ActionCooldown, err = parseDuration("action-cooldown", *actionCooldown)
+	checkError(err, "%s", err)
+	options.StuckTimeout, err = parseDuration("stuck-timeout", *stuckTimeout)
+	checkError(err, "%s", err)
+	options.DeployPoll, err = parseDuration("deploy-poll", *deployPoll)
+	checkError(err, "%s", err)
+	options.DeployPollInterval, err = parseDuration("deploy-poll-interval", *deployPollInterval)
+	checkError(err, "%s", err)
+	latency, err := parseDuration("backpressure-latency", *backpressureLatency)
+	checkError(err, "%s", err)
+	if latency < 0 || *backpressureErrorRate < 0 || *backpressureErrorRate > 1 {
+		log.Fatalf("[error] invalid options: backpressure-latency must not be negative and backpressure-error-rate must be between 0 and 1")
+	}
+	notifyTimeout, err := parseDuration("webhook-timeout", *webhookTimeout)
+	checkError(err, "%s", err)
+	if notifyTimeout <= 0 || *webhookRetries < 0 {
+		log.Fatalf("[error] invalid options: webhook-timeout must be greater than zero and webhook-retries must not be negative")
+	}
+	window, err := parseDuration("notification-window", *notificationWindow)
+	checkError(err, "%s", err)
+	if window < 0 {
+		log.Fatalf("[error] invalid options: notification-window must not be negative")
+	}
+	options.StateTimeouts = make(map[string]time.Duration)
+	for state, value := range timeouts {
+		options.StateTimeouts[state], err = parseDuration("state-timeouts "+state, value)
+		checkError(err, "%s", err)
+	}
+
+	// Read the credentials with which to access MAAS from the credentials
+	// directory, if specified, in preference to the command line
+	var caCert string
+	if *credentialsDir != "" {
+		*maasURL, err = readCredential(*credentialsDir, "MAAS_URL", false)
+		checkError(err, "%s", err)
+		*apiKey, err = readCredential(*credentialsDir, "API_KEY", false)
+		checkError(err, "%s", err)
+		caCert, err = readCredential(*credentialsDir, "CA_CERT", true)
+		checkError(err, "%s", err)
+	}
+
+	// Determine the API key with which to access MAAS
+	key, err := resolveAPIKey(*apiKey, *consumerKey, *tokenKey, *tokenSecret)
+	checkError(err, "invalid options: %s", err)
+
+	// Verify the options are consistent with the transition table
+	err = options.Validate()
+	checkError(err, "invalid configuration : %s", err)
+
+	// When checking the configuration all that remains is to report it is
+	// valid, as any error has already been reported with a non-zero exit
+	if command == "check" {
+		log.Printf("[info] configuration is valid")
+		return
+	}
+
+	maasflow.SetGlobalConcurrency(*globalConcurrency)
+	maasflow.SetCordoned(*cordon)
+	maasflow.SetRateLimit(*maxRPS)
+	maasflow.SetBackpressure(latency, *backpressureErrorRate)
+
+	// Deliver the notifications in the background, so a slow webhook never
+	// holds up a pass, until shutdown
+	if *webhookURL != "" {
+		maasflow.SetNotifiers([]maasflow.Notifier{maasflow.Webhook{URL: *webhookURL}}, notifyTimeout, *webhookRetries)
+	}
+	maasflow.SetNotificationWindow(window)
+	notifyCtx, stopNotifying := context.WithCancel(context.Background())
+	maasflow.StartNotifications(notifyCtx)
+	defer maasflow.FlushNotifications()
+
+	// Polling the deploys in progress stops on shutdown
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	maasflow.SetDeployPollContext(pollCtx)
+	defer stopPolling()
+
+	// Export the metrics and the status of the matched nodes, if requested,
+	// in the background
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", maasflow.MetricsHandler())
+		mux.Handle("/status", maasflow.StatusHandler())
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, mux)
+			checkError(err, "unable to export metrics on '%s' : %s", *metricsAddr, err)
+		}()
+	}
+
+	// Serve the profiling endpoints, if requested, in the background. These
+	// expose the internals of the process so are only served when asked for.
+	if *pprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			err := http.ListenAndServe(*pprofAddr, mux)
+			checkError(err, "unable to serve profiling endpoints on '%s' : %s", *pprofAddr, err)
+		}()
 	}
 
 	// Create an object through which we will communicate with MAAS
-	client := maas.NewMAAS(*authClient)
+	err = maasflow.SetProxy(*proxyURL)
+	checkError(err, "%s", err)
+	if caCert != "" {
+		err = maasflow.SetCACert([]byte(caCert))
+		checkError(err, "invalid CA certificate in '%s' : %s", *credentialsDir, err)
+	}
+	var client *maas.MAASObject
+	if *readOnly && key == "" {
+		client, err = maasflow.NewAnonymousClient(*maasURL, *apiVersion)
+		checkError(err, "unable to create an anonymous client for the MAAS server : %s", err)
+	} else {
+		client, err = maasflow.NewClient(*maasURL, key, *apiVersion)
+		if err != nil {
+			checkError(err, "Unable to use specified client key, '%s', to authenticate to the MAAS server: %s", key, err)
+		}
+	}
+	if *readOnly {
+		log.Printf("[info] read only, the nodes are observed but never acted on")
+	}
+
+	// When reporting the status, the state tracked by a previous run, if
+	// persisted, provides how long each node has been in its state
+	if command == "status" {
+		if *stateFile != "" {
+			err = maasflow.LoadState(*stateFile)
+			checkError(err, "unable to load state from '%s' : %s", *stateFile, err)
+		}
+		nodes, _, err := maasflow.FetchNodes(client)
+		checkError(err, "unable to fetch the nodes : %s", err)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(maasflow.Status(nodes, maasflow.CurrentClock().Now()))
+		checkError(err, "unable to write the status : %s", err)
+		return
+	}
+
+	// Report how the mappings match the nodes known to MAAS, so that a new
+	// mapping file can be checked before it is used
+	if command == "check-mappings" {
+		nodes, _, err := maasflow.FetchNodes(client)
+		checkError(err, "unable to fetch the nodes : %s", err)
+		report := maasflow.CheckMappings(nodes, options.Mappings)
+		printMappingReport(os.Stdout, report)
+		if len(report.Conflicts) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Export the nodes that match the filter for those that work from
+	// spreadsheets rather than MAAS
+	if command == "export-csv" {
+		nodes, _, err := maasflow.FetchNodes(client)
+		checkError(err, "unable to fetch the nodes : %s", err)
+		out := io.Writer(os.Stdout)
+		if *exportOut != "" {
+			file, err := os.Create(*exportOut)
+			checkError(err, "unable to create '%s' : %s", *exportOut, err)
+			defer file.Close()
+			out = file
+		}
+		err = maasflow.WriteCSV(out, nodes, options.Filter)
+		checkError(err, "unable to write the nodes as CSV : %s", err)
+		return
+	}
+
+	// Make the effective state machine obvious, as the options change the
+	// actions taken from some states
+	log.Printf("[info] transitions to the target state:")
+	for _, line := range options.DescribeTransitions() {
+		log.Printf("[info]   %s", line)
+	}
+
+	// To recognize the nodes allocated by others the automation must know
+	// which user it is
+	if options.SkipExternallyAllocated && options.Owner == "" && !*readOnly {
+		options.Owner, err = maasflow.WhoAmI(client)
+		checkError(err, "unable to determine the MAAS user as which nodes are aquired, specify it with -owner : %s", err)
+		log.Printf("[info] nodes allocated by users other than '%s' will not be deployed", options.Owner)
+	}
+
+	// Create any machines in the manifest that MAAS does not yet know about,
+	// they are then driven by the normal processing of the nodes
+	err = maasflow.Enlist(client, manifest, options)
+	checkError(err, "unable to enlist the machines in the manifest : %s", err)
+
+	// Restore the state tracked across passes and persist it after each pass
+	// and on shutdown
+	if *stateFile != "" {
+		err = maasflow.LoadState(*stateFile)
+		checkError(err, "unable to load state from '%s' : %s", *stateFile, err)
+	}
+	saveState := func() {
+		if *stateFile != "" {
+			err := maasflow.SaveState(*stateFile)
+			checkWarn(err, "unable to save state to '%s' : %s", *stateFile, err)
+		}
+	}
+
+	// Once the credentials have stopped working retrying is pointless, so
+	// exit and let the orchestrator restart with fresh credentials
+	checkAuth := func() {
+		if *maxAuthFailures > 0 && maasflow.ConsecutiveAuthFailures() >= *maxAuthFailures {
+			log.Fatalf("[error] %d consecutive requests to MAAS failed authentication, exiting",
+				maasflow.ConsecutiveAuthFailures())
+		}
+	}
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	// Cordon, or uncordon, the automation each time SIGUSR2 is received, the
+	// cordon takes effect from the next node processed
+	logCordon := func() {
+		if maasflow.Cordoned() {
+			log.Printf("[info] cordoned, no new work will be started, send SIGUSR2 to pid %d to uncordon", os.Getpid())
+		} else {
+			log.Printf("[info] uncordoned, new work will be started")
+		}
+	}
+	if *cordon {
+		logCordon()
+	}
+	toggleCordon := make(chan os.Signal, 1)
+	signal.Notify(toggleCordon, syscall.SIGUSR2)
+	go func() {
+		for range toggleCordon {
+			maasflow.SetCordoned(!maasflow.Cordoned())
+			logCordon()
+		}
+	}()
+
+	// Fetch the nodes to process in a pass. To reduce the load on the MAAS
+	// server the full list of nodes is only fetched every "full-fetch-every"
+	// passes, in between only the nodes still being driven towards the target
+	// state are fetched individually, and the pass is marked as partial. The
+	// first pass always fetches the full list.
+	passes := 0
+	fetch := func(passOptions *maasflow.ProcessingOptions) []maasflow.MaasNode {
+		defer func() { passes++ }()
+		if *fullFetchEvery <= 1 || passes%*fullFetchEvery == 0 {
+			passOptions.PartialFetch = false
+			nodes, malformed, _ := maasflow.FetchNodes(client, passOptions.NodeFields()...)
+			if malformed > 0 {
+				log.Printf("[warn] %d of the nodes listed by MAAS could not be parsed and are not processed", malformed)
+			}
+			return nodes
+		}
+		passOptions.PartialFetch = true
+		nodes, _ := maasflow.FetchNodesByID(client, maasflow.PendingNodeIDs())
+		return nodes
+	}
 
 	// This utility essentially polls the MAAS server for node state and
 	// process the node to the next state. This is done by kicking off the
 	// process every specified duration. This means that the first processing of
 	// nodes will have "period" in the future. This is really not the behavior
 	// we want, we really want, do it now, and then do the next one in "period".
-	// So, the code does one now.
-	nodes, _ := fetchNodes(client)
-	ProcessAll(client, nodes, options)
+	// So, the code does one now, unless the operator has asked to wait for the
+	// first period, i.e. to let a just started MAAS settle.
+	//
+	// When holding, the periodic passes only observe the nodes, as in preview
+	// mode, and a real pass is only performed when triggered by SIGUSR1.
+	observe := options
+	trigger := make(chan os.Signal, 1)
+	if *hold {
+		observe.Preview = true
+		signal.Notify(trigger, syscall.SIGUSR1)
+		log.Printf("[info] holding, send SIGUSR1 to pid %d to trigger a single pass", os.Getpid())
+	}
+
+	if !*skipInitial {
+		nodes := fetch(&observe)
+		results := maasflow.ProcessAll(client, nodes, observe)
+		saveState()
+		checkAuth()
+
+		// The plan of a preview pass is written for review, to be executed
+		// later with execute-plan
+		if *writePlan != "" {
+			err := maasflow.WritePlan(*writePlan, maasflow.NewPlan(results))
+			checkError(err, "unable to write the plan to '%s' : %s", *writePlan, err)
+			log.Printf("[info] wrote the plan to '%s'", *writePlan)
+		}
+
+		// In strict mode a run once, preview, pass fails if any nodes could
+		// not be processed
+		if *preview && *strict {
+			for _, result := range results {
+				if result.Err != nil {
+					log.Fatalf("[error] one or more nodes could not be processed")
+				}
+			}
+		}
+
+		// A run once, preview, pass can use convergence as its success
+		// criterion
+		if *preview && *untilConverged && !maasflow.Converged() {
+			log.Fatalf("[error] the matched nodes have not converged")
+		}
+	}
+
+	// A plan is executed once, waiting for its actions to complete
+	if *executePlan != "" {
+		maasflow.WaitForActions()
+		saveState()
+		log.Printf("[info] executed the plan")
+		return
+	}
+
+	// Once no work remains there is nothing more to do when running until
+	// converged
+	exitConverged := func() bool {
+		if !*untilConverged || !maasflow.Converged() {
+			return false
+		}
+		maasflow.WaitForActions()
+		saveState()
+		log.Printf("[info] the matched nodes have converged, exiting")
+		return true
+	}
+	if !*preview && !*skipInitial && exitConverged() {
+		return
+	}
 
 	if !(*preview) {
-		// Create a ticker and fetch and process the nodes every "period"
-		ticker := time.NewTicker(period)
-		for t := range ticker.C {
-			log.Printf("[info] query server at %s", t)
-			nodes, _ := fetchNodes(client)
-			ProcessAll(client, nodes, options)
+		// Create a ticker and fetch and process the nodes every "period". The
+		// passes are run in the background so that a tick that arrives while
+		// a pass is still running, i.e. with a short period, can be skipped
+		// rather than starting overlapping passes.
+		ticker := maasflow.CurrentClock().NewTicker(period)
+		running := false
+		triggered := false
+		ticks := 0
+		done := make(chan struct{}, 1)
+		startPass := func(passOptions maasflow.ProcessingOptions) {
+			running = true
+			go func() {
+				nodes := fetch(&passOptions)
+				maasflow.ProcessAll(client, nodes, passOptions)
+				saveState()
+				checkAuth()
+				done <- struct{}{}
+			}()
+		}
+		triggerPass := func() string {
+			if running {
+				log.Printf("[info] triggered, performing a single pass once the previous pass completes")
+				triggered = true
+				return "ok, pass will be performed once the previous pass completes"
+			}
+			log.Printf("[info] triggered, performing a single pass before returning to holding")
+			startPass(options)
+			return "ok, pass started"
+		}
+
+		// Accept control commands, if requested, which are performed by this
+		// loop between its other work. The listener is unauthenticated.
+		var control chan controlRequest
+		if *controlAddr != "" {
+			listener, err := listenControl(*controlAddr)
+			checkError(err, "unable to accept control commands on '%s' : %s", *controlAddr, err)
+			control = make(chan controlRequest)
+			go serveControl(listener, control)
+			log.Printf("[info] accepting control commands on '%s'", *controlAddr)
+		}
+		perform := func(command string) string {
+			switch command {
+			case "pause":
+				observe.Preview = true
+				log.Printf("[info] paused, the nodes will be observed but not acted on")
+				return "ok, paused"
+			case "resume":
+				observe.Preview = false
+				log.Printf("[info] resumed, the nodes will be acted on")
+				return "ok, resumed"
+			case "trigger":
+				return triggerPass()
+			case "cordon", "uncordon":
+				maasflow.SetCordoned(command == "cordon")
+				logCordon()
+				return "ok, " + command + "ed"
+			case "reload":
+				filter, skipped, err := loadFilter(*filterSpec, *filterAnchored, *filterLenient, *expandFileVars)
+				if err == nil {
+					err = filter.Validate()
+				}
+				if err != nil {
+					log.Printf("[warn] unable to reload the filter, keeping the current filter : %s", err)
+					return "error, " + err.Error()
+				}
+				mappings, err := loadMappings(*mappings, *expandFileVars)
+				if err != nil {
+					log.Printf("[warn] unable to reload the mappings, keeping the current mappings : %s", err)
+					return "error, " + err.Error()
+				}
+				if len(skipped) > 0 {
+					log.Printf("[warn] %s", summarizeSkipped(skipped))
+				}
+				options.Filter, observe.Filter = filter, filter
+				options.Mappings, observe.Mappings = mappings, mappings
+				log.Printf("[info] reloaded the filter and mappings")
+				return "ok, reloaded"
+			case "status":
+				return fmt.Sprintf("paused=%t cordoned=%t running=%t converged=%t", observe.Preview, maasflow.Cordoned(), running, maasflow.Converged())
+			}
+			return fmt.Sprintf("error, unknown command '%s', expected one of pause, resume, trigger, cordon, uncordon, reload or status", command)
+		}
+
+		// Reload the filter and mappings each time SIGHUP is received, as
+		// with the reload control command, those fetched from a URL are then
+		// fetched again
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+
+		for {
+			select {
+			case request := <-control:
+				request.reply <- perform(request.command)
+			case <-hangup:
+				perform("reload")
+			case t := <-ticker.Chan():
+				if running {
+					log.Printf("[info] previous pass still running, skipping tick")
+					continue
+				}
+				// While MAAS is overloaded passes are only made every few
+				// periods
+				ticks++
+				if stretch := maasflow.PollStretch(); ticks < stretch {
+					log.Printf("[info] MAAS is overloaded, skipping tick, polling every %d periods", stretch)
+					continue
+				}
+				ticks = 0
+				log.Printf("[info] query server at %s", t)
+				startPass(observe)
+			case <-trigger:
+				triggerPass()
+			case <-done:
+				running = false
+				if exitConverged() {
+					return
+				}
+				if triggered {
+					triggered = false
+					log.Printf("[info] performing the triggered pass before returning to holding")
+					startPass(options)
+				}
+			case sig := <-shutdown:
+				log.Printf("[info] received %s, shutting down", sig)
+				if running {
+					log.Printf("[info] waiting for the pass in progress to complete")
+					<-done
+				}
+				stopPolling()
+				maasflow.WaitForActions()
+				saveState()
+				stopNotifying()
+				return
+			}
 		}
 	}
 }
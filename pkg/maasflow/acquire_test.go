@@ -0,0 +1,38 @@
+package maasflow
+
+import (
+	"testing"
+)
+
+func TestAcquireParams(t *testing.T) {
+	node := newTestNode(t, `{"system_id":"a","hostname":"n1","zone":{"name":"rack-1"}}`)
+	options := ProcessingOptions{
+		AcquireParams: map[string]string{"arch": "amd64", "pool": "ignored", "tags": "gpu"},
+		ResourcePool:  "team-a",
+		AgentName:     "maas-flow",
+	}
+
+	params := options.acquireParams(node)
+	want := map[string]string{"system_id": "a", "arch": "amd64", "tags": "gpu", "pool": "team-a", "agent_name": "maas-flow"}
+	if len(params) != len(want) {
+		t.Errorf("expected parameters %v, got %v", want, params)
+	}
+	for key, value := range want {
+		if got := params.Get(key); got != value {
+			t.Errorf("parameter '%s' = '%s', want '%s'", key, got, value)
+		}
+	}
+}
+
+func TestValidateAcquireParams(t *testing.T) {
+	for _, key := range []string{"", "system_id"} {
+		options := ProcessingOptions{AcquireParams: map[string]string{key: "x"}}
+		if err := options.Validate(); err == nil {
+			t.Errorf("expected the acquire parameter '%s' to be rejected", key)
+		}
+	}
+	options := ProcessingOptions{AcquireParams: map[string]string{"arch": "amd64"}}
+	if err := options.Validate(); err != nil {
+		t.Errorf("unexpected error : %s", err)
+	}
+}
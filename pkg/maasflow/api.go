@@ -0,0 +1,142 @@
+package maasflow
+
+import (
+	"math"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// throttleLogInterval how often a summary of the throttled requests is logged
+const throttleLogInterval = 10 * time.Second
+
+// tokenBucket limits the rate of requests to the MAAS server, allowing short
+// bursts of up to a second's worth of requests
+type tokenBucket struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	throttled int
+	logged    time.Time
+}
+
+// wait block until a request may be made without exceeding the rate
+func (b *tokenBucket) wait(options ProcessingOptions) {
+	b.Lock()
+	now := clock.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.throttled++
+		if now.Sub(b.logged) >= throttleLogInterval {
+			options.logf("[info] throttled %d MAAS API requests to respect the limit of %g requests per second",
+				b.throttled, b.rate)
+			b.throttled = 0
+			b.logged = now
+		}
+	}
+	b.Unlock()
+
+	if delay > 0 {
+		clock.Sleep(delay)
+	}
+}
+
+// limiter the rate limiter shared by all requests to the MAAS server, a nil
+// limiter places no limit on the rate
+var limiter *tokenBucket
+
+// SetRateLimit set the maximum number of requests per second made to the
+// MAAS server, a limit of zero or less removes the limit. This should be
+// called before any nodes are fetched or processed.
+func SetRateLimit(rps float64) {
+	if rps <= 0 {
+		limiter = nil
+		return
+	}
+	burst := math.Max(1, rps)
+	limiter = &tokenBucket{rate: rps, burst: burst, tokens: burst, last: clock.Now()}
+}
+
+// throttle wait, if required, to respect the rate limit
+func throttle(options ProcessingOptions) {
+	if limiter != nil {
+		limiter.wait(options)
+	}
+}
+
+// consecutiveAuthFailures the number of requests to the MAAS server, since
+// the last successful request, that failed authentication
+var consecutiveAuthFailures int64
+
+// ConsecutiveAuthFailures the number of requests to the MAAS server, since the
+// last successful request, that failed authentication, i.e. because the API
+// key has been revoked
+func ConsecutiveAuthFailures() int {
+	return int(atomic.LoadInt64(&consecutiveAuthFailures))
+}
+
+// checkAuth track whether requests to the MAAS server are failing to
+// authenticate, which unlike other failures will not resolve themselves
+func checkAuth(err error, options ProcessingOptions) error {
+	if err == nil {
+		atomic.StoreInt64(&consecutiveAuthFailures, 0)
+		return nil
+	}
+	if classifyMaasError(err) == ErrorAuth {
+		count := atomic.AddInt64(&consecutiveAuthFailures, 1)
+		authFailures.inc()
+		options.logf("[error] MAAS authentication failed, the API key may have been revoked (%d consecutive failures) : %s",
+			count, err)
+	}
+	return err
+}
+
+// callGet invoke an idempotent API method on a MAAS object
+func callGet(options ProcessingOptions, obj maas.MAASObject, operation string, params url.Values) (maas.JSONObject, error) {
+	throttle(options)
+	start := clock.Now()
+	result, err := obj.CallGet(operation, params)
+	pressure.record(start, err)
+	traceRequest(options, "GET", obj, operation, params, result, err)
+	return result, checkAuth(err, options)
+}
+
+// callPost invoke a non-idempotent API method on a MAAS object
+func callPost(options ProcessingOptions, obj maas.MAASObject, operation string, params url.Values) (maas.JSONObject, error) {
+	throttle(options)
+	start := clock.Now()
+	result, err := obj.CallPost(operation, params)
+	pressure.record(start, err)
+	traceRequest(options, "POST", obj, operation, params, result, err)
+	return result, checkAuth(err, options)
+}
+
+// updateObject modify a MAAS object
+func updateObject(options ProcessingOptions, obj maas.MAASObject, params url.Values) (maas.MAASObject, error) {
+	throttle(options)
+	start := clock.Now()
+	result, err := obj.Update(params)
+	pressure.record(start, err)
+	traceRequest(options, "PUT", obj, "", params, result, err)
+	return result, checkAuth(err, options)
+}
+
+// getObject retrieve a fresh copy of a MAAS object
+func getObject(options ProcessingOptions, obj maas.MAASObject) (maas.MAASObject, error) {
+	throttle(options)
+	start := clock.Now()
+	result, err := obj.Get()
+	pressure.record(start, err)
+	traceRequest(options, "GET", obj, "", url.Values{}, result, err)
+	return result, checkAuth(err, options)
+}
@@ -0,0 +1,24 @@
+package maasflow
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+func TestCheckAuthLogsRunID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { consecutiveAuthFailures = 0 }()
+
+	checkAuth(maas.ServerError{StatusCode: http.StatusUnauthorized}, ProcessingOptions{RunID: "abcd1234"})
+	if !strings.Contains(buf.String(), "[run:abcd1234] [error] MAAS authentication failed") {
+		t.Errorf("expected the authentication failure to be logged with the run id, got %q", buf.String())
+	}
+}
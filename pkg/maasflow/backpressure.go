@@ -0,0 +1,159 @@
+package maasflow
+
+import (
+	"sync"
+	"time"
+)
+
+// The bounds on the backpressure applied when MAAS is overloaded
+const (
+	// backpressureWindow how far back the responses from MAAS are considered
+	// when determining whether it is overloaded
+	backpressureWindow = time.Minute
+
+	// backpressureMinSamples the fewest responses in the window from which
+	// to determine whether MAAS is overloaded
+	backpressureMinSamples = 10
+
+	// backpressureMaxLevel the most the backpressure is increased, each
+	// level halves the concurrency and doubles the poll interval
+	backpressureMaxLevel = 3
+
+	// backpressureConcurrency the concurrency that is halved under
+	// backpressure when no global concurrency is configured
+	backpressureConcurrency = 16
+)
+
+// responseSample the outcome of a single request to MAAS
+type responseSample struct {
+	at        time.Time
+	latency   time.Duration
+	transient bool
+}
+
+// backpressure tracks the recent responses from MAAS and, once enabled with
+// SetBackpressure, the level of backpressure applied because of them
+type backpressure struct {
+	sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	samples   []responseSample
+	level     int
+}
+
+// pressure the backpressure shared by all requests to the MAAS server
+var pressure = &backpressure{}
+
+// SetBackpressure enable adaptive backpressure, reducing the concurrency and
+// lengthening the poll interval while the mean latency of the recent
+// responses from MAAS exceeds the latency, or the proportion of them that
+// are transient errors, i.e. 503s, exceeds the error rate. A zero latency or
+// error rate disables that check, both zero disables backpressure. This
+// should be called before any nodes are fetched or processed.
+func SetBackpressure(latency time.Duration, errorRate float64) {
+	pressure.Lock()
+	defer pressure.Unlock()
+	pressure.latency = latency
+	pressure.errorRate = errorRate
+	pressure.samples = nil
+	pressure.level = 0
+	backpressureLevel.set(0)
+	inFlight.setBound(globalConcurrency)
+}
+
+// record note the outcome of a request to MAAS
+func (b *backpressure) record(start time.Time, err error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.latency <= 0 && b.errorRate <= 0 {
+		return
+	}
+	now := clock.Now()
+	b.samples = append(b.prune(now), responseSample{
+		at:        now,
+		latency:   now.Sub(start),
+		transient: classifyMaasError(err) == ErrorTransient,
+	})
+}
+
+// prune the samples within the window
+func (b *backpressure) prune(now time.Time) []responseSample {
+	i := 0
+	for i < len(b.samples) && now.Sub(b.samples[i].at) > backpressureWindow {
+		i++
+	}
+	return b.samples[i:]
+}
+
+// overloaded whether the recent responses show MAAS to be overloaded, along
+// with their mean latency and error rate
+func (b *backpressure) overloaded(now time.Time) (bool, time.Duration, float64) {
+	b.samples = b.prune(now)
+	if len(b.samples) < backpressureMinSamples {
+		return false, 0, 0
+	}
+	var total time.Duration
+	errors := 0
+	for _, sample := range b.samples {
+		total += sample.latency
+		if sample.transient {
+			errors++
+		}
+	}
+	mean := total / time.Duration(len(b.samples))
+	rate := float64(errors) / float64(len(b.samples))
+	return (b.latency > 0 && mean > b.latency) || (b.errorRate > 0 && rate > b.errorRate), mean, rate
+}
+
+// adjust increase the backpressure while MAAS is overloaded and relax it once
+// MAAS recovers, one level per call, logging each adjustment
+func (b *backpressure) adjust(options ProcessingOptions) {
+	b.Lock()
+	defer b.Unlock()
+	if b.latency <= 0 && b.errorRate <= 0 {
+		return
+	}
+	overloaded, mean, rate := b.overloaded(clock.Now())
+	switch {
+	case overloaded && b.level < backpressureMaxLevel:
+		b.level++
+		options.logf("[warn] MAAS is overloaded, mean latency %s and %.0f%% transient errors, reducing concurrency to %d and polling every %d periods",
+			mean.Round(time.Millisecond), rate*100, b.concurrency(), 1<<uint(b.level))
+	case !overloaded && b.level > 0:
+		b.level--
+		options.logf("[info] MAAS is recovering, mean latency %s and %.0f%% transient errors, raising concurrency to %d and polling every %d periods",
+			mean.Round(time.Millisecond), rate*100, b.concurrency(), 1<<uint(b.level))
+	default:
+		return
+	}
+	backpressureLevel.set(float64(b.level))
+	if b.level == 0 {
+		inFlight.setBound(globalConcurrency)
+	} else {
+		inFlight.setBound(b.concurrency())
+	}
+}
+
+// concurrency the bound on the mutating actions in flight at the current
+// level, 0 for no bound
+func (b *backpressure) concurrency() int {
+	if b.level == 0 {
+		return globalConcurrency
+	}
+	base := globalConcurrency
+	if base == 0 {
+		base = backpressureConcurrency
+	}
+	if bound := base >> uint(b.level); bound > 1 {
+		return bound
+	}
+	return 1
+}
+
+// PollStretch the number of periods between the passes under the current
+// backpressure, 1 when MAAS is not overloaded
+func PollStretch() int {
+	pressure.Lock()
+	defer pressure.Unlock()
+	return 1 << uint(pressure.level)
+}
@@ -0,0 +1,88 @@
+package maasflow
+
+import (
+	"testing"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+func TestBackpressure(t *testing.T) {
+	fake := useFakeClock(t)
+	SetBackpressure(100*time.Millisecond, 0.2)
+	defer SetBackpressure(0, 0)
+	defer SetGlobalConcurrency(0)
+	SetGlobalConcurrency(4)
+
+	for i := 0; i < backpressureMinSamples; i++ {
+		var err error
+		if i%2 == 0 {
+			err = maas.ServerError{StatusCode: 503}
+		}
+		pressure.record(clock.Now(), err)
+	}
+	pressure.adjust(ProcessingOptions{})
+	if got := PollStretch(); got != 2 {
+		t.Errorf("expected the poll interval to double under errors, stretch %d", got)
+	}
+	if inFlight.bound != 2 {
+		t.Errorf("expected the concurrency to halve to 2, bound %d", inFlight.bound)
+	}
+
+	// Slow responses alone are also overload
+	fake.Advance(2 * backpressureWindow)
+	for i := 0; i < backpressureMinSamples; i++ {
+		start := clock.Now()
+		fake.Advance(time.Second)
+		pressure.record(start, nil)
+	}
+	pressure.adjust(ProcessingOptions{})
+	if got := PollStretch(); got != 4 || inFlight.bound != 1 {
+		t.Errorf("expected the backpressure to increase under latency, stretch %d, bound %d", got, inFlight.bound)
+	}
+
+	// Once the window holds too few responses to judge, MAAS is considered
+	// to have recovered
+	fake.Advance(2 * backpressureWindow)
+	pressure.adjust(ProcessingOptions{})
+	pressure.adjust(ProcessingOptions{})
+	if got := PollStretch(); got != 1 || inFlight.bound != 4 {
+		t.Errorf("expected the backpressure to be relaxed, stretch %d, bound %d", got, inFlight.bound)
+	}
+}
+
+func TestBackpressureDisabled(t *testing.T) {
+	useFakeClock(t)
+	for i := 0; i < backpressureMinSamples; i++ {
+		pressure.record(clock.Now(), maas.ServerError{StatusCode: 503})
+	}
+	pressure.adjust(ProcessingOptions{})
+	if got := PollStretch(); got != 1 {
+		t.Errorf("expected no backpressure unless enabled, stretch %d", got)
+	}
+}
+
+func TestSemaphoreLoweredBound(t *testing.T) {
+	s := newSemaphore(2)
+	s.acquire()
+	s.acquire()
+	s.setBound(1)
+
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire()
+		close(acquired)
+	}()
+	s.release()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the acquire to wait until below the lowered bound")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the acquire once below the lowered bound")
+	}
+}
@@ -0,0 +1,166 @@
+package maasflow
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxCycleStates the longest cycle of states detected as an oscillation, the
+// history kept for each node is twice this
+const maxCycleStates = 8
+
+// progressRanks how far each state is along the path to the target state, a
+// fleet whose total rank does not rise is not advancing. States off the path,
+// i.e. the failed states, rank lowest.
+var progressRanks = map[string]int{
+	"New":           1,
+	"Commissioning": 2,
+	"Ready":         3,
+	"Allocated":     4,
+	"Deploying":     5,
+	"Deployed":      6,
+}
+
+// stateEntry a state a node entered and the pass in which it was observed
+// having entered it
+type stateEntry struct {
+	State string
+	Pass  int
+}
+
+// churn the per node state history and fleet progress across passes, used to
+// detect a misconfiguration that has nodes oscillating between states or the
+// fleet taking actions without advancing
+var churn = struct {
+	sync.Mutex
+	pass        int
+	history     map[string][]stateEntry
+	oscillating map[string]bool
+	best        int
+	stalled     int
+}{
+	history:     make(map[string][]stateEntry),
+	oscillating: make(map[string]bool),
+}
+
+// repeatedCycle the cycle of states with which the history ends having been
+// entered twice in a row, starting within the given number of passes of the
+// current pass, if any
+func repeatedCycle(history []stateEntry, pass int, within int) []string {
+	n := len(history)
+	for length := 2; 2*length <= n; length++ {
+		if history[n-2*length].Pass <= pass-within {
+			break
+		}
+		repeated := true
+		for i := 0; i < length; i++ {
+			if history[n-length+i].State != history[n-2*length+i].State {
+				repeated = false
+				break
+			}
+		}
+		if repeated {
+			cycle := make([]string, 0, length+1)
+			for _, entry := range history[n-length:] {
+				cycle = append(cycle, entry.State)
+			}
+			return append(cycle, cycle[0])
+		}
+	}
+	return nil
+}
+
+// takesAction whether the result is of a mutating action started for the
+// node
+func takesAction(result NodeResult) bool {
+	if result.Skipped || result.Err != nil {
+		return false
+	}
+	for _, entry := range actionNames {
+		if entry.name == result.Action {
+			return mutatingAction(entry.action)
+		}
+	}
+	return false
+}
+
+// checkChurn record the states of the matched nodes, logging when a node's
+// states start repeating the same cycle within OscillationPasses and when
+// NoProgressPasses passes in a row take actions without the matched nodes as
+// a whole advancing towards the target state. A pass that only fetched the
+// nodes still being driven cannot tell whether the fleet advanced, so only
+// the oscillations are checked.
+func checkChurn(nodes []MaasNode, results []NodeResult, matched []int, options ProcessingOptions) {
+	if options.OscillationPasses <= 0 && options.NoProgressPasses <= 0 {
+		return
+	}
+	churn.Lock()
+	defer churn.Unlock()
+	churn.pass++
+
+	seen := make(map[string]bool, len(matched))
+	score, acted := 0, false
+	for _, i := range matched {
+		node := nodes[i]
+		id := node.SystemID()
+		seen[id] = true
+		acted = acted || takesAction(results[i])
+		state, err := node.StatusName()
+		if err != nil {
+			continue
+		}
+		score += progressRanks[state]
+
+		history := churn.history[id]
+		if len(history) == 0 || history[len(history)-1].State != state {
+			history = append(history, stateEntry{State: state, Pass: churn.pass})
+			if len(history) > 2*maxCycleStates {
+				history = history[len(history)-2*maxCycleStates:]
+			}
+			churn.history[id] = history
+		}
+		if options.OscillationPasses <= 0 {
+			continue
+		}
+		cycle := repeatedCycle(history, churn.pass, options.OscillationPasses)
+		switch {
+		case cycle != nil && !churn.oscillating[id]:
+			options.logf("[warn] node '%s' is oscillating, it has cycled through %s twice within %d passes, check the filter and transitions",
+				node.Hostname(), strings.Join(cycle, " -> "), options.OscillationPasses)
+			churn.oscillating[id] = true
+		case cycle == nil && churn.oscillating[id]:
+			delete(churn.oscillating, id)
+		}
+	}
+	if options.PartialFetch {
+		oscillatingNodes.set(float64(len(churn.oscillating)))
+		return
+	}
+	// The nodes no longer matched are forgotten
+	for id := range churn.history {
+		if !seen[id] {
+			delete(churn.history, id)
+			delete(churn.oscillating, id)
+		}
+	}
+	oscillatingNodes.set(float64(len(churn.oscillating)))
+
+	if options.NoProgressPasses <= 0 {
+		return
+	}
+	// Only passes that took actions count, a pass that took none ends the
+	// run and the next run is measured from where the nodes then are
+	if acted && score <= churn.best {
+		churn.stalled++
+		if churn.stalled == options.NoProgressPasses {
+			options.logf("[warn] no progress in %d passes, actions were taken but the matched nodes did not advance towards the target state, check the filter and transitions",
+				churn.stalled)
+		}
+	} else {
+		if churn.stalled >= options.NoProgressPasses {
+			options.logf("[info] matched nodes no longer taking actions without progress")
+		}
+		churn.best, churn.stalled = score, 0
+	}
+	noProgressPasses.set(float64(churn.stalled))
+}
@@ -0,0 +1,111 @@
+package maasflow
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// resetChurn forget the state history and progress for the duration of the
+// test
+func resetChurn(t *testing.T) {
+	reset := func() {
+		churn.Lock()
+		defer churn.Unlock()
+		churn.pass, churn.best, churn.stalled = 0, 0, 0
+		churn.history = make(map[string][]stateEntry)
+		churn.oscillating = make(map[string]bool)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestOscillationDetected(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	resetChurn(t)
+
+	options := ProcessingOptions{OscillationPasses: 6}
+	states := []string{"Ready", "Allocated", "Ready", "Allocated", "Allocated"}
+	for i, state := range states {
+		node := newTestNode(t, `{"system_id":"o","hostname":"o","status_name":"`+state+`"}`)
+		results := []NodeResult{{Action: "Wait"}}
+		checkChurn([]MaasNode{node}, results, []int{0}, options)
+		if i < 3 && strings.Contains(buf.String(), "oscillating") {
+			t.Fatalf("pass %d: unexpected oscillation reported : %s", i, buf.String())
+		}
+	}
+	if got := strings.Count(buf.String(), "node 'o' is oscillating"); got != 1 {
+		t.Errorf("expected the oscillation to be reported once, got %d : %s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "Ready -> Allocated -> Ready") &&
+		!strings.Contains(buf.String(), "Allocated -> Ready -> Allocated") {
+		t.Errorf("expected the cycle to be reported, got %s", buf.String())
+	}
+	if got := oscillatingNodes.values[""]; got != 1 {
+		t.Errorf("expected 1 oscillating node, got %g", got)
+	}
+}
+
+func TestOscillationOutsideWindowIgnored(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	resetChurn(t)
+
+	options := ProcessingOptions{OscillationPasses: 3}
+	for _, state := range []string{"Ready", "Ready", "Allocated", "Allocated", "Ready", "Ready", "Allocated"} {
+		node := newTestNode(t, `{"system_id":"s","hostname":"s","status_name":"`+state+`"}`)
+		checkChurn([]MaasNode{node}, []NodeResult{{Action: "Wait"}}, []int{0}, options)
+	}
+	if strings.Contains(buf.String(), "oscillating") {
+		t.Errorf("expected a slow cycle not to be reported, got %s", buf.String())
+	}
+}
+
+func TestNoProgressDetected(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	resetChurn(t)
+
+	options := ProcessingOptions{NoProgressPasses: 3}
+	ready := newTestNode(t, `{"system_id":"p","hostname":"p","status_name":"Ready"}`)
+	pass := func(action string) {
+		checkChurn([]MaasNode{ready}, []NodeResult{{Action: action}}, []int{0}, options)
+	}
+
+	pass("Aquire")
+	for i := 0; i < 3; i++ {
+		pass("Aquire")
+	}
+	if got := strings.Count(buf.String(), "no progress in 3 passes"); got != 1 {
+		t.Fatalf("expected the lack of progress to be reported once, got %d : %s", got, buf.String())
+	}
+	if got := noProgressPasses.values[""]; got != 3 {
+		t.Errorf("expected 3 passes without progress, got %g", got)
+	}
+
+	// A pass that takes no actions ends the run
+	buf.Reset()
+	pass("Wait")
+	if !strings.Contains(buf.String(), "no longer taking actions without progress") {
+		t.Errorf("expected the end of the run to be reported, got %s", buf.String())
+	}
+	if got := noProgressPasses.values[""]; got != 0 {
+		t.Errorf("expected the passes without progress to be reset, got %g", got)
+	}
+
+	// Advancing towards the target state is progress
+	buf.Reset()
+	for _, state := range []string{"Allocated", "Deploying", "Deployed"} {
+		node := newTestNode(t, `{"system_id":"p","hostname":"p","status_name":"`+state+`"}`)
+		checkChurn([]MaasNode{node}, []NodeResult{{Action: "Deploy"}}, []int{0}, options)
+	}
+	if strings.Contains(buf.String(), "no progress") {
+		t.Errorf("expected advancing nodes not to be reported, got %s", buf.String())
+	}
+}
@@ -0,0 +1,244 @@
+// Package maasflow drives the nodes under the control of a MAAS server through
+// their lifecycle towards a target state. It is the core of the maas-flow
+// command line utility and can be embedded in other provisioning services.
+package maasflow
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// checkWarn if the given err is not nil, then log the message as a warning and
+// return true, else return false.
+func checkWarn(err error, message string, v ...interface{}) bool {
+	if err != nil {
+		log.Printf("[warn] "+message, v...)
+		return true
+	}
+	return false
+}
+
+// SetProxy configure the proxy through which all requests to the MAAS server,
+// both queries and actions, are made. If no proxy URL is given the proxy is
+// determined from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables. As the MAAS client library always uses the default HTTP
+// transport, it is the default transport that is configured, which affects
+// all HTTP clients in the process that use it.
+func SetProxy(proxyURL string) error {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL '%s' : %s", proxyURL, err)
+		}
+		proxy = http.ProxyURL(parsed)
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("unable to configure proxy, the default HTTP transport has been replaced")
+	}
+	transport = transport.Clone()
+	transport.Proxy = proxy
+	http.DefaultTransport = transport
+	return nil
+}
+
+// SetCACert trust the given PEM encoded certificate authority, in addition
+// to the system certificate authorities, when connecting to the MAAS server.
+// As with SetProxy it is the default HTTP transport that is configured.
+func SetCACert(pem []byte) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("unable to parse any certificates from the CA certificate")
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("unable to configure CA certificate, the default HTTP transport has been replaced")
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.RootCAs = pool
+	http.DefaultTransport = transport
+	return nil
+}
+
+// NewClient create an object through which to communicate with the MAAS
+// server at the given URL, authenticated with the given API key
+func NewClient(maasURL string, apiKey string, apiVersion string) (*maas.MAASObject, error) {
+	authClient, err := maas.NewAuthenticatedClient(maasURL, apiKey, apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	return newMAAS(*authClient), nil
+}
+
+// NewAnonymousClient create a client for the MAAS server that makes its
+// requests without authenticating, for a MAAS that allows anonymous read
+// access, see ProcessingOptions.ReadOnly
+func NewAnonymousClient(maasURL string, apiVersion string) (*maas.MAASObject, error) {
+	anonClient, err := maas.NewAnonymousClient(maasURL, apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	return newMAAS(*anonClient), nil
+}
+
+// ErrNetwork a request to the MAAS server failed without a response from the
+// server, i.e. the server could not be reached
+type ErrNetwork struct {
+	Operation string
+	Err       error
+}
+
+func (e ErrNetwork) Error() string {
+	return fmt.Sprintf("network failure attempting to %s : %s", e.Operation, e.Err)
+}
+
+// ErrErrorPayload the MAAS server responded successfully, but the response
+// was not of the expected shape, i.e. an error object rather than a list
+type ErrErrorPayload struct {
+	Operation string
+	Message   string
+}
+
+func (e ErrErrorPayload) Error() string {
+	return fmt.Sprintf("MAAS returned an error payload attempting to %s : %s", e.Operation, e.Message)
+}
+
+// maxPayloadMessage the longest raw response included in an error message
+const maxPayloadMessage = 200
+
+// describePayload summarize a response that was not of the expected shape,
+// preferring any error message it contains over the raw response
+func describePayload(obj maas.JSONObject) string {
+	if attrs, err := obj.GetMap(); err == nil {
+		for _, key := range []string{"error", "message", "detail"} {
+			if msg, err := attrs[key].GetString(); err == nil {
+				return msg
+			}
+		}
+	}
+	body, _ := obj.GetBytes()
+	if len(body) > maxPayloadMessage {
+		return string(body[:maxPayloadMessage]) + "..."
+	}
+	return string(body)
+}
+
+// identities the MAAS user as which each client is authenticated, as this
+// does not change the lookup is only made once per client
+var identities = struct {
+	sync.Mutex
+	usernames map[*maas.MAASObject]string
+}{usernames: make(map[*maas.MAASObject]string)}
+
+// WhoAmI determine the name of the MAAS user as which the client is
+// authenticated, i.e. to distinguish the nodes the automation owns from those
+// owned by others
+func WhoAmI(client *maas.MAASObject) (string, error) {
+	identities.Lock()
+	defer identities.Unlock()
+	if username, ok := identities.usernames[client]; ok {
+		return username, nil
+	}
+	username, err := whoAmI(client)
+	if err != nil {
+		return "", err
+	}
+	identities.usernames[client] = username
+	return username, nil
+}
+
+// whoAmI look up the name of the MAAS user as which the client is
+// authenticated
+func whoAmI(client *maas.MAASObject) (string, error) {
+	result, err := callGet(ProcessingOptions{}, client.GetSubObject("users"), "whoami", url.Values{})
+	if err != nil {
+		return "", err
+	}
+	attrs, err := result.GetMap()
+	if err != nil {
+		return "", ErrErrorPayload{Operation: "determine the current user", Message: describePayload(result)}
+	}
+	username, err := attrs["username"].GetString()
+	if err != nil || username == "" {
+		return "", ErrErrorPayload{Operation: "determine the current user", Message: describePayload(result)}
+	}
+	return username, nil
+}
+
+// FetchNodes do a HTTP GET to the MAAS server to query all the nodes. Entries
+// of the listing that are not valid nodes are logged and omitted from the
+// result, along with the number of them omitted. When fields are given, see
+// ProcessingOptions.NodeFields, only those fields of the nodes are parsed and
+// kept, which is considerably cheaper for large clusters.
+func FetchNodes(client *maas.MAASObject, fields ...string) ([]MaasNode, int, error) {
+	nodeListing := client.GetSubObject("nodes")
+	var listNodeObjects maas.JSONObject
+	var err error
+	if raw, ok := rawClient(client); ok && len(fields) > 0 {
+		listNodeObjects, err = callGetProjected(ProcessingOptions{}, raw, nodeListing, "list", url.Values{}, fields)
+	} else {
+		listNodeObjects, err = callGet(ProcessingOptions{}, nodeListing, "list", url.Values{})
+	}
+	if err != nil {
+		// Error responses from the server are already described as such,
+		// anything else never reached the server
+		if _, ok := err.(maas.ServerError); !ok {
+			err = ErrNetwork{Operation: "list nodes", Err: err}
+		}
+		checkWarn(err, "unable to get the list of all nodes: %s", err)
+		return nil, 0, err
+	}
+	listNodes, err := listNodeObjects.GetArray()
+	if err != nil {
+		// Some MAAS versions return an error object, rather than an error
+		// status, so log the response to help diagnose the problem
+		body, _ := listNodeObjects.GetBytes()
+		log.Printf("[debug] response to list nodes was not a list : %s", body)
+		err = ErrErrorPayload{Operation: "list nodes", Message: describePayload(listNodeObjects)}
+		checkWarn(err, "unable to get the node objects for the list: %s", err)
+		return nil, 0, err
+	}
+
+	nodes := make([]MaasNode, 0, len(listNodes))
+	malformed := 0
+	for _, nodeObj := range listNodes {
+		node, err := nodeObj.GetMAASObject()
+		if checkWarn(err, "unable to retrieve object for node: %s", err) {
+			nodeErrors.inc("reason", "malformed")
+			malformed++
+			continue
+		}
+		nodes = append(nodes, MaasNode{node})
+	}
+	return nodes, malformed, nil
+}
+
+// FetchNodesByID do a HTTP GET to the MAAS server for each of the given nodes,
+// nodes that cannot be retrieved are logged and omitted from the result
+func FetchNodesByID(client *maas.MAASObject, ids []string) ([]MaasNode, error) {
+	nodesObj := client.GetSubObject("nodes")
+	nodes := make([]MaasNode, 0, len(ids))
+	for _, id := range ids {
+		node, err := getObject(ProcessingOptions{}, nodesObj.GetSubObject(id))
+		if !checkWarn(err, "unable to retrieve node '%s': %s", id, err) {
+			nodes = append(nodes, MaasNode{node})
+		}
+	}
+	return nodes, nil
+}
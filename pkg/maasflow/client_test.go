@@ -0,0 +1,111 @@
+package maasflow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+func TestFetchNodes(t *testing.T) {
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"system_id":"a","hostname":"n1","resource_uri":"/MAAS/api/1.0/nodes/a/"}]`))
+	}))
+	nodes, malformed, err := FetchNodes(client)
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].SystemID() != "a" || malformed != 0 {
+		t.Errorf("expected the single node 'a', got %v, %d malformed", nodes, malformed)
+	}
+}
+
+func TestFetchNodesMalformedEntry(t *testing.T) {
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"system_id":"a","hostname":"n1","resource_uri":"/MAAS/api/1.0/nodes/a/"},
+			"not a node",
+			{"system_id":"b","hostname":"n2","resource_uri":"/MAAS/api/1.0/nodes/b/"}]`))
+	}))
+	nodes, malformed, err := FetchNodes(client)
+	if err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	if malformed != 1 {
+		t.Errorf("expected 1 malformed entry, got %d", malformed)
+	}
+	if len(nodes) != 2 || nodes[0].SystemID() != "a" || nodes[1].SystemID() != "b" {
+		t.Fatalf("expected the nodes 'a' and 'b', got %v", nodes)
+	}
+	for _, node := range nodes {
+		if node.SystemID() == "" {
+			t.Errorf("expected no zero value nodes, got %v", nodes)
+		}
+	}
+}
+
+func TestFetchNodesErrorPayload(t *testing.T) {
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"error":"database is locked"}`))
+	}))
+	_, _, err := FetchNodes(client)
+	payload, ok := err.(ErrErrorPayload)
+	if !ok {
+		t.Fatalf("expected an error payload error, got %T : %v", err, err)
+	}
+	if payload.Message != "database is locked" {
+		t.Errorf("expected the error message from the payload, got '%s'", payload.Message)
+	}
+}
+
+func TestFetchNodesNetworkFailure(t *testing.T) {
+	c, err := maas.NewAnonymousClient("http://127.0.0.1:1/MAAS/", "1.0")
+	if err != nil {
+		t.Fatalf("unable to create client : %s", err)
+	}
+	_, _, err = FetchNodes(maas.NewMAAS(*c))
+	if _, ok := err.(ErrNetwork); !ok {
+		t.Fatalf("expected a network error, got %T : %v", err, err)
+	}
+}
+
+func TestFetchNodesProjected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"system_id":"a","hostname":"n1","resource_uri":"/MAAS/api/1.0/nodes/a/",` +
+			`"status_name":"Ready","commissioning_results":[{"output":"..."}],"interface_set":[{"mac_address":"aa:bb:cc:dd:ee:ff"}]}]`))
+	}))
+	defer server.Close()
+	client, err := NewAnonymousClient(server.URL+"/MAAS/", "1.0")
+	if err != nil {
+		t.Fatalf("unable to create client : %s", err)
+	}
+
+	nodes, _, err := FetchNodes(client, ProcessingOptions{}.NodeFields()...)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("expected a single node, got %v, %v", nodes, err)
+	}
+	if _, ok := nodes[0].GetMap()["commissioning_results"]; ok {
+		t.Errorf("expected the fields that are not used to be dropped, got %v", nodes[0].GetMap())
+	}
+	if len(nodes[0].MACs()) != 0 {
+		t.Errorf("expected the interfaces to be dropped when not used, got %v", nodes[0].MACs())
+	}
+	if state, _ := nodes[0].StatusName(); state != "Ready" || nodes[0].Hostname() != "n1" {
+		t.Errorf("expected the fields used to be kept, got %v", nodes[0].GetMap())
+	}
+
+	mapped := ProcessingOptions{Mappings: map[string]interface{}{"aa:bb:cc:dd:ee:ff": "n1"}}
+	nodes, _, err = FetchNodes(client, mapped.NodeFields()...)
+	if err != nil || len(nodes) != 1 || len(nodes[0].MACs()) != 1 {
+		t.Errorf("expected the interfaces to be kept when mapping, got %v, %v", nodes, err)
+	}
+
+	nodes, _, err = FetchNodes(client)
+	if _, ok := nodes[0].GetMap()["commissioning_results"]; err != nil || !ok {
+		t.Errorf("expected every field without a projection, got %v, %v", nodes[0].GetMap(), err)
+	}
+}
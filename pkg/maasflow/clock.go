@@ -0,0 +1,72 @@
+package maasflow
+
+import (
+	"time"
+)
+
+// Clock the source of time for the automation, so that the behaviours that
+// depend on time, i.e. state timeouts, cooldowns and backoffs, can be driven
+// deterministically by replacing the clock
+type Clock interface {
+	// Now the current time
+	Now() time.Time
+
+	// Sleep pause the calling goroutine for the duration
+	Sleep(d time.Duration)
+
+	// After a channel on which the time is sent once the duration has elapsed
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker a ticker that sends the time every period
+	NewTicker(period time.Duration) Ticker
+}
+
+// Ticker a source of periodic ticks, as created by a Clock
+type Ticker interface {
+	// Chan the channel on which the ticks are delivered
+	Chan() <-chan time.Time
+
+	// Stop stop delivering ticks
+	Stop()
+}
+
+// systemClock the clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTicker(period time.Duration) Ticker {
+	return systemTicker{time.NewTicker(period)}
+}
+
+// systemTicker a ticker backed by the time package
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// SystemClock the clock backed by the system time, used unless replaced with
+// SetClock
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// clock the clock used throughout the automation
+var clock Clock = systemClock{}
+
+// SetClock replace the clock used throughout the automation, i.e. with a fake
+// clock in tests. This should be called before any nodes are fetched or
+// processed.
+func SetClock(c Clock) {
+	clock = c
+}
+
+// CurrentClock the clock used throughout the automation, so that callers, i.e.
+// the scheduling of passes, observe the same time as the processing
+func CurrentClock() Clock {
+	return clock
+}
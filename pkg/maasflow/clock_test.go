@@ -0,0 +1,134 @@
+package maasflow
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock a clock that only moves when advanced, sleeping advances it by
+// the duration slept so that backoffs complete immediately
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter a channel to send the time on once the clock reaches at, and
+// the period to rearm it with if it is a ticker
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// fakeTicker a ticker driven by a fakeClock
+type fakeTicker struct {
+	clock *fakeClock
+	c     chan time.Time
+}
+
+func (t fakeTicker) Chan() <-chan time.Time { return t.c }
+
+func (t fakeTicker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, waiter := range t.clock.waiters {
+		if waiter.c == t.c {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// useFakeClock replace the clock with a fake clock for the duration of the
+// test
+func useFakeClock(t *testing.T) *fakeClock {
+	fake := &fakeClock{now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	previous := CurrentClock()
+	SetClock(fake)
+	t.Cleanup(func() { SetClock(previous) })
+	return fake
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	waiter := fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, waiter)
+	return waiter.c
+}
+
+func (c *fakeClock) NewTicker(period time.Duration) Ticker {
+	c.Lock()
+	defer c.Unlock()
+	waiter := fakeWaiter{at: c.now.Add(period), period: period, c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, waiter)
+	return fakeTicker{clock: c, c: waiter.c}
+}
+
+// Advance move the clock forward, firing the timers and tickers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		select {
+		case waiter.c <- c.now:
+		default:
+		}
+		if waiter.period > 0 {
+			for !waiter.at.After(c.now) {
+				waiter.at = waiter.at.Add(waiter.period)
+			}
+			pending = append(pending, waiter)
+		}
+	}
+	c.waiters = pending
+}
+
+func TestFakeClock(t *testing.T) {
+	fake := useFakeClock(t)
+	start := clock.Now()
+
+	after := clock.After(time.Minute)
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	clock.Sleep(30 * time.Second)
+	select {
+	case <-after:
+		t.Fatalf("expected the timer not to fire before it is due")
+	default:
+	}
+
+	fake.Advance(30 * time.Second)
+	if got := clock.Now().Sub(start); got != time.Minute {
+		t.Errorf("expected the clock to have moved a minute, moved %s", got)
+	}
+	select {
+	case <-after:
+	default:
+		t.Errorf("expected the timer to fire once due")
+	}
+	select {
+	case <-ticker.Chan():
+	default:
+		t.Errorf("expected the ticker to tick once due")
+	}
+}
@@ -0,0 +1,114 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescedFailure the identical failures within a window, the first of which
+// was delivered and the rest coalesced into a summary sent once the window
+// ends
+type coalescedFailure struct {
+	first     Event
+	until     time.Time
+	count     int
+	systemIDs []string
+}
+
+// coalescing the window within which identical failures are coalesced, and the
+// failures within the current window of each, by failureKey
+var coalescing = struct {
+	sync.Mutex
+	window   time.Duration
+	failures map[string]*coalescedFailure
+}{failures: make(map[string]*coalescedFailure)}
+
+// SetNotificationWindow set the window within which identical failures, the
+// same action failing with the same error, are coalesced. The first failure
+// is delivered at once and the rest are summarized in a single event once the
+// window ends, so a fleet wide failure, i.e. MAAS being down, does not send a
+// notification for every node. Differing failures are each delivered at once.
+// A window of zero delivers every failure. This should be called before
+// StartNotifications.
+func SetNotificationWindow(window time.Duration) {
+	coalescing.Lock()
+	defer coalescing.Unlock()
+	coalescing.window = window
+	coalescing.failures = make(map[string]*coalescedFailure)
+}
+
+// notificationWindow the window within which identical failures are coalesced
+func notificationWindow() time.Duration {
+	coalescing.Lock()
+	defer coalescing.Unlock()
+	return coalescing.window
+}
+
+// failureKey identifies identical failures, the node's system id and hostname
+// are removed from the error so that the same error for different nodes is
+// identical
+func failureKey(event Event) string {
+	message := event.Error
+	for _, name := range []string{event.SystemID, event.Hostname} {
+		if name != "" {
+			message = strings.Replace(message, name, "", -1)
+		}
+	}
+	return event.Action + "\x00" + message
+}
+
+// admitFailure whether the failure is to be delivered now, otherwise it is
+// identical to one delivered within the window and is coalesced
+func admitFailure(event Event, now time.Time) bool {
+	coalescing.Lock()
+	defer coalescing.Unlock()
+	if coalescing.window <= 0 {
+		return true
+	}
+
+	key := failureKey(event)
+	if failure, ok := coalescing.failures[key]; ok && now.Before(failure.until) {
+		failure.count++
+		failure.systemIDs = append(failure.systemIDs, event.SystemID)
+		return false
+	}
+	coalescing.failures[key] = &coalescedFailure{first: event, until: now.Add(coalescing.window),
+		count: 1, systemIDs: []string{event.SystemID}}
+	return true
+}
+
+// endedWindows the summaries of the windows that have ended as of now within
+// which failures were coalesced, the windows are forgotten so that the next
+// identical failure is delivered at once
+func endedWindows(now time.Time) []Event {
+	coalescing.Lock()
+	defer coalescing.Unlock()
+
+	var summaries []Event
+	for key, failure := range coalescing.failures {
+		if now.Before(failure.until) {
+			continue
+		}
+		delete(coalescing.failures, key)
+		if failure.count < 2 {
+			continue
+		}
+		sort.Strings(failure.systemIDs)
+		summaries = append(summaries, Event{
+			Time:      now,
+			RunID:     failure.first.RunID,
+			State:     failure.first.State,
+			Action:    failure.first.Action,
+			Error:     failure.first.Error,
+			Count:     failure.count,
+			SystemIDs: failure.systemIDs,
+			Summary: fmt.Sprintf("%d nodes failed %s in the last %s",
+				failure.count, failure.first.Action, coalescing.window),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Action < summaries[j].Action })
+	return summaries
+}
@@ -0,0 +1,91 @@
+package maasflow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingNotifier a notifier that records the events delivered to it
+type recordingNotifier struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, event Event) error {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recordingNotifier) delivered() []Event {
+	r.Lock()
+	defer r.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestIdenticalFailuresCoalesced(t *testing.T) {
+	fake := useFakeClock(t)
+	SetNotificationWindow(time.Minute)
+	t.Cleanup(func() { SetNotificationWindow(0) })
+	recorder := &recordingNotifier{}
+	useNotifiers(t, []Notifier{recorder}, time.Second, 0)
+	before := notificationsCoalesced.values[labelKey([]string{"action", "Aquire"})]
+
+	for i := 0; i < 5; i++ {
+		host := fmt.Sprintf("h%d", i)
+		notify(Event{SystemID: host, Hostname: host, State: "Ready", Action: "Aquire",
+			Error: "unable to aquire '" + host + "' : connection refused"})
+	}
+	notify(Event{SystemID: "d", Hostname: "d", State: "Allocated", Action: "Deploy", Error: "rejected"})
+	notify(Event{SystemID: "ok", Hostname: "ok", State: "Ready", Action: "Aquire"})
+	FlushNotifications()
+
+	delivered := recorder.delivered()
+	if len(delivered) != 3 || delivered[0].SystemID != "h0" || delivered[1].SystemID != "d" || delivered[2].SystemID != "ok" {
+		t.Fatalf("expected the first failure, the distinct failure and the success to be delivered, got %+v", delivered)
+	}
+	if got := notificationsCoalesced.values[labelKey([]string{"action", "Aquire"})] - before; got != 4 {
+		t.Errorf("expected 4 failures to be coalesced, got %g", got)
+	}
+
+	// Once the window ends a single summary is sent
+	fake.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.delivered()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	FlushNotifications()
+	delivered = recorder.delivered()
+	if len(delivered) != 4 {
+		t.Fatalf("expected a single summary to be sent, got %+v", delivered)
+	}
+	summary := delivered[3]
+	if summary.Count != 5 || summary.Action != "Aquire" || strings.Join(summary.SystemIDs, ",") != "h0,h1,h2,h3,h4" ||
+		summary.Summary != "5 nodes failed Aquire in the last 1m0s" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	// After the window the next identical failure is sent at once
+	notify(Event{SystemID: "h5", Hostname: "h5", Action: "Aquire", Error: "unable to aquire 'h5' : connection refused"})
+	FlushNotifications()
+	if got := len(recorder.delivered()); got != 5 {
+		t.Errorf("expected the failure after the window to be delivered, got %d events", got)
+	}
+}
+
+func TestNoWindowDeliversEveryFailure(t *testing.T) {
+	recorder := &recordingNotifier{}
+	useNotifiers(t, []Notifier{recorder}, time.Second, 0)
+	for i := 0; i < 3; i++ {
+		notify(Event{SystemID: "n", Hostname: "n", Action: "Deploy", Error: "rejected"})
+	}
+	FlushNotifications()
+	if got := len(recorder.delivered()); got != 3 {
+		t.Errorf("expected every failure to be delivered without a window, got %d", got)
+	}
+}
@@ -0,0 +1,69 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fakeNodeServer a fake MAAS serving a single node, applying updates to it and
+// recording the operations posted to it
+type fakeNodeServer struct {
+	sync.Mutex
+	node    map[string]interface{}
+	updates int
+	posts   map[string][]string
+	params  map[string]string
+}
+
+func (s *fakeNodeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	r.ParseForm()
+	switch r.Method {
+	case http.MethodPut:
+		s.updates++
+		if hostname := r.PostForm.Get("hostname"); hostname != "" {
+			s.node["hostname"] = hostname
+		}
+		if zone := r.PostForm.Get("zone"); zone != "" {
+			s.node["zone"] = map[string]interface{}{"name": zone}
+		}
+	case http.MethodPost:
+		op := r.URL.Query().Get("op")
+		s.posts[op] = append(s.posts[op], r.PostForm.Encode())
+		for key := range r.PostForm {
+			s.params[op+"."+key] = r.PostForm.Get(key)
+		}
+	}
+	json.NewEncoder(w).Encode(s.node)
+}
+
+func TestCommissionUpdatesMappingOnce(t *testing.T) {
+	attrs := `{"system_id":"c","hostname":"old","power_state":"off","zone":{"name":"default"},` +
+		`"macaddress_set":[{"mac_address":"aa:bb:cc:dd:ee:ff"}]}`
+	node := newTestNode(t, attrs)
+	server := &fakeNodeServer{node: map[string]interface{}{}, posts: map[string][]string{}, params: map[string]string{}}
+	json.Unmarshal([]byte(attrs), &server.node)
+	server.node["resource_uri"] = "/MAAS/api/1.0/nodes/c/"
+	client := newTestMAAS(t, server)
+
+	options := ProcessingOptions{
+		Mappings:           map[string]interface{}{"aa:bb:cc:dd:ee:ff": map[string]interface{}{"hostname": "new", "zone": "burn-in"}},
+		ZoneTestingScripts: map[string]string{"burn-in": "memtester"},
+		RenameMode:         RenameAlways,
+	}
+	if _, err := Commission(client, node, options); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	if server.updates != 2 {
+		t.Errorf("expected the node to be renamed and rezoned once each, got %d updates", server.updates)
+	}
+	if len(server.posts["commission"]) != 1 {
+		t.Fatalf("expected the node to be commissioned once, got %v", server.posts)
+	}
+	if scripts := server.params["commission.testing_scripts"]; scripts != "memtester" {
+		t.Errorf("expected the testing scripts of the mapped zone, got '%s'", scripts)
+	}
+}
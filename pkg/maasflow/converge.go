@@ -0,0 +1,70 @@
+package maasflow
+
+import (
+	"sync"
+)
+
+// fleetConvergence whether the matched nodes had converged as of the last
+// pass, used to log the convergence only when it changes
+var fleetConvergence = struct {
+	sync.Mutex
+	converged bool
+}{}
+
+// settledActions the actions that leave a node where it is for good, i.e. the
+// node is at the target state or in a terminal state that needs an operator
+var settledActions = map[string]bool{
+	"Done":       true,
+	"Fail":       true,
+	"AdminState": true,
+}
+
+// converged whether no work remains for the matched nodes, i.e. the pass took
+// no mutating actions, could process every matched node without error and
+// every matched node is at the target state, in a terminal state or is held
+// back from being aquired. A pass that matched no nodes has not converged, as
+// that is more likely a misconfigured filter than a finished fleet.
+func converged(results []NodeResult, matched []int, held map[int]bool) bool {
+	if len(matched) == 0 {
+		return false
+	}
+	for _, i := range matched {
+		if held[i] {
+			continue
+		}
+		result := results[i]
+		if result.Skipped || result.Err != nil || !settledActions[result.Action] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkConverged record whether the matched nodes have converged, logging
+// once when they converge and again if any node then leaves its target state
+func checkConverged(results []NodeResult, matched []int, held map[int]bool, options ProcessingOptions) {
+	now := converged(results, matched, held)
+	if now {
+		convergedGauge.set(1)
+	} else {
+		convergedGauge.set(0)
+	}
+
+	fleetConvergence.Lock()
+	defer fleetConvergence.Unlock()
+	switch {
+	case now && !fleetConvergence.converged:
+		options.logf("[info] fleet converged, all %d matched nodes are at the target state or need manual attention", len(matched))
+	case !now && fleetConvergence.converged:
+		options.logf("[info] fleet no longer converged, work remains for one or more matched nodes")
+	}
+	fleetConvergence.converged = now
+}
+
+// Converged whether the nodes that matched the filter had converged as of the
+// last pass, i.e. no work remains for them
+func Converged() bool {
+	fleetConvergence.Lock()
+	defer fleetConvergence.Unlock()
+	return fleetConvergence.converged
+}
@@ -0,0 +1,59 @@
+package maasflow
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConverged(t *testing.T) {
+	done := NodeResult{Action: "Done"}
+	tests := []struct {
+		name    string
+		results []NodeResult
+		matched []int
+		held    map[int]bool
+		want    bool
+	}{
+		{"no matched nodes", []NodeResult{done}, nil, nil, false},
+		{"all done", []NodeResult{done, {Action: "Fail"}, {Action: "AdminState"}}, []int{0, 1, 2}, nil, true},
+		{"held node", []NodeResult{done, {FromState: "Ready", Skipped: true}}, []int{0, 1}, map[int]bool{1: true}, true},
+		{"skipped node", []NodeResult{done, {Action: "Done", Skipped: true}}, []int{0, 1}, nil, false},
+		{"errored node", []NodeResult{done, {Action: "Done", Err: errors.New("failed")}}, []int{0, 1}, nil, false},
+		{"unsettled action", []NodeResult{done, {Action: "Wait"}}, []int{0, 1}, nil, false},
+		{"mutating action", []NodeResult{done, {Action: "Deploy"}}, []int{0, 1}, nil, false},
+		{"unmatched node ignored", []NodeResult{done, {Action: "Deploy"}}, []int{0}, nil, true},
+	}
+	for _, test := range tests {
+		if got := converged(test.results, test.matched, test.held); got != test.want {
+			t.Errorf("%s: converged = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckConverged(t *testing.T) {
+	fleetConvergence.converged = false
+	defer func() { fleetConvergence.converged = false }()
+
+	passes := []struct {
+		results []NodeResult
+		want    bool
+	}{
+		{[]NodeResult{{Action: "Deploy"}}, false},
+		{[]NodeResult{{Action: "Done"}}, true},
+		{[]NodeResult{{Action: "Done"}}, true},
+		{[]NodeResult{{Action: "Release"}}, false},
+	}
+	for i, pass := range passes {
+		checkConverged(pass.results, []int{0}, nil, ProcessingOptions{})
+		if got := Converged(); got != pass.want {
+			t.Errorf("pass %d: Converged = %t, want %t", i, got, pass.want)
+		}
+		want := 0.0
+		if pass.want {
+			want = 1
+		}
+		if got := convergedGauge.values[""]; got != want {
+			t.Errorf("pass %d: maas_flow_converged = %g, want %g", i, got, want)
+		}
+	}
+}
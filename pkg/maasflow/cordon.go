@@ -0,0 +1,29 @@
+package maasflow
+
+import "sync/atomic"
+
+// cordoned whether the automation is cordoned, non-zero when cordoned
+var cordoned int32
+
+// SetCordoned cordon, or uncordon, the automation. When cordoned the nodes
+// already mid-transition continue to be driven to the target state, but no
+// new work, i.e. commissioning or aquiring a node, is started.
+func SetCordoned(cordon bool) {
+	var value int32
+	if cordon {
+		value = 1
+	}
+	atomic.StoreInt32(&cordoned, value)
+}
+
+// Cordoned whether the automation is cordoned, see SetCordoned
+func Cordoned() bool {
+	return atomic.LoadInt32(&cordoned) != 0
+}
+
+// initiatingAction whether the action starts new work on a node, as opposed
+// to continuing to drive a node that is already mid-transition. Power cycling
+// a stuck node is disruptive so is also new work.
+func initiatingAction(action Action) bool {
+	return sameAction(action, Commission) || sameAction(action, Aquire) || sameAction(action, PowerCycle)
+}
@@ -0,0 +1,60 @@
+package maasflow
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeployKernelOpts(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	created := url.Values{}
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		r.ParseForm()
+		op := r.URL.Query().Get("op")
+		requests = append(requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/MAAS/api/1.0")+" "+op)
+		switch {
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/tags/"):
+			http.NotFound(w, r)
+			return
+		case op == "new":
+			created = r.PostForm
+		case op == "start" && r.PostForm.Get("distro_series") == "":
+			http.Error(w, "no distro", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	node := newTestNode(t, `{"system_id":"d","hostname":"n1","zone":{"name":"dpdk"},"tag_names":["maas-flow-kernel-00000000"]}`)
+	options := ProcessingOptions{DeployKernelOpts: "quiet", ZoneDeployKernelOpts: map[string]string{"dpdk": "hugepages=64 iommu=pt"}}
+
+	if _, err := Deploy(client, node, options); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	tag := kernelOptsTag("hugepages=64 iommu=pt")
+	if created.Get("name") != tag || created.Get("kernel_opts") != "hugepages=64 iommu=pt" {
+		t.Errorf("expected the tag '%s' to be created with the zone's kernel options, got %v", tag, created)
+	}
+	want := []string{
+		"GET /tags/" + tag + "/ ",
+		"POST /tags/ new",
+		"POST /tags/" + tag + "/ update_nodes",
+		"POST /tags/maas-flow-kernel-00000000/ update_nodes",
+		"POST /nodes/d/ start",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected the requests\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(requests, "\n"))
+	}
+}
+
+func TestValidateZoneDeployKernelOpts(t *testing.T) {
+	options := ProcessingOptions{ZoneDeployKernelOpts: map[string]string{"dpdk": " "}}
+	if err := options.Validate(); err == nil {
+		t.Errorf("expected empty kernel options to be rejected")
+	}
+}
@@ -0,0 +1,87 @@
+package maasflow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// deployPolls the context that, once done, i.e. on shutdown, ends the polling
+// of the deploys in progress
+var deployPolls = struct {
+	sync.Mutex
+	ctx context.Context
+}{ctx: context.Background()}
+
+// SetDeployPollContext set the context that, once done, ends the polling of
+// the deploys in progress, see ProcessingOptions.DeployPoll, so that polling
+// never holds up a shutdown
+func SetDeployPollContext(ctx context.Context) {
+	deployPolls.Lock()
+	defer deployPolls.Unlock()
+	deployPolls.ctx = ctx
+}
+
+// deployPollContext the context that ends the polling of deploys
+func deployPollContext() context.Context {
+	deployPolls.Lock()
+	defer deployPolls.Unlock()
+	return deployPolls.ctx
+}
+
+// pollDeploy poll the state of a node that has just been started, every
+// DeployPollInterval until DeployPoll has elapsed, the node leaves Deploying
+// or polling is cancelled, logging its progress. Each poll is a request to
+// MAAS, so is subject to the rate limit. The state in which the node was last
+// seen is returned, Deploying if it could not be read.
+func pollDeploy(client *maas.MAASObject, node MaasNode, options ProcessingOptions) string {
+	ctx := deployPollContext()
+	nodeObj := client.GetSubObject("nodes").GetSubObject(node.SystemID())
+	start := clock.Now()
+	last := "Deploying"
+	for clock.Now().Sub(start)+options.DeployPollInterval <= options.DeployPoll {
+		select {
+		case <-clock.After(options.DeployPollInterval):
+		case <-ctx.Done():
+			if options.verbose() {
+				options.logf("[info] no longer polling the deploy of '%s' as polling is cancelled", node.Hostname())
+			}
+			return last
+		}
+
+		obj, err := getObject(options, nodeObj)
+		if err != nil {
+			options.logf("[warn] unable to poll the deploy of '%s', leaving it to the next pass : %s", node.Hostname(), err)
+			return last
+		}
+		polled := MaasNode{obj}
+		state, err := polled.StatusName()
+		if err != nil {
+			options.logf("[warn] unable to poll the deploy of '%s', leaving it to the next pass : %s", node.Hostname(), err)
+			return last
+		}
+		elapsed := clock.Now().Sub(start).Round(options.DeployPollInterval)
+		if state != last || options.verbose() {
+			options.logf("DEPLOY PROGRESS: %s %s after %s", node.Hostname(), state, elapsed)
+		}
+		last = state
+		if state != "Deploying" {
+			return state
+		}
+	}
+	return last
+}
+
+// deployOutcome the result of a deploy whose progress was polled until the
+// node was last seen in the given state, a failed deployment is an error so
+// that it is seen and notified without waiting for the next pass
+func deployOutcome(node MaasNode, state string, options ProcessingOptions) (ActionResult, error) {
+	if state == "FailedDeployment" {
+		err := fmt.Errorf("deployment of '%s' failed", node.Hostname())
+		options.logf("ERROR: DEPLOY '%s' : '%s'", node.Hostname(), err)
+		return ActionResult{Mutated: true, NextState: state}, err
+	}
+	return ActionResult{Mutated: true, NextState: state}, nil
+}
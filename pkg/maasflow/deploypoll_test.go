@@ -0,0 +1,147 @@
+package maasflow
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// pollingMAAS a fake MAAS in which a started machine moves to the given
+// state once it has been polled the given number of times
+type pollingMAAS struct {
+	*fakeMAAS
+	id    string
+	after int
+	state string
+	polls int
+}
+
+func (p *pollingMAAS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/nodes/"+p.id+"/") {
+		p.Lock()
+		if p.polls++; p.polls == p.after {
+			p.setState(p.id, p.state)
+		}
+		p.Unlock()
+	}
+	p.fakeMAAS.ServeHTTP(w, r)
+}
+
+// deployPolling deploy the node, advancing the fake clock by the interval
+// each time the deploy waits to poll, until the deploy returns
+func deployPolling(fake *fakeClock, client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	type outcome struct {
+		result ActionResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := Deploy(client, node, options)
+		done <- outcome{result, err}
+	}()
+	for {
+		select {
+		case o := <-done:
+			return o.result, o.err
+		default:
+		}
+		fake.Lock()
+		waiting := len(fake.waiters) > 0
+		fake.Unlock()
+		if waiting {
+			fake.Advance(options.DeployPollInterval)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestDeployPolled(t *testing.T) {
+	// The polls stop once the node leaves Deploying, or at the latest once
+	// the budget is used
+	cases := []struct {
+		state  string
+		after  int
+		budget time.Duration
+		next   string
+		err    bool
+		polls  int
+	}{
+		{"FailedDeployment", 2, time.Minute, "FailedDeployment", true, 2},
+		{"Deployed", 1, time.Minute, "Deployed", false, 1},
+		{"Deployed", 100, time.Minute, "Deploying", false, 4},
+	}
+	for _, c := range cases {
+		fakeTime := useFakeClock(t)
+		id := "poll-" + c.state
+		fake := &pollingMAAS{fakeMAAS: newFakeMAAS(t, map[string]string{id: id}), id: id, after: c.after, state: c.state}
+		fake.Lock()
+		fake.setState(id, "Allocated")
+		fake.Unlock()
+		client := newTestMAAS(t, fake)
+		node := newTestNode(t, `{"system_id":"`+id+`","hostname":"`+id+`","status_name":"Allocated"}`)
+
+		options := ProcessingOptions{DeployPoll: c.budget, DeployPollInterval: 15 * time.Second}
+		result, err := deployPolling(fakeTime, client, node, options)
+		if (err != nil) != c.err || result.NextState != c.next {
+			t.Errorf("%s: expected next state %s and error %t, got %+v, %v", c.state, c.next, c.err, result, err)
+		}
+		if fake.polls != c.polls {
+			t.Errorf("%s: expected %d polls, got %d", c.state, c.polls, fake.polls)
+		}
+	}
+}
+
+func TestDeployPollCancelled(t *testing.T) {
+	useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	SetDeployPollContext(ctx)
+	defer SetDeployPollContext(context.Background())
+
+	fake := &pollingMAAS{fakeMAAS: newFakeMAAS(t, map[string]string{"poll-c": "poll-c"}), id: "poll-c"}
+	fake.Lock()
+	fake.setState("poll-c", "Allocated")
+	fake.Unlock()
+	client := newTestMAAS(t, fake)
+	node := newTestNode(t, `{"system_id":"poll-c","hostname":"poll-c","status_name":"Allocated"}`)
+
+	options := ProcessingOptions{DeployPoll: time.Hour, DeployPollInterval: time.Minute}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if result, err := Deploy(client, node, options); err != nil || result.NextState != "Deploying" {
+			t.Errorf("expected the deploy to be left deploying, got %+v, %v", result, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected polling to end once cancelled")
+	}
+	if fake.polls != 0 {
+		t.Errorf("expected no polls once cancelled, got %d", fake.polls)
+	}
+}
+
+func TestDeployPollValidated(t *testing.T) {
+	for _, options := range []ProcessingOptions{
+		{DeployPoll: -time.Second},
+		{DeployPoll: time.Minute},
+		{DeployPoll: time.Minute, DeployPollInterval: time.Hour},
+		{DeployPoll: lockLease + time.Second, DeployPollInterval: time.Minute, LockNodes: true},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%s every %s: expected the options to be rejected", options.DeployPoll, options.DeployPollInterval)
+		}
+	}
+	options := ProcessingOptions{DeployPoll: lockLease, DeployPollInterval: time.Minute, LockNodes: true}
+	if err := options.Validate(); err != nil {
+		t.Errorf("unexpected error polling for the lease of a lock : %s", err)
+	}
+}
@@ -0,0 +1,74 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DescribeTransitions describe the effective state machine, for each state
+// from which there is a transition to the target state, in the order of the
+// state names, the action taken given the options, i.e. to be logged at
+// startup
+func (o ProcessingOptions) DescribeTransitions() []string {
+	targets := Transitions[targetState]
+	states := make([]string, 0, len(targets))
+	for state := range targets {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	lines := make([]string, 0, len(states))
+	for _, state := range states {
+		lines = append(lines, fmt.Sprintf("%s -> %s", state, o.describeTransition(state, targets[state])))
+	}
+	return lines
+}
+
+// describeTransition describe the action taken for a node in the given state,
+// noting how the options change or restrict it
+func (o ProcessingOptions) describeTransition(state string, action Action) string {
+	name := ActionName(action)
+	var notes []string
+	switch {
+	case sameAction(action, ReleaseWithoutErase) && !o.ReleaseFailedErase:
+		name = ActionName(Fail)
+	case sameAction(action, Deploy) && state == "Allocated" && o.SkipExternallyAllocated:
+		notes = append(notes, "AdminState when allocated by another user")
+	case sameAction(action, Aquire) && o.TargetDeployed > 0:
+		notes = append(notes, fmt.Sprintf("until %d are deployed", o.TargetDeployed))
+	case sameAction(action, Done) && o.ScaleDown:
+		notes = append(notes, fmt.Sprintf("Release when more than %d are deployed", o.TargetDeployed))
+	case sameAction(action, Wait):
+		if timeout, ok := o.StateTimeouts[state]; ok {
+			if remedy, ok := o.remediation(state); ok {
+				notes = append(notes, fmt.Sprintf("%s after %s", ActionName(remedy), timeout))
+			} else {
+				notes = append(notes, fmt.Sprintf("manual attention after %s", timeout))
+			}
+		}
+		if state == "Deploying" && o.PowerCycleStuck && o.ArmDestructive && o.PowerCycleAttempts > 0 {
+			notes = append(notes, fmt.Sprintf("PowerCycle after %s, up to %d times", o.StuckTimeout, o.PowerCycleAttempts))
+		}
+	}
+	if o.NameTemplate != "" && sameAction(action, Aquire) && !o.DeferAcquireName ||
+		o.NameTemplate != "" && sameAction(action, Deploy) && o.DeferAcquireName {
+		notes = append(notes, "named from "+o.NameTemplate)
+	}
+	if o.DeployPoll > 0 && sameAction(action, Deploy) && !o.Preview {
+		notes = append(notes, fmt.Sprintf("polled for up to %s", o.DeployPoll))
+	}
+	if o.SkipTestFailed && (sameAction(action, Aquire) || sameAction(action, Deploy)) {
+		notes = append(notes, "unless its hardware tests failed")
+	}
+	if guards := o.Guards[state]; len(guards) > 0 {
+		notes = append(notes, "once "+strings.Join(guards, ", "))
+	}
+	if o.ReadOnly && mutatingAction(action) {
+		notes = append(notes, "not taken when read only")
+	}
+	if len(notes) > 0 {
+		name += " (" + strings.Join(notes, "; ") + ")"
+	}
+	return name
+}
@@ -0,0 +1,50 @@
+package maasflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDescribeTransitions(t *testing.T) {
+	describe := func(options ProcessingOptions) map[string]bool {
+		lines := make(map[string]bool)
+		for _, line := range options.DescribeTransitions() {
+			lines[line] = true
+		}
+		return lines
+	}
+
+	lines := describe(ProcessingOptions{})
+	if len(lines) != len(Transitions[targetState]) {
+		t.Errorf("expected a line for each of the %d states, got %d", len(Transitions[targetState]), len(lines))
+	}
+	for _, line := range []string{"New -> Commission", "FailedDiskErasing -> Fail", "Deploying -> Wait"} {
+		if !lines[line] {
+			t.Errorf("expected '%s' in %v", line, lines)
+		}
+	}
+
+	lines = describe(ProcessingOptions{
+		ReleaseFailedErase: true,
+		ArmDestructive:     true,
+		StateTimeouts:      map[string]time.Duration{"Deploying": 30 * time.Minute},
+		Guards:             map[string][]string{"Ready": {"power-on"}},
+		SkipTestFailed:     true,
+	})
+	for _, line := range []string{
+		"FailedDiskErasing -> ReleaseWithoutErase",
+		"Deploying -> Wait (Release after 30m0s)",
+		"Ready -> Aquire (unless its hardware tests failed; once power-on)",
+	} {
+		if !lines[line] {
+			t.Errorf("expected '%s' in %v", line, lines)
+		}
+	}
+
+	lines = describe(ProcessingOptions{NameTemplate: "gpu-pool-%03d", DeferAcquireName: true})
+	for _, line := range []string{"Ready -> Aquire", "Allocated -> Deploy (named from gpu-pool-%03d)"} {
+		if !lines[line] {
+			t.Errorf("expected '%s' in %v", line, lines)
+		}
+	}
+}
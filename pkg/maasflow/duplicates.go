@@ -0,0 +1,58 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// duplicatesReported the duplicate hostnames last warned about, used to
+// warn only when the duplicates change rather than every pass
+var duplicatesReported = struct {
+	sync.Mutex
+	summary string
+}{}
+
+// checkDuplicateHostnames warn, prominently, when nodes share a hostname,
+// listing the system ids of the colliding nodes. Hostnames are expected to be
+// unique and nodes that share one cause confusing behavior, i.e. a mapping
+// that renames the wrong node, so this surfaces a data problem that otherwise
+// appears as mysterious failures. The warning is repeated only when the
+// duplicates change.
+func checkDuplicateHostnames(nodes []MaasNode, options ProcessingOptions) {
+	byHostname := make(map[string][]string)
+	for _, node := range nodes {
+		if hostname := node.Hostname(); hostname != "" {
+			byHostname[hostname] = append(byHostname[hostname], node.SystemID())
+		}
+	}
+
+	var collisions []string
+	for hostname, ids := range byHostname {
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			collisions = append(collisions, fmt.Sprintf("'%s' : %s", hostname, strings.Join(ids, ", ")))
+		}
+	}
+	sort.Strings(collisions)
+	duplicateHostnames.set(float64(len(collisions)))
+
+	duplicatesReported.Lock()
+	defer duplicatesReported.Unlock()
+	summary := strings.Join(collisions, "; ")
+	if summary == duplicatesReported.summary {
+		return
+	}
+	duplicatesReported.summary = summary
+	if len(collisions) == 0 {
+		options.logf("[info] no nodes share a hostname")
+		return
+	}
+	options.logf("[warn] ******************************************************************")
+	options.logf("[warn] %d hostnames are shared by more than one node, hostnames should be unique", len(collisions))
+	for _, collision := range collisions {
+		options.logf("[warn] duplicate hostname %s", collision)
+	}
+	options.logf("[warn] ******************************************************************")
+}
@@ -0,0 +1,33 @@
+package maasflow
+
+import (
+	"testing"
+)
+
+func TestDuplicateHostnamesOnlyOnFullFetch(t *testing.T) {
+	defer func() {
+		duplicatesReported.summary = ""
+		duplicateHostnames.set(0)
+	}()
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"n1","status_name":"Deployed"}`),
+		newTestNode(t, `{"system_id":"b","hostname":"n1","status_name":"Deployed"}`),
+	}
+
+	ProcessAll(nil, nodes, ProcessingOptions{Preview: true})
+	if got := duplicateHostnames.values[""]; got != 1 {
+		t.Fatalf("expected 1 duplicate hostname after a full fetch, got %v", got)
+	}
+
+	// A partial fetch only sees some of the nodes, so can't tell the
+	// duplicates have been resolved
+	ProcessAll(nil, nodes[:1], ProcessingOptions{Preview: true, PartialFetch: true})
+	if got := duplicateHostnames.values[""]; got != 1 {
+		t.Errorf("expected a partial fetch to leave the duplicates as they were, got %v", got)
+	}
+
+	ProcessAll(nil, nodes[:1], ProcessingOptions{Preview: true})
+	if got := duplicateHostnames.values[""]; got != 0 {
+		t.Errorf("expected no duplicate hostnames after a full fetch, got %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package maasflow
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// EnlistEntry a machine to be registered with MAAS before the automation
+// drives it, identified by its MAC address
+type EnlistEntry struct {
+	MAC         string            `json:"mac"`
+	Hostname    string            `json:"hostname"`
+	PowerType   string            `json:"power_type"`
+	PowerParams map[string]string `json:"power_params"`
+}
+
+// ValidateManifest verify that every entry in an enlistment manifest has a
+// valid, unique, MAC address
+func ValidateManifest(entries []EnlistEntry) error {
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		mac, err := net.ParseMAC(entry.MAC)
+		if err != nil {
+			return fmt.Errorf("enlist manifest entry %d has an invalid mac '%s' : %s", i, entry.MAC, err)
+		}
+		key := mac.String()
+		if first, ok := seen[key]; ok {
+			return fmt.Errorf("enlist manifest entry %d has the same mac '%s' as entry %d", i, entry.MAC, first)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// normalizeMAC the canonical form of a MAC address used to compare
+// addresses, addresses that cannot be parsed are compared as lower case
+func normalizeMAC(mac string) string {
+	if parsed, err := net.ParseMAC(mac); err == nil {
+		return parsed.String()
+	}
+	return strings.ToLower(mac)
+}
+
+// Enlist create the machines in the manifest that are not already known to
+// MAAS, matched by MAC address, so that they are enlisted deterministically.
+// Once created the machines are driven by the normal processing of the nodes.
+func Enlist(client *maas.MAASObject, entries []EnlistEntry, options ProcessingOptions) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	nodes, _, err := FetchNodes(client)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]string)
+	for _, node := range nodes {
+		for _, mac := range node.MACs() {
+			known[normalizeMAC(mac)] = node.Hostname()
+		}
+	}
+
+	nodesObj := client.GetSubObject("nodes")
+	for _, entry := range entries {
+		if hostname, ok := known[normalizeMAC(entry.MAC)]; ok {
+			if options.Verbose {
+				options.logf("[info] not enlisting '%s' as a node with mac '%s' already exists as '%s'",
+					entry.Hostname, entry.MAC, hostname)
+			}
+			continue
+		}
+
+		options.logf("ENLIST: %s (%s)", entry.Hostname, entry.MAC)
+		if options.Preview {
+			continue
+		}
+		params := url.Values{}
+		params.Add("mac_addresses", entry.MAC)
+		if entry.Hostname != "" {
+			params.Add("hostname", entry.Hostname)
+		}
+		if entry.PowerType != "" {
+			params.Add("power_type", entry.PowerType)
+		}
+		for key, value := range entry.PowerParams {
+			params.Add("power_parameters_"+key, value)
+		}
+		_, err := callPost(options, nodesObj, "new", params)
+		if err != nil {
+			options.logf("ERROR: ENLIST '%s' : '%s'", entry.Hostname, err)
+			return err
+		}
+	}
+	return nil
+}
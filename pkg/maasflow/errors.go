@@ -0,0 +1,91 @@
+package maasflow
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// ErrorClass the kind of failure of a request to the MAAS server, which
+// determines how the failure is handled, i.e. whether it is retried
+type ErrorClass int
+
+// The classes of failure of a request to the MAAS server
+const (
+	// ErrorNone the request did not fail
+	ErrorNone ErrorClass = iota
+
+	// ErrorTransient the request may succeed if retried, i.e. the server
+	// could not be reached, timed out or reported an internal error
+	ErrorTransient
+
+	// ErrorAuth the request failed authentication or authorization, which
+	// will not resolve itself
+	ErrorAuth
+
+	// ErrorConflict the request conflicted with the current state of the
+	// object, i.e. another request for the same node was in progress
+	ErrorConflict
+
+	// ErrorNotFound the object of the request does not exist
+	ErrorNotFound
+
+	// ErrorClient the server rejected the request as invalid, retrying the
+	// same request will fail the same way
+	ErrorClient
+
+	// ErrorUnknown the error is not one that can be classified
+	ErrorUnknown
+)
+
+var errorClassNames = []string{"none", "transient", "auth", "conflict", "not_found", "client", "unknown"}
+
+func (c ErrorClass) String() string {
+	if c < 0 || int(c) >= len(errorClassNames) {
+		return "unknown"
+	}
+	return errorClassNames[c]
+}
+
+// classifyMaasError classify an error returned by a request to the MAAS
+// server. Error responses from the server are classified by their HTTP
+// status, while errors without a response, i.e. refused connections,
+// timeouts and connections closed mid response, are transient.
+func classifyMaasError(err error) ErrorClass {
+	if err == nil {
+		return ErrorNone
+	}
+
+	var serverErr maas.ServerError
+	if errors.As(err, &serverErr) {
+		switch code := serverErr.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrorAuth
+		case code == http.StatusConflict:
+			return ErrorConflict
+		case code == http.StatusNotFound:
+			return ErrorNotFound
+		case code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500:
+			return ErrorTransient
+		case code >= 400:
+			return ErrorClient
+		}
+		return ErrorUnknown
+	}
+
+	var network ErrNetwork
+	if errors.As(err, &network) {
+		return ErrorTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorTransient
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorTransient
+	}
+	return ErrorUnknown
+}
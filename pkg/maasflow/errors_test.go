@@ -0,0 +1,45 @@
+package maasflow
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+func TestClassifyMaasError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ErrorNone},
+		{"bad request", maas.ServerError{StatusCode: 400}, ErrorClient},
+		{"unauthorized", maas.ServerError{StatusCode: 401}, ErrorAuth},
+		{"forbidden", maas.ServerError{StatusCode: 403}, ErrorAuth},
+		{"not found", maas.ServerError{StatusCode: 404}, ErrorNotFound},
+		{"request timeout", maas.ServerError{StatusCode: 408}, ErrorTransient},
+		{"conflict", maas.ServerError{StatusCode: 409}, ErrorConflict},
+		{"too many requests", maas.ServerError{StatusCode: 429}, ErrorTransient},
+		{"internal error", maas.ServerError{StatusCode: 500}, ErrorTransient},
+		{"unavailable", maas.ServerError{StatusCode: 503}, ErrorTransient},
+		{"wrapped server error", fmt.Errorf("deploy : %w", maas.ServerError{StatusCode: 409}), ErrorConflict},
+		{"redirect", maas.ServerError{StatusCode: 302}, ErrorUnknown},
+		{"network failure", ErrNetwork{Operation: "fetch nodes", Err: errors.New("reset")}, ErrorTransient},
+		{"connection refused", refused, ErrorTransient},
+		{"wrapped connection refused", fmt.Errorf("fetch : %w", refused), ErrorTransient},
+		{"closed mid response", io.ErrUnexpectedEOF, ErrorTransient},
+		{"closed", fmt.Errorf("read : %w", io.EOF), ErrorTransient},
+		{"other", errors.New("something else"), ErrorUnknown},
+	}
+	for _, test := range tests {
+		if got := classifyMaasError(test.err); got != test.want {
+			t.Errorf("%s: classified as %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package maasflow
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// csvColumns the columns of the fleet export, see WriteCSV
+var csvColumns = []string{"system_id", "hostname", "zone", "status", "power_state", "cpu", "memory", "tags", "owner"}
+
+// WriteCSV write the nodes that match the filter as CSV, with a header row and
+// a row per node. A node's tags are separated by spaces and the status of a
+// node whose status cannot be determined is left empty.
+func WriteCSV(w io.Writer, nodes []MaasNode, filter Filter) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if !filter.Matches(node) {
+			continue
+		}
+		status, _ := node.StatusName()
+		err := writer.Write([]string{
+			node.SystemID(),
+			node.Hostname(),
+			node.Zone(),
+			status,
+			node.PowerState(),
+			strconv.Itoa(node.CPUCount()),
+			strconv.Itoa(node.Memory()),
+			strings.Join(node.Tags(), " "),
+			node.Owner(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
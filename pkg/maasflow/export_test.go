@@ -0,0 +1,26 @@
+package maasflow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"compute-1","zone":{"name":"rack-1"},"status_name":"Deployed",`+
+			`"power_state":"on","cpu_count":32,"memory":65536,"tag_names":["gpu","compute"],"owner":"admin"}`),
+		newTestNode(t, `{"system_id":"b","hostname":"storage-1","status_name":"Ready"}`),
+	}
+	var filter Filter
+	filter.Hosts.Include = []string{"compute-.*"}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, nodes, filter); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	want := "system_id,hostname,zone,status,power_state,cpu,memory,tags,owner\n" +
+		"a,compute-1,rack-1,Deployed,on,32,65536,compute gpu,admin\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
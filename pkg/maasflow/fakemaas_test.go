@@ -0,0 +1,284 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSettles the state in which each transitional state of a fake MAAS
+// machine settles, on the listing after the machine entered it
+var fakeSettles = map[string]string{
+	"Commissioning": "Ready",
+	"Deploying":     "Deployed",
+	"Releasing":     "Ready",
+}
+
+// fakeMAAS a fake MAAS server implementing, in memory, the subset of the API
+// the automation uses to drive machines to deployment: listing the nodes,
+// updating, commissioning, aquiring, starting and releasing a node. A machine
+// that enters a transitional state, i.e. Commissioning, settles in the next
+// state when the nodes are next listed, so that each processing pass sees
+// the machines move on as they would in MAAS.
+type fakeMAAS struct {
+	sync.Mutex
+	t        *testing.T
+	machines map[string]map[string]interface{}
+	entered  map[string]bool
+	ops      []string
+}
+
+// newFakeMAAS a fake MAAS with machines of the given hostnames, by system id,
+// that are New and powered off
+func newFakeMAAS(t *testing.T, hostnames map[string]string) *fakeMAAS {
+	f := &fakeMAAS{t: t, machines: make(map[string]map[string]interface{}), entered: make(map[string]bool)}
+	for id, hostname := range hostnames {
+		f.machines[id] = map[string]interface{}{
+			"system_id":    id,
+			"hostname":     hostname,
+			"power_state":  "off",
+			"zone":         map[string]interface{}{"name": "default"},
+			"resource_uri": "/MAAS/api/1.0/nodes/" + id + "/",
+		}
+		f.setState(id, "New")
+	}
+	return f
+}
+
+// setState move the machine to the given state, caller must hold the lock
+func (f *fakeMAAS) setState(id string, state string) {
+	machine := f.machines[id]
+	machine["status_name"] = state
+	for code, name := range names {
+		if name == state {
+			machine["status"] = code
+		}
+	}
+	f.entered[id] = true
+}
+
+// state the state of the machine
+func (f *fakeMAAS) state(id string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.machines[id]["status_name"].(string)
+}
+
+// hostname the hostname of the machine
+func (f *fakeMAAS) hostname(id string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.machines[id]["hostname"].(string)
+}
+
+// operations the operations performed on the machines, in order, as the
+// system id and operation, i.e. "n1 commission"
+func (f *fakeMAAS) operations() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.ops...)
+}
+
+// settle move the machines that entered a transitional state before the
+// previous listing on to the state in which it settles
+func (f *fakeMAAS) settle() {
+	for id, machine := range f.machines {
+		if f.entered[id] {
+			delete(f.entered, id)
+			continue
+		}
+		if next, ok := fakeSettles[machine["status_name"].(string)]; ok {
+			f.setState(id, next)
+			delete(f.entered, id)
+		}
+	}
+}
+
+func (f *fakeMAAS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	r.ParseForm()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/MAAS/api/1.0/"), "/")
+	parts := strings.Split(path, "/")
+	op := r.URL.Query().Get("op")
+	if parts[0] != "nodes" {
+		f.fail(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet && op == "list":
+		f.settle()
+		ids := make([]string, 0, len(f.machines))
+		for id := range f.machines {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		listing := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			listing = append(listing, f.machines[id])
+		}
+		json.NewEncoder(w).Encode(listing)
+	case len(parts) == 1 && r.Method == http.MethodPost && op == "acquire":
+		id := r.PostForm.Get("system_id")
+		machine, ok := f.machines[id]
+		if !ok || machine["status_name"] != "Ready" {
+			http.Error(w, "No available node matches constraints", http.StatusConflict)
+			return
+		}
+		f.ops = append(f.ops, id+" acquire")
+		machine["owner"] = "maas-flow"
+		machine["agent_name"] = r.PostForm.Get("agent_name")
+		f.setState(id, "Allocated")
+		json.NewEncoder(w).Encode(machine)
+	case len(parts) == 3 && parts[2] == "interfaces" && r.Method == http.MethodGet:
+		if _, ok := f.machines[parts[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("[]"))
+	case len(parts) == 2:
+		machine, ok := f.machines[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.serveMachine(w, r, parts[1], machine, op)
+	default:
+		f.fail(w, r)
+	}
+}
+
+// serveMachine answer a request for a single machine
+func (f *fakeMAAS) serveMachine(w http.ResponseWriter, r *http.Request, id string, machine map[string]interface{}, op string) {
+	// The states from which each operation is accepted and the state the
+	// machine enters
+	transitions := map[string]struct {
+		from []string
+		to   string
+	}{
+		"commission": {[]string{"New", "Ready", "Broken"}, "Commissioning"},
+		"start":      {[]string{"Allocated"}, "Deploying"},
+		"release":    {[]string{"Allocated", "Deployed", "Broken"}, "Releasing"},
+	}
+
+	switch {
+	case r.Method == http.MethodGet && op == "":
+	case r.Method == http.MethodPut:
+		f.ops = append(f.ops, id+" update")
+		if hostname := r.PostForm.Get("hostname"); hostname != "" {
+			machine["hostname"] = hostname
+		}
+	case r.Method == http.MethodPost:
+		transition, ok := transitions[op]
+		if !ok {
+			f.fail(w, r)
+			return
+		}
+		accepted := false
+		for _, from := range transition.from {
+			accepted = accepted || machine["status_name"] == from
+		}
+		if !accepted {
+			http.Error(w, "Node cannot be "+op+"ed in its current state", http.StatusConflict)
+			return
+		}
+		f.ops = append(f.ops, id+" "+op)
+		switch op {
+		case "start":
+			machine["power_state"] = "on"
+		case "release":
+			delete(machine, "owner")
+			delete(machine, "agent_name")
+			machine["power_state"] = "off"
+		}
+		f.setState(id, transition.to)
+	default:
+		f.fail(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(machine)
+}
+
+// fail reject a request the fake does not implement, failing the test as the
+// automation has made a request it was not expected to
+func (f *fakeMAAS) fail(w http.ResponseWriter, r *http.Request) {
+	f.t.Errorf("unexpected request to the fake MAAS : %s %s", r.Method, r.URL)
+	http.Error(w, "not implemented by the fake MAAS", http.StatusNotImplemented)
+}
+
+// runPasses list the nodes and process them, waiting for the actions to
+// complete, for the given number of passes, returning the state in which
+// each pass found the given machine
+func runPasses(t *testing.T, fake *fakeMAAS, passes int, options ProcessingOptions, id string) []string {
+	client := newTestMAAS(t, fake)
+	var states []string
+	for pass := 0; pass < passes; pass++ {
+		nodes, _, err := FetchNodes(client)
+		if err != nil {
+			t.Fatalf("pass %d: unable to list the nodes : %s", pass, err)
+		}
+		states = append(states, fake.state(id))
+		for _, result := range ProcessAll(client, nodes, options) {
+			if result.Err != nil {
+				t.Errorf("pass %d: unexpected error processing '%s' : %s", pass, result.Hostname, result.Err)
+			}
+		}
+		WaitForActions()
+	}
+	return states
+}
+
+func TestEndToEndNewToDeployed(t *testing.T) {
+	fake := newFakeMAAS(t, map[string]string{"e2e-1": "calm-otter", "e2e-2": "keen-heron"})
+	options := ProcessingOptions{AgentName: "maas-flow"}
+
+	states := runPasses(t, fake, 6, options, "e2e-1")
+	expected := []string{"New", "Commissioning", "Ready", "Allocated", "Deploying", "Deployed"}
+	if strings.Join(states, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the node to advance through %v, got %v", expected, states)
+	}
+	if got := fake.state("e2e-2"); got != "Deployed" {
+		t.Errorf("expected every node to be deployed, 'e2e-2' is %s", got)
+	}
+
+	var ops []string
+	for _, op := range fake.operations() {
+		if strings.HasPrefix(op, "e2e-1 ") {
+			ops = append(ops, op)
+		}
+	}
+	if strings.Join(ops, ",") != "e2e-1 commission,e2e-1 acquire,e2e-1 start" {
+		t.Errorf("expected the node to be commissioned, aquired and started once each, got %v", ops)
+	}
+}
+
+func TestEndToEndScaleDown(t *testing.T) {
+	fake := newFakeMAAS(t, map[string]string{"e2e-3": "bold-crane", "e2e-4": "wise-finch"})
+	options := ProcessingOptions{AgentName: "maas-flow", ArmDestructive: true}
+
+	runPasses(t, fake, 6, options, "e2e-3")
+	if fake.state("e2e-3") != "Deployed" || fake.state("e2e-4") != "Deployed" {
+		t.Fatalf("expected both nodes to be deployed, got %s and %s", fake.state("e2e-3"), fake.state("e2e-4"))
+	}
+
+	options.ScaleDown, options.TargetDeployed, options.MaxReleasesPerPass = true, 1, 1
+	runPasses(t, fake, 3, options, "e2e-3")
+	released := 0
+	for _, id := range []string{"e2e-3", "e2e-4"} {
+		switch fake.state(id) {
+		case "Ready":
+			released++
+		case "Deployed":
+		default:
+			t.Errorf("expected '%s' to be deployed or released, got %s", id, fake.state(id))
+		}
+	}
+	if released != 1 {
+		t.Errorf("expected one node to be released to reach the target, %d were", released)
+	}
+}
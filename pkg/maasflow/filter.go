@@ -0,0 +1,419 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FilterSet the include and exclude regular expressions applied to a single
+// node attribute
+type FilterSet struct {
+	Include []string
+	Exclude []string
+}
+
+// Filter used to constrain the nodes on which the automation operates
+type Filter struct {
+	Zones      FilterSet
+	Hosts      FilterSet
+	PowerTypes FilterSet `json:"power_types"`
+	Tags       FilterSet
+	Statuses   FilterSet
+	Subnets    FilterSet
+
+	// Anchored match the patterns against the whole of the value, rather
+	// than any part of it, so that "compute-1" does not match
+	// "host-compute-100"
+	Anchored bool `json:"-"`
+}
+
+// filterDimension a node attribute on which the filter matches, along with
+// the values of that attribute for a node. Nodes may have several values for
+// an attribute, i.e. tags, and any value may match.
+type filterDimension struct {
+	name   string
+	set    FilterSet
+	values func(node MaasNode) []string
+}
+
+// dimensions the attributes on which the filter matches, in the order in
+// which they are evaluated
+func (f Filter) dimensions() []filterDimension {
+	return []filterDimension{
+		{"hosts", f.Hosts, func(node MaasNode) []string { return []string{node.Hostname()} }},
+		{"zones", f.Zones, func(node MaasNode) []string { return []string{node.Zone()} }},
+		{"power_types", f.PowerTypes, func(node MaasNode) []string { return []string{node.PowerType()} }},
+		{"tags", f.Tags, func(node MaasNode) []string { return node.Tags() }},
+		{"statuses", f.Statuses, func(node MaasNode) []string {
+			status, err := node.StatusName()
+			if err != nil {
+				return []string{}
+			}
+			return []string{status}
+		}},
+		{"subnets", f.Subnets, func(node MaasNode) []string { return node.Subnets() }},
+	}
+}
+
+// Validate verify all the regular expressions in the filter compile
+func (f Filter) Validate() error {
+	for _, d := range f.dimensions() {
+		for i, pattern := range d.set.Include {
+			if _, err := f.compile(pattern); err != nil {
+				return fmt.Errorf("invalid regular expression '%s' at %s include index %d : %s", pattern, d.name, i, err)
+			}
+		}
+		for i, pattern := range d.set.Exclude {
+			if _, err := f.compile(pattern); err != nil {
+				return fmt.Errorf("invalid regular expression '%s' at %s exclude index %d : %s", pattern, d.name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sectionNames the names of the filter sets, in the order in which they are
+// reported
+var sectionNames = []string{"hosts", "zones", "power_types", "tags", "statuses", "subnets"}
+
+// sections the filter sets of the filter by the name of the attribute to
+// which they apply
+func (f *Filter) sections() map[string]*FilterSet {
+	return map[string]*FilterSet{
+		"hosts":       &f.Hosts,
+		"zones":       &f.Zones,
+		"power_types": &f.PowerTypes,
+		"tags":        &f.Tags,
+		"statuses":    &f.Statuses,
+		"subnets":     &f.Subnets,
+	}
+}
+
+// Prune remove the patterns that do not compile from the filter, returning
+// the filter with only the valid patterns along with an error describing each
+// pattern removed. Removing every include pattern of an attribute would widen
+// the filter to every node, so that is an error rather than a pruning.
+func (f Filter) Prune() (Filter, []error, error) {
+	var skipped []error
+	sections := f.sections()
+	for _, name := range sectionNames {
+		set := sections[name]
+		var err error
+		if set.Include, err = f.prunePatterns(name, "include", set.Include, &skipped); err != nil {
+			return f, skipped, err
+		}
+		if set.Exclude, err = f.prunePatterns(name, "exclude", set.Exclude, &skipped); err != nil {
+			return f, skipped, err
+		}
+	}
+	return f, skipped, nil
+}
+
+// prunePatterns the patterns that compile, recording an error for each that
+// does not
+func (f Filter) prunePatterns(name string, kind string, patterns []string, skipped *[]error) ([]string, error) {
+	if len(patterns) == 0 {
+		return patterns, nil
+	}
+	valid := []string{}
+	for i, pattern := range patterns {
+		if _, err := f.compile(pattern); err != nil {
+			*skipped = append(*skipped,
+				fmt.Errorf("invalid regular expression '%s' at %s %s index %d : %s", pattern, name, kind, i, err))
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+	if len(valid) == 0 && kind == "include" {
+		return nil, fmt.Errorf("every %s include pattern is invalid", name)
+	}
+	return valid, nil
+}
+
+// lineCounter a reader that records the offsets of the newlines read through
+// it, so that a position in the input can be reported as a line number
+type lineCounter struct {
+	r        io.Reader
+	read     int64
+	newlines []int64
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.read+int64(i))
+		}
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// lineAt the line number, from 1, of the given offset into the input
+func (c *lineCounter) lineAt(offset int64) int {
+	return sort.Search(len(c.newlines), func(i int) bool { return c.newlines[i] >= offset }) + 1
+}
+
+// filterDecoder decode a filter specification token by token, validating
+// each pattern as it is read
+type filterDecoder struct {
+	lines   *lineCounter
+	dec     *json.Decoder
+	lenient bool
+	skipped []error
+}
+
+// DecodeFilter read a JSON filter specification from the reader, decoding it
+// as it is read rather than reading it in full. Each pattern is compiled as it
+// is decoded so that an invalid pattern is reported with its location in the
+// input. When lenient, invalid patterns are left out of the filter and
+// returned, rather than failing the decode.
+func DecodeFilter(r io.Reader, lenient bool) (Filter, []error, error) {
+	var filter Filter
+	lines := &lineCounter{r: r}
+	d := &filterDecoder{lines: lines, dec: json.NewDecoder(lines), lenient: lenient}
+
+	if ok, err := d.open('{'); err != nil || !ok {
+		return filter, d.skipped, err
+	}
+	sections := filter.sections()
+	for d.dec.More() {
+		key, err := d.key()
+		if err != nil {
+			return filter, d.skipped, err
+		}
+		set, ok := sections[strings.ToLower(key)]
+		if !ok {
+			if err := d.skip(); err != nil {
+				return filter, d.skipped, err
+			}
+			continue
+		}
+		if err := d.decodeSet(strings.ToLower(key), set); err != nil {
+			return filter, d.skipped, err
+		}
+	}
+	return filter, d.skipped, d.close()
+}
+
+// decodeSet decode the include and exclude patterns of a filter set
+func (d *filterDecoder) decodeSet(name string, set *FilterSet) error {
+	if ok, err := d.open('{'); err != nil || !ok {
+		return err
+	}
+	for d.dec.More() {
+		key, err := d.key()
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(key) {
+		case "include":
+			set.Include, err = d.decodePatterns(name, "include")
+		case "exclude":
+			set.Exclude, err = d.decodePatterns(name, "exclude")
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return d.close()
+}
+
+// decodePatterns decode an array of patterns, compiling each as it is read
+func (d *filterDecoder) decodePatterns(name string, kind string) ([]string, error) {
+	if ok, err := d.open('['); err != nil || !ok {
+		return nil, err
+	}
+	patterns := []string{}
+	skipped := len(d.skipped)
+	for i := 0; d.dec.More(); i++ {
+		token, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+		pattern, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a regular expression at %s %s index %d, line %d, found '%v'",
+				name, kind, i, d.line(), token)
+		}
+		if _, err := compilePattern(pattern); err != nil {
+			err = fmt.Errorf("invalid regular expression '%s' at %s %s index %d, line %d : %s",
+				pattern, name, kind, i, d.line(), err)
+			if !d.lenient {
+				return nil, err
+			}
+			d.skipped = append(d.skipped, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 && len(d.skipped) > skipped && kind == "include" {
+		return nil, fmt.Errorf("every %s include pattern is invalid, line %d", name, d.line())
+	}
+	return patterns, d.close()
+}
+
+// line the line number of the current position in the input
+func (d *filterDecoder) line() int {
+	return d.lines.lineAt(d.dec.InputOffset())
+}
+
+// token read the next token, reporting the line of any syntax error
+func (d *filterDecoder) token() (json.Token, error) {
+	token, err := d.dec.Token()
+	switch e := err.(type) {
+	case nil:
+		return token, nil
+	case *json.SyntaxError:
+		return nil, fmt.Errorf("%s, line %d", e, d.lines.lineAt(e.Offset))
+	default:
+		if err == io.EOF {
+			return nil, fmt.Errorf("unexpected end of input, line %d", d.line())
+		}
+		return nil, err
+	}
+}
+
+// open read the opening delimiter of an object or array, returning false if
+// the value is null
+func (d *filterDecoder) open(delim json.Delim) (bool, error) {
+	token, err := d.token()
+	if err != nil {
+		return false, err
+	}
+	if token == nil {
+		return false, nil
+	}
+	if token != delim {
+		return false, fmt.Errorf("expected '%s', line %d, found '%v'", delim, d.line(), token)
+	}
+	return true, nil
+}
+
+// close read the closing delimiter of an object or array
+func (d *filterDecoder) close() error {
+	_, err := d.token()
+	return err
+}
+
+// key read the key of an object member
+func (d *filterDecoder) key() (string, error) {
+	token, err := d.token()
+	if err != nil {
+		return "", err
+	}
+	return token.(string), nil
+}
+
+// skip read and discard the next value, used for unknown keys
+func (d *filterDecoder) skip() error {
+	var value json.RawMessage
+	if err := d.dec.Decode(&value); err != nil {
+		if e, ok := err.(*json.SyntaxError); ok {
+			return fmt.Errorf("%s, line %d", e, d.lines.lineAt(e.Offset))
+		}
+		return err
+	}
+	return nil
+}
+
+// Matches whether the node matches the filter. A node matches if, for every
+// attribute with include patterns, it matches at least one of the includes
+// and, for every attribute, it matches none of the excludes. An attribute
+// without include patterns places no constraint on the nodes.
+func (f Filter) Matches(node MaasNode) bool {
+	_, ok, _ := f.explain(node)
+	return ok
+}
+
+// explain determine whether the node matches the filter, as Matches, and if
+// not the reason it did not match. A filter with a pattern that does not
+// compile, which Validate reports, matches no nodes rather than risk acting
+// on nodes that were meant to be excluded, and the error is returned.
+func (f Filter) explain(node MaasNode) (string, bool, error) {
+	for _, d := range f.dimensions() {
+		values := d.values(node)
+		matched, err := f.matchedAny(d.set.Include, values)
+		if err != nil {
+			return fmt.Sprintf("its %s include filter is invalid", d.name), false, err
+		}
+		if len(d.set.Include) > 0 && !matched {
+			return fmt.Sprintf("its %s %v didn't match the include filter '%v'", d.name, values, d.set.Include), false, nil
+		}
+		matched, err = f.matchedAny(d.set.Exclude, values)
+		if err != nil {
+			return fmt.Sprintf("its %s exclude filter is invalid", d.name), false, err
+		}
+		if matched {
+			return fmt.Sprintf("its %s %v matched the exclude filter '%v'", d.name, values, d.set.Exclude), false, nil
+		}
+	}
+	return "", true, nil
+}
+
+// patterns the compiled regular expressions, as the same patterns are matched
+// against every node on every pass
+var patterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// compilePattern compile the regular expression, reusing a previous
+// compilation of the same pattern
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patterns.Lock()
+	defer patterns.Unlock()
+	if r, ok := patterns.compiled[pattern]; ok {
+		return r, nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.compiled[pattern] = r
+	return r, nil
+}
+
+// anchor the pattern as it is to be compiled, i.e. anchored to both ends of
+// the value if the filter is anchored
+func (f Filter) anchor(pattern string) string {
+	if f.Anchored {
+		return "^(?:" + pattern + ")$"
+	}
+	return pattern
+}
+
+// compile compile the pattern as it is to be matched, see anchor. The pattern
+// itself is compiled first, as a pattern with unbalanced parentheses, e.g.
+// a)|(b, can compile once wrapped but would then not be anchored.
+func (f Filter) compile(pattern string) (*regexp.Regexp, error) {
+	r, err := compilePattern(pattern)
+	if err != nil || !f.Anchored {
+		return r, err
+	}
+	return compilePattern(f.anchor(pattern))
+}
+
+// matchedAny whether any of the values matches any of the patterns, or the
+// error compiling the first pattern that does not compile
+func (f Filter) matchedAny(patterns []string, values []string) (bool, error) {
+	for _, pattern := range patterns {
+		r, err := f.compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression '%s' : %s", pattern, err)
+		}
+		for _, value := range values {
+			if r.MatchString(value) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
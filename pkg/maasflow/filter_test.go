@@ -0,0 +1,117 @@
+package maasflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProcessAllInvalidFilter(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"n1","status_name":"Deployed"}`),
+	}
+	options := ProcessingOptions{Preview: true}
+	options.Filter.Hosts.Exclude = []string{"n1("}
+
+	results := ProcessAll(nil, nodes, options)
+	if !results[0].Skipped {
+		t.Errorf("expected the node to be skipped by an invalid filter, got %+v", results[0])
+	}
+	if results[0].Err == nil {
+		t.Errorf("expected the node to record the invalid filter")
+	}
+}
+
+func TestProcessAllManagedTag(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"n1","status_name":"Deployed","tag_names":["managed"]}`),
+		newTestNode(t, `{"system_id":"b","hostname":"n2","status_name":"Deployed","tag_names":["other"]}`),
+		newTestNode(t, `{"system_id":"c","hostname":"n3","status_name":"Deployed","tag_names":["managed"]}`),
+	}
+	options := ProcessingOptions{Preview: true, ManagedTag: "managed"}
+	options.Filter.Hosts.Exclude = []string{"n3"}
+
+	results := ProcessAll(nil, nodes, options)
+	for i, skipped := range []bool{false, true, true} {
+		if results[i].Skipped != skipped {
+			t.Errorf("%s: expected skipped %t, got %+v", results[i].Hostname, skipped, results[i])
+		}
+	}
+}
+
+func TestFilterAnchored(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		hostname   string
+		unanchored bool
+		anchored   bool
+	}{
+		{"compute-1", "compute-1", true, true},
+		{"compute-1", "compute-100", true, false},
+		{"compute-1", "host-compute-100", true, false},
+		{"compute-1.*", "compute-100", true, true},
+		{"compute-[0-9]+", "compute-12", true, true},
+		{"compute-[0-9]+", "compute-12.lab", true, false},
+		{"^compute-1$", "compute-1", true, true},
+		{"a|b", "b", true, true},
+		{"a|b", "ab", true, false},
+	}
+	for _, test := range tests {
+		node := newTestNode(t, `{"system_id":"a","hostname":"`+test.hostname+`"}`)
+		filter := Filter{Hosts: FilterSet{Include: []string{test.pattern}}}
+		if got := filter.Matches(node); got != test.unanchored {
+			t.Errorf("unanchored '%s' against '%s' = %t, want %t", test.pattern, test.hostname, got, test.unanchored)
+		}
+		filter.Anchored = true
+		if got := filter.Matches(node); got != test.anchored {
+			t.Errorf("anchored '%s' against '%s' = %t, want %t", test.pattern, test.hostname, got, test.anchored)
+		}
+
+		// Anchoring applies to the exclude patterns too
+		filter = Filter{Anchored: true, Hosts: FilterSet{Exclude: []string{test.pattern}}}
+		if got := filter.Matches(node); got != !test.anchored {
+			t.Errorf("anchored exclude '%s' against '%s' = %t, want %t", test.pattern, test.hostname, got, !test.anchored)
+		}
+	}
+}
+
+func TestFilterAnchoredUnbalanced(t *testing.T) {
+	// Wrapped for anchoring, the pattern compiles as ^(?:a)|(b)$, which is
+	// not anchored, so it is rejected as the pattern it is
+	pattern := "a)|(b"
+	filter := Filter{Anchored: true, Hosts: FilterSet{Include: []string{pattern}}}
+	if err := filter.Validate(); err == nil {
+		t.Errorf("expected the anchored pattern '%s' to be invalid", pattern)
+	}
+	if _, _, err := filter.Prune(); err == nil {
+		t.Errorf("expected pruning the only include pattern '%s' to be an error", pattern)
+	}
+	if _, _, err := DecodeFilter(strings.NewReader(`{"hosts":{"include":["`+pattern+`"]}}`), false); err == nil {
+		t.Errorf("expected decoding the pattern '%s' to be an error", pattern)
+	}
+	node := newTestNode(t, `{"system_id":"a","hostname":"compute-a1"}`)
+	if filter.Matches(node) {
+		t.Errorf("expected the anchored pattern '%s' not to match 'compute-a1'", pattern)
+	}
+}
+
+func TestFilterSubnets(t *testing.T) {
+	node := newTestNode(t, `{"system_id":"a","hostname":"n1","interface_set":[
+		{"id":1,"mac_address":"aa","links":[{"id":1,"mode":"auto","subnet":{"cidr":"10.1.2.0/24"}}]},
+		{"id":2,"mac_address":"ab","links":[{"id":2,"mode":"auto","subnet":{"cidr":"10.9.0.0/16"}}]}]}`)
+	tests := []struct {
+		name string
+		set  FilterSet
+		want bool
+	}{
+		{"no constraint", FilterSet{}, true},
+		{"included", FilterSet{Include: []string{`^10\.9\.`}}, true},
+		{"not included", FilterSet{Include: []string{`^172\.`}}, false},
+		{"excluded", FilterSet{Exclude: []string{`^10\.1\.2\.0/24$`}}, false},
+	}
+	for _, test := range tests {
+		filter := Filter{Subnets: test.set}
+		if got := filter.Matches(node); got != test.want {
+			t.Errorf("%s: Matches = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validator a check made before the action of a transition is taken, an
+// error describes why the action must not be taken yet
+type Validator func(node MaasNode, options ProcessingOptions) error
+
+// PowerOn require the node to be powered on
+var PowerOn = func(node MaasNode, options ProcessingOptions) error {
+	if state := node.PowerState(); state != "on" {
+		return fmt.Errorf("its power state is '%s', not 'on'", state)
+	}
+	return nil
+}
+
+// TestsPassed require the node to have passed all of its hardware tests
+var TestsPassed = func(node MaasNode, options ProcessingOptions) error {
+	status := node.TestingStatus()
+	switch status {
+	case "Passed":
+		return nil
+	case "":
+		return fmt.Errorf("it does not report the status of its hardware tests")
+	}
+	return fmt.Errorf("the status of its hardware tests is '%s', not 'Passed'", status)
+}
+
+// testsFailed whether MAAS reports the node failed its hardware tests
+func testsFailed(node MaasNode) bool {
+	switch node.TestingStatus() {
+	case "Failed", "Timed out":
+		return true
+	}
+	return false
+}
+
+// Validators the built in validators by the name with which they are
+// selected, see ProcessingOptions.Guards
+var Validators = map[string]Validator{
+	"power-on":     PowerOn,
+	"tests-passed": TestsPassed,
+}
+
+// validatorNames the names of the built in validators, sorted
+func validatorNames() []string {
+	names := make([]string, 0, len(Validators))
+	for name := range Validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// guard the validator of the transition from the given state, all the
+// validators selected for the state combined, nil if there are none
+func (o ProcessingOptions) guard(state string) Validator {
+	names := o.Guards[state]
+	if len(names) == 0 {
+		return nil
+	}
+	return func(node MaasNode, options ProcessingOptions) error {
+		for _, name := range names {
+			validate, ok := Validators[name]
+			if !ok {
+				return fmt.Errorf("unknown validator '%s'", name)
+			}
+			if err := validate(node, options); err != nil {
+				return fmt.Errorf("%s : %s", name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// validateGuards verify the guards only select known validators for states
+// from which there is a transition to the target state
+func (o ProcessingOptions) validateGuards(targets map[string]Action) error {
+	for state, names := range o.Guards {
+		if _, ok := targets[state]; !ok {
+			return fmt.Errorf("guard specified for state '%s' from which no transition to the target state is defined", state)
+		}
+		for _, name := range names {
+			if _, ok := Validators[name]; !ok {
+				return fmt.Errorf("unknown validator '%s' guarding state '%s', the validators are %s",
+					name, state, strings.Join(validatorNames(), ", "))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package maasflow
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate Validator
+		attrs    string
+		ok       bool
+	}{
+		{"powered on", PowerOn, `{"system_id":"a","power_state":"on"}`, true},
+		{"powered off", PowerOn, `{"system_id":"a","power_state":"off"}`, false},
+		{"tests passed", TestsPassed, `{"system_id":"a","testing_status_name":"Passed"}`, true},
+		{"tests failed", TestsPassed, `{"system_id":"a","testing_status_name":"Failed"}`, false},
+		{"tests not reported", TestsPassed, `{"system_id":"a"}`, false},
+	}
+	for _, test := range tests {
+		err := test.validate(newTestNode(t, test.attrs), ProcessingOptions{})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %t, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestGuardedTransition(t *testing.T) {
+	client := newTestMAAS(t, http.NotFoundHandler())
+	defer delete(tracker.nodes, "g")
+	options := ProcessingOptions{Preview: true, Guards: map[string][]string{"Ready": {"power-on", "tests-passed"}}}
+
+	node := newTestNode(t, `{"system_id":"g","hostname":"g","status_name":"Ready","power_state":"on","testing_status_name":"Failed"}`)
+	if result := processNode(client, node, options); !result.Skipped {
+		t.Errorf("expected the guarded action to be skipped, got %+v", result)
+	}
+
+	node = newTestNode(t, `{"system_id":"g","hostname":"g","status_name":"Ready","power_state":"on","testing_status_name":"Passed"}`)
+	if result := processNode(client, node, options); result.Skipped || result.Action != "Aquire" {
+		t.Errorf("expected the node to be aquired once its checks pass, got %+v", result)
+	}
+}
+
+func TestSkipTestFailed(t *testing.T) {
+	client := newTestMAAS(t, http.NotFoundHandler())
+	defer delete(tracker.nodes, "tf")
+	before := needsAttention.values[labelKey([]string{"reason", "tests_failed"})]
+
+	for _, state := range []string{"Ready", "Allocated"} {
+		node := newTestNode(t, `{"system_id":"tf","hostname":"tf","status_name":"`+state+`","testing_status_name":"Failed"}`)
+		if result := processNode(client, node, ProcessingOptions{Preview: true, SkipTestFailed: true}); !result.Skipped {
+			t.Errorf("%s: expected the node that failed its tests to be skipped, got %+v", state, result)
+		}
+		if result := processNode(client, node, ProcessingOptions{Preview: true}); result.Skipped {
+			t.Errorf("%s: expected the tests to be ignored unless skipping, got %+v", state, result)
+		}
+	}
+	if got := needsAttention.values[labelKey([]string{"reason", "tests_failed"})] - before; got != 2 {
+		t.Errorf("expected 2 nodes needing attention to be counted, got %v", got)
+	}
+}
+
+func TestValidateGuards(t *testing.T) {
+	tests := []struct {
+		name   string
+		guards map[string][]string
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"known", map[string][]string{"Allocated": {"tests-passed"}}, true},
+		{"unknown validator", map[string][]string{"Allocated": {"tests-ran"}}, false},
+		{"unknown state", map[string][]string{"Sleeping": {"power-on"}}, false},
+	}
+	for _, test := range tests {
+		err := ProcessingOptions{Guards: test.guards}.Validate()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %t, got %v", test.name, test.ok, err)
+		}
+	}
+}
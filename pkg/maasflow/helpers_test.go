@@ -0,0 +1,48 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// newTestNode a node with the given JSON attributes, as returned by MAAS
+func newTestNode(t *testing.T, attrs string) MaasNode {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(attrs), &values); err != nil {
+		t.Fatalf("invalid node attributes %s : %s", attrs, err)
+	}
+	if _, ok := values["resource_uri"]; !ok {
+		values["resource_uri"] = "/MAAS/api/1.0/nodes/" + values["system_id"].(string) + "/"
+	}
+	data, _ := json.Marshal(values)
+
+	client, err := maas.NewAnonymousClient("http://localhost/MAAS/", "1.0")
+	if err != nil {
+		t.Fatalf("unable to create client : %s", err)
+	}
+	parsed, err := maas.Parse(*client, data)
+	if err != nil {
+		t.Fatalf("unable to parse node : %s", err)
+	}
+	obj, err := parsed.GetMAASObject()
+	if err != nil {
+		t.Fatalf("unable to create node : %s", err)
+	}
+	return MaasNode{obj}
+}
+
+// newTestMAAS a client of a fake MAAS server that answers requests with the
+// given handler, the server is closed when the test completes
+func newTestMAAS(t *testing.T, handler http.Handler) *maas.MAASObject {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := maas.NewAnonymousClient(server.URL+"/MAAS/", "1.0")
+	if err != nil {
+		t.Fatalf("unable to create client : %s", err)
+	}
+	return maas.NewMAAS(*client)
+}
@@ -0,0 +1,165 @@
+package maasflow
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// The keys of the node owner data in which the lock on a node is recorded
+const (
+	lockHolderKey  = "maas-flow-lock-holder"
+	lockExpiresKey = "maas-flow-lock-expires"
+)
+
+// lockLease how long a lock on a node is held before it expires, so that the
+// nodes locked by an instance that dies are not locked forever
+const lockLease = 5 * time.Minute
+
+// DefaultInstanceID an identifier for this instance of the automation, used
+// when locking nodes, that is unique across the hosts running instances
+func DefaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// mutatingAction whether the action may modify the node, as opposed to only
+// reporting on it. Waiting may remediate a node, but only rarely, so it is not
+// considered mutating.
+func mutatingAction(action Action) bool {
+	return !(sameAction(action, Done) || sameAction(action, Wait) ||
+		sameAction(action, Fail) || sameAction(action, AdminState))
+}
+
+// lockNode attempt to lock the node so that only this instance acts on it,
+// returning whether the lock was obtained. The lock is advisory, it only
+// coordinates instances of the automation and is not enforced by MAAS. It is
+// recorded in the owner data of the node by reading the lock, writing this
+// instance's lock and reading it back. MAAS offers no compare and set of
+// owner data, so two instances that write at the same moment may both read
+// back their own lock before the other write lands, and both act on the node.
+// The window is small and the actions are ones MAAS rejects when already in
+// progress, so the lock reduces rather than eliminates duplicate actions.
+//
+// Owner data only exists for nodes with an owner, so nodes without an owner
+// are not locked. The only actions taken on them, commission and aquire, are
+// serialized by MAAS itself, an aquire of a node another instance has just
+// aquired fails with a conflict, see acquireWithRetry, and a commission of a
+// node already commissioning is rejected.
+func lockNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (bool, error) {
+	if node.Owner() == "" {
+		return true, nil
+	}
+	nodeObj := client.GetSubObject("nodes").GetSubObject(node.SystemID())
+
+	holder, expires, err := readLock(options, nodeObj)
+	if err != nil {
+		return false, err
+	}
+	if holder != "" && holder != options.InstanceID && clock.Now().Before(expires) {
+		return false, nil
+	}
+
+	params := url.Values{}
+	params.Add(lockHolderKey, options.InstanceID)
+	params.Add(lockExpiresKey, clock.Now().Add(lockLease).UTC().Format(time.RFC3339))
+	if _, err := callPost(options, nodeObj, "set_owner_data", params); err != nil {
+		return false, err
+	}
+
+	// Another instance may have written its lock at the same time, the last
+	// write wins so read it back to determine which instance holds the lock
+	holder, _, err = readLock(options, nodeObj)
+	if err != nil {
+		return false, err
+	}
+	return holder == options.InstanceID, nil
+}
+
+// unlockNode release the lock on the node, if held, by removing it from the
+// owner data of the node
+func unlockNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) {
+	if node.Owner() == "" {
+		return
+	}
+	nodeObj := client.GetSubObject("nodes").GetSubObject(node.SystemID())
+	params := url.Values{}
+	params.Add(lockHolderKey, "")
+	params.Add(lockExpiresKey, "")
+	_, err := callPost(options, nodeObj, "set_owner_data", params)
+	if err != nil {
+		options.logf("[warn] unable to unlock node '%s', the lock will expire : %s", node.Hostname(), err)
+	}
+}
+
+// readLock read the holder and expiry of the lock on a node from its owner
+// data, a node that is not locked has no holder
+func readLock(options ProcessingOptions, nodeObj maas.MAASObject) (string, time.Time, error) {
+	fresh, err := getObject(options, nodeObj)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	data, err := fresh.GetMap()["owner_data"].GetMap()
+	if err != nil {
+		return "", time.Time{}, nil
+	}
+	holder, _ := data[lockHolderKey].GetString()
+	value, _ := data[lockExpiresKey].GetString()
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return holder, time.Time{}, nil
+	}
+	return holder, expires, nil
+}
+
+// lockToUpdate lock the node, when locking nodes, before modifying it outside
+// of its action, i.e. to reconcile it with its mapping, returning whether
+// the node may be modified and the function to call once done
+func lockToUpdate(client *maas.MAASObject, node MaasNode, options ProcessingOptions, what string) (func(), bool) {
+	if !options.LockNodes || options.Preview {
+		return func() {}, true
+	}
+	ok, err := lockNode(client, node, options)
+	if err != nil {
+		options.logf("[warn] unable to lock node '%s', not %s it this pass : %s", node.Hostname(), what, err)
+		return nil, false
+	}
+	if !ok {
+		options.logf("[info] not %s node '%s' this pass as it is locked by another instance", what, node.Hostname())
+		return nil, false
+	}
+	return func() { unlockNode(client, node, options) }, true
+}
+
+// holdToUpdate take the precautions of a mutating action before modifying the
+// node outside of its action: nothing is modified while cordoned, one of the
+// mutating actions in flight is held and the node is locked when locking
+// nodes. Returns whether the node may be modified and the function to call
+// once done.
+func holdToUpdate(client *maas.MAASObject, node MaasNode, options ProcessingOptions, what string) (func(), bool) {
+	if Cordoned() {
+		if options.verbose() {
+			options.logf("[info] not %s node '%s' as cordoned", what, node.Hostname())
+		}
+		return nil, false
+	}
+	if options.Preview {
+		return func() {}, true
+	}
+	inFlight.acquire()
+	unlock, ok := lockToUpdate(client, node, options, what)
+	if !ok {
+		inFlight.release()
+		return nil, false
+	}
+	return func() {
+		unlock()
+		inFlight.release()
+	}, true
+}
@@ -0,0 +1,189 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLockServer a fake MAAS serving a single node with owner data, the
+// owner data written by set_owner_data can be replaced by racing, to model
+// another instance writing its lock at the same moment
+type fakeLockServer struct {
+	sync.Mutex
+	owner  string
+	data   map[string]string
+	writes int
+	racing map[string]string
+}
+
+func (s *fakeLockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Method == http.MethodPost && r.URL.Query().Get("op") == "set_owner_data" {
+		r.ParseForm()
+		for key := range r.PostForm {
+			s.data[key] = r.PostForm.Get(key)
+		}
+		s.writes++
+		if s.racing != nil {
+			s.data = s.racing
+		}
+		w.Write([]byte("{}"))
+		return
+	}
+	node := map[string]interface{}{
+		"system_id":    "a",
+		"hostname":     "n1",
+		"owner":        s.owner,
+		"owner_data":   s.data,
+		"resource_uri": "/MAAS/api/1.0/nodes/a/",
+	}
+	json.NewEncoder(w).Encode(node)
+}
+
+func lockData(holder string, expires time.Time) map[string]string {
+	return map[string]string{lockHolderKey: holder, lockExpiresKey: expires.UTC().Format(time.RFC3339)}
+}
+
+func TestLockNode(t *testing.T) {
+	useFakeClock(t)
+	now := clock.Now()
+	tests := []struct {
+		name   string
+		owner  string
+		data   map[string]string
+		racing map[string]string
+		want   bool
+		writes int
+	}{
+		{"ownerless node", "", map[string]string{}, nil, true, 0},
+		{"unlocked", "maas", map[string]string{}, nil, true, 1},
+		{"held by self", "maas", lockData("self", now.Add(time.Minute)), nil, true, 1},
+		{"held by another", "maas", lockData("other", now.Add(time.Minute)), nil, false, 0},
+		{"held by another, expired", "maas", lockData("other", now.Add(-time.Minute)), nil, true, 1},
+		{"lost the race", "maas", map[string]string{}, lockData("other", now.Add(time.Minute)), false, 1},
+	}
+	for _, test := range tests {
+		server := &fakeLockServer{owner: test.owner, data: test.data, racing: test.racing}
+		client := newTestMAAS(t, server)
+		node := newTestNode(t, `{"system_id":"a","hostname":"n1","owner":"`+test.owner+`"}`)
+
+		got, err := lockNode(client, node, ProcessingOptions{InstanceID: "self"})
+		if err != nil {
+			t.Errorf("%s: unexpected error : %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: locked = %t, want %t", test.name, got, test.want)
+		}
+		if server.writes != test.writes {
+			t.Errorf("%s: %d lock writes, want %d", test.name, server.writes, test.writes)
+		}
+	}
+}
+
+func TestLockNodeContention(t *testing.T) {
+	server := &fakeLockServer{owner: "maas", data: map[string]string{}}
+	client := newTestMAAS(t, server)
+	node := newTestNode(t, `{"system_id":"a","hostname":"n1","owner":"maas"}`)
+
+	first, err := lockNode(client, node, ProcessingOptions{InstanceID: "first"})
+	if err != nil || !first {
+		t.Fatalf("expected the first instance to lock the node, got %t, %v", first, err)
+	}
+	second, err := lockNode(client, node, ProcessingOptions{InstanceID: "second"})
+	if err != nil || second {
+		t.Fatalf("expected the second instance to be refused the lock, got %t, %v", second, err)
+	}
+
+	unlockNode(client, node, ProcessingOptions{InstanceID: "first"})
+	second, err = lockNode(client, node, ProcessingOptions{InstanceID: "second"})
+	if err != nil || !second {
+		t.Fatalf("expected the second instance to lock the released node, got %t, %v", second, err)
+	}
+}
+
+func TestLockLeaseExpires(t *testing.T) {
+	fake := useFakeClock(t)
+	server := &fakeLockServer{owner: "maas", data: map[string]string{}}
+	client := newTestMAAS(t, server)
+	node := newTestNode(t, `{"system_id":"a","hostname":"n1","owner":"maas"}`)
+
+	if first, err := lockNode(client, node, ProcessingOptions{InstanceID: "first"}); err != nil || !first {
+		t.Fatalf("expected the first instance to lock the node, got %t, %v", first, err)
+	}
+
+	fake.Advance(lockLease - time.Second)
+	if second, err := lockNode(client, node, ProcessingOptions{InstanceID: "second"}); err != nil || second {
+		t.Fatalf("expected the lock to be held until the lease expires, got %t, %v", second, err)
+	}
+
+	fake.Advance(2 * time.Second)
+	if second, err := lockNode(client, node, ProcessingOptions{InstanceID: "second"}); err != nil || !second {
+		t.Fatalf("expected the second instance to lock the node once the lease expired, got %t, %v", second, err)
+	}
+}
+
+// ownerDataServer a fakeNodeServer that also records the owner data written
+// by set_owner_data, so that a lock can be read back
+type ownerDataServer struct {
+	fakeNodeServer
+}
+
+func (s *ownerDataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Query().Get("op") == "set_owner_data" {
+		r.ParseForm()
+		s.Lock()
+		data := map[string]string{}
+		for key := range r.PostForm {
+			data[key] = r.PostForm.Get(key)
+		}
+		s.node["owner_data"] = data
+		s.Unlock()
+	}
+	s.fakeNodeServer.ServeHTTP(w, r)
+}
+
+func TestReconcileTakesPrecautions(t *testing.T) {
+	useFakeClock(t)
+	mappings := map[string]interface{}{"aa:bb:cc:dd:ee:01": map[string]interface{}{"hostname": "mapped"}}
+	attrs := `{"system_id":"rc","hostname":"calm-otter","status_name":"Deployed","owner":"maas",` +
+		`"macaddress_set":[{"mac_address":"aa:bb:cc:dd:ee:01"}],"resource_uri":"/MAAS/api/1.0/nodes/rc/"}`
+	serve := func(data map[string]string) (*ownerDataServer, []MaasNode) {
+		server := &ownerDataServer{fakeNodeServer{node: map[string]interface{}{}, posts: map[string][]string{}, params: map[string]string{}}}
+		json.Unmarshal([]byte(attrs), &server.node)
+		server.node["owner_data"] = data
+		return server, []MaasNode{newTestNode(t, attrs)}
+	}
+	options := ProcessingOptions{RenameMode: RenameAlways, Mappings: mappings, EnsureTag: "managed",
+		LockNodes: true, InstanceID: "self"}
+
+	// Nothing is reconciled or tagged while cordoned
+	server, nodes := serve(map[string]string{})
+	SetCordoned(true)
+	ProcessAll(newTestMAAS(t, server), nodes, options)
+	WaitForActions()
+	SetCordoned(false)
+	if server.updates != 0 || len(server.posts["update_nodes"]) != 0 {
+		t.Errorf("expected no updates while cordoned, got %d updates and %v", server.updates, server.posts)
+	}
+
+	// Nor while another instance holds the lock
+	server, nodes = serve(lockData("other", clock.Now().Add(time.Minute)))
+	ProcessAll(newTestMAAS(t, server), nodes, options)
+	WaitForActions()
+	if server.updates != 0 || len(server.posts["update_nodes"]) != 0 {
+		t.Errorf("expected no updates while locked by another, got %d updates and %v", server.updates, server.posts)
+	}
+
+	// Otherwise the node is locked before it is reconciled
+	server, nodes = serve(map[string]string{})
+	ProcessAll(newTestMAAS(t, server), nodes, options)
+	WaitForActions()
+	if server.updates != 1 || len(server.posts["set_owner_data"]) == 0 {
+		t.Errorf("expected the node to be locked and reconciled, got %d updates and %v", server.updates, server.posts)
+	}
+}
@@ -0,0 +1,123 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MappingMatch a MAC address in the mappings that is on a node
+type MappingMatch struct {
+	MAC          string
+	Hostname     string
+	SystemID     string
+	NodeHostname string
+}
+
+// UnmappedNode a node none of whose MAC addresses are in the mappings
+type UnmappedNode struct {
+	SystemID string
+	Hostname string
+	MACs     []string
+}
+
+// MappingConflict mappings that cannot all be honored, i.e. the same hostname
+// mapped from MAC addresses on different nodes
+type MappingConflict struct {
+	Hostname string
+	MACs     []string
+	Reason   string
+}
+
+// MappingReport the result of checking the mappings against the nodes known
+// to MAAS, as reported by the check-mappings command
+type MappingReport struct {
+	Matched   []MappingMatch
+	Unmatched []string
+	Unmapped  []UnmappedNode
+	Conflicts []MappingConflict
+}
+
+// CheckMappings check the mappings against the nodes, reporting which mapped
+// MAC addresses are on a node, which are on no node, which nodes have no
+// mapped MAC address and which mappings conflict with each other. A hostname
+// may be mapped from several MAC addresses, i.e. the interfaces of one node,
+// but mapping it from MAC addresses that are not all on the same node, or
+// mapping one node's MAC addresses to different hostnames, is a conflict.
+func CheckMappings(nodes []MaasNode, mappings map[string]interface{}) MappingReport {
+	var report MappingReport
+
+	owners := make(map[string]MaasNode)
+	for _, node := range nodes {
+		matched := false
+		mapped := make(map[string][]string)
+		for _, mac := range node.MACs() {
+			owners[mac] = node
+			if entry, ok := mappings[mac]; ok {
+				matched = true
+				// A mapping of only the zone or tags leaves the hostname as is
+				// and so does not conflict with a hostname mapped for the node
+				hostname := parseMapping(entry).Hostname
+				if hostname != "" {
+					mapped[hostname] = append(mapped[hostname], mac)
+				}
+				report.Matched = append(report.Matched, MappingMatch{
+					MAC: mac, Hostname: hostname, SystemID: node.SystemID(), NodeHostname: node.Hostname()})
+			}
+		}
+		if !matched {
+			report.Unmapped = append(report.Unmapped, UnmappedNode{node.SystemID(), node.Hostname(), node.MACs()})
+		}
+		if len(mapped) > 1 {
+			var hostnames, macs []string
+			for hostname, from := range mapped {
+				hostnames = append(hostnames, hostname)
+				macs = append(macs, from...)
+			}
+			sort.Strings(hostnames)
+			sort.Strings(macs)
+			report.Conflicts = append(report.Conflicts, MappingConflict{
+				Hostname: strings.Join(hostnames, ","),
+				MACs:     macs,
+				Reason:   fmt.Sprintf("node '%s' is mapped to %d different hostnames", node.SystemID(), len(hostnames)),
+			})
+		}
+	}
+
+	byHostname := make(map[string][]string)
+	for mac, entry := range mappings {
+		if _, ok := owners[mac]; !ok {
+			report.Unmatched = append(report.Unmatched, mac)
+		}
+		if hostname := parseMapping(entry).Hostname; hostname != "" {
+			byHostname[hostname] = append(byHostname[hostname], mac)
+		}
+	}
+	for hostname, macs := range byHostname {
+		if len(macs) < 2 {
+			continue
+		}
+		sort.Strings(macs)
+		distinct := make(map[string]bool)
+		for _, mac := range macs {
+			if node, ok := owners[mac]; ok {
+				distinct[node.SystemID()] = true
+			} else {
+				distinct["mac:"+mac] = true
+			}
+		}
+		if len(distinct) > 1 {
+			report.Conflicts = append(report.Conflicts, MappingConflict{
+				Hostname: hostname,
+				MACs:     macs,
+				Reason:   "mapped from MAC addresses that are not all on the same node",
+			})
+		}
+	}
+
+	sort.Slice(report.Matched, func(i, j int) bool { return report.Matched[i].MAC < report.Matched[j].MAC })
+	sort.Strings(report.Unmatched)
+	sort.Slice(report.Unmapped, func(i, j int) bool { return report.Unmapped[i].Hostname < report.Unmapped[j].Hostname })
+	sort.Slice(report.Conflicts, func(i, j int) bool { return report.Conflicts[i].Hostname < report.Conflicts[j].Hostname })
+	return report
+}
@@ -0,0 +1,48 @@
+package maasflow
+
+import (
+	"testing"
+)
+
+func TestCheckMappingsHostnames(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"a","macaddress_set":[{"mac_address":"aa"},{"mac_address":"ab"}]}`),
+		newTestNode(t, `{"system_id":"b","hostname":"b","macaddress_set":[{"mac_address":"ba"},{"mac_address":"bb"}]}`),
+		newTestNode(t, `{"system_id":"c","hostname":"c","macaddress_set":[{"mac_address":"ca"}]}`),
+	}
+	mappings := map[string]interface{}{
+		// A hostname along with a zone only mapping for the same node
+		"aa": "node-a",
+		"ab": map[string]interface{}{"zone": "rack-1"},
+		// Different hostnames for the same node
+		"ba": "node-b",
+		"bb": map[string]interface{}{"hostname": "node-b2"},
+		"zz": "node-z",
+	}
+
+	report := CheckMappings(nodes, mappings)
+	if len(report.Matched) != 4 {
+		t.Errorf("expected 4 matched MAC addresses, got %+v", report.Matched)
+	}
+	if len(report.Unmatched) != 1 || report.Unmatched[0] != "zz" {
+		t.Errorf("expected only 'zz' to be unmatched, got %v", report.Unmatched)
+	}
+	if len(report.Unmapped) != 1 || report.Unmapped[0].SystemID != "c" {
+		t.Errorf("expected only node 'c' to be unmapped, got %+v", report.Unmapped)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Hostname != "node-b,node-b2" {
+		t.Errorf("expected only node 'b' to conflict, got %+v", report.Conflicts)
+	}
+}
+
+func TestCheckMappingsWithoutHostname(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"a","macaddress_set":[{"mac_address":"aa"}]}`),
+	}
+	mappings := map[string]interface{}{"aa": map[string]interface{}{"tags": []interface{}{"gpu"}}}
+
+	report := CheckMappings(nodes, mappings)
+	if len(report.Matched) != 1 || len(report.Unmapped) != 0 || len(report.Conflicts) != 0 {
+		t.Errorf("expected a tags only mapping to match without conflict, got %+v", report)
+	}
+}
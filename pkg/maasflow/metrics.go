@@ -0,0 +1,225 @@
+package maasflow
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric a value exported in the OpenMetrics text format
+type metric interface {
+	family() string
+	write(w io.Writer)
+}
+
+// registry all the metrics exported by the automation
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+// register add a metric to those exported
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+// labelKey render label name / value pairs in the OpenMetrics form, i.e.
+// {zone="default",state="Ready"}
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sample a single value of a metric with its rendered labels
+type sample struct {
+	labels string
+	value  float64
+}
+
+// valueMetric the common implementation of gauges and counters, a value for
+// each distinct set of labels
+type valueMetric struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	suffix string
+	values map[string]float64
+}
+
+func (m *valueMetric) family() string {
+	return m.name
+}
+
+func (m *valueMetric) write(w io.Writer) {
+	m.Lock()
+	samples := make([]sample, 0, len(m.values))
+	for labels, value := range m.values {
+		samples = append(samples, sample{labels, value})
+	}
+	m.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", m.name, m.kind, m.name, m.help)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s%s %g\n", m.name, m.suffix, s.labels, s.value)
+	}
+}
+
+// gauge a metric whose value can go up and down
+type gauge struct {
+	valueMetric
+}
+
+func newGauge(name string, help string) *gauge {
+	g := &gauge{valueMetric{name: name, help: help, kind: "gauge", values: make(map[string]float64)}}
+	register(g)
+	return g
+}
+
+// set set the value of the gauge for the given label name / value pairs
+func (g *gauge) set(value float64, labels ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[labelKey(labels)] = value
+}
+
+// reset remove all the values of the gauge, used when the set of labels is
+// recomputed each pass
+func (g *gauge) reset() {
+	g.Lock()
+	defer g.Unlock()
+	g.values = make(map[string]float64)
+}
+
+// counter a metric whose value only increases
+type counter struct {
+	valueMetric
+}
+
+func newCounter(name string, help string) *counter {
+	c := &counter{valueMetric{name: name, help: help, kind: "counter", suffix: "_total", values: make(map[string]float64)}}
+	register(c)
+	return c
+}
+
+// inc increment the counter for the given label name / value pairs
+func (c *counter) inc(labels ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelKey(labels)]++
+}
+
+// histogram a metric that counts observations into buckets
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *histogram) family() string {
+	return h.name
+}
+
+// observe add an observation to the histogram
+func (h *histogram) observe(value float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# TYPE %s histogram\n# HELP %s %s\n", h.name, h.name, h.help)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// The metrics describing each processing pass
+var (
+	passDuration = newHistogram("maas_flow_pass_duration_seconds",
+		"Wall clock time taken to process all the nodes in a pass.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60, 120})
+	passNodes = newGauge("maas_flow_pass_nodes",
+		"Number of nodes considered in the last pass.")
+	matchedNodes = newGauge("maas_flow_matched_nodes",
+		"Number of nodes that matched the filter in the last pass.")
+	hostnameDrift = newGauge("maas_flow_hostname_drift",
+		"Number of nodes whose hostname differed from their mapped hostname in the last pass.")
+	nodeErrors = newCounter("maas_flow_node_errors",
+		"Number of errors processing nodes, by reason.")
+	needsAttention = newCounter("maas_flow_needs_attention",
+		"Number of times a node was left for manual attention rather than acted on, by reason.")
+	notificationsDropped = newCounter("maas_flow_notifications_dropped",
+		"Number of notifications dropped, by reason, as the queue was full, delivery failed or on shutdown.")
+	notificationsCoalesced = newCounter("maas_flow_notifications_coalesced",
+		"Number of failure notifications, by action, coalesced into a summary as identical to one sent within the notification window.")
+	noTransitions = newCounter("maas_flow_no_transition",
+		"Number of times a node was found in a state with no transition to the target state.")
+	authFailures = newCounter("maas_flow_auth_failures",
+		"Number of requests to MAAS that failed authentication.")
+	actionsTaken = newCounter("maas_flow_actions",
+		"Number of actions completed, by action and whether the action modified the node.")
+	zoneNodes = newGauge("maas_flow_zone_nodes",
+		"Number of nodes in each zone in each state in the last pass.")
+	duplicateHostnames = newGauge("maas_flow_duplicate_hostnames",
+		"Number of hostnames shared by more than one node in the last pass.")
+	backpressureLevel = newGauge("maas_flow_backpressure_level",
+		"The level of backpressure applied because MAAS is overloaded, each level halves the concurrency and doubles the poll interval.")
+	oscillatingNodes = newGauge("maas_flow_oscillating_nodes",
+		"Number of matched nodes whose states repeated the same cycle within the oscillation passes as of the last pass.")
+	noProgressPasses = newGauge("maas_flow_no_progress_passes",
+		"Number of passes in a row that took actions without the matched nodes advancing towards the target state.")
+	convergedGauge = newGauge("maas_flow_converged",
+		"Whether, as of the last pass, every matched node was at the target state or needed manual attention, with no work remaining.")
+)
+
+// MetricsHandler an HTTP handler that exports the automation's metrics in
+// the OpenMetrics text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.Lock()
+		metrics := make([]metric, len(registry.metrics))
+		copy(metrics, registry.metrics)
+		registry.Unlock()
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].family() < metrics[j].family() })
+
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		for _, m := range metrics {
+			m.write(w)
+		}
+		fmt.Fprintln(w, "# EOF")
+	})
+}
@@ -0,0 +1,136 @@
+package maasflow
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// nameTemplateVerb the single integer verb a name template must contain, i.e.
+// the %03d of gpu-pool-%03d
+var nameTemplateVerb = regexp.MustCompile(`%0?[0-9]*d`)
+
+// poolNames the indexes of the names generated from the name template that are
+// in use, by the system id of the node using each, either as the hostname of a
+// node or allocated to a node being aquired. An index is only freed when its
+// node is released, so a node that has not yet been seen with its new name is
+// never given the same name as another.
+var poolNames = struct {
+	sync.Mutex
+	used map[int]string
+}{used: make(map[int]string)}
+
+// validNameTemplate verify the template contains a single integer verb and no
+// other verbs
+func validNameTemplate(template string) error {
+	if len(nameTemplateVerb.FindAllString(template, -1)) != 1 {
+		return fmt.Errorf("name template '%s' must contain a single integer verb, i.e. gpu-pool-%%03d", template)
+	}
+	if strings.Count(nameTemplateVerb.ReplaceAllString(template, ""), "%") > 0 {
+		return fmt.Errorf("name template '%s' must not contain verbs other than its integer verb", template)
+	}
+	return nil
+}
+
+// poolIndex the index from which the name was generated by the template, if
+// it was
+func poolIndex(template string, name string) (int, bool) {
+	parts := nameTemplateVerb.Split(template, 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	pattern := "^" + regexp.QuoteMeta(parts[0]) + "([0-9]+)" + regexp.QuoteMeta(parts[1]) + "$"
+	match := regexp.MustCompile(pattern).FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	index, err := strconv.Atoi(match[1])
+	if err != nil || fmt.Sprintf(template, index) != name {
+		return 0, false
+	}
+	return index, true
+}
+
+// recordPoolNames record the indexes used by the hostnames of the nodes,
+// including those that do not match the filter, so they are not given again
+func recordPoolNames(nodes []MaasNode, template string) {
+	poolNames.Lock()
+	defer poolNames.Unlock()
+	for _, node := range nodes {
+		if index, ok := poolIndex(template, shortHostname(node)); ok {
+			poolNames.used[index] = node.SystemID()
+		}
+	}
+}
+
+// allocatePoolName allocate the name with the lowest unused index to the node,
+// a node already allocated a name keeps it
+func allocatePoolName(template string, id string) string {
+	return poolName(template, id, true)
+}
+
+// poolName the name with the lowest unused index, or the name already
+// allocated to the node, recording the index as used by the node if record
+func poolName(template string, id string, record bool) string {
+	poolNames.Lock()
+	defer poolNames.Unlock()
+	for index, user := range poolNames.used {
+		if user == id {
+			return fmt.Sprintf(template, index)
+		}
+	}
+	index := 1
+	for poolNames.used[index] != "" {
+		index++
+	}
+	if record {
+		poolNames.used[index] = id
+	}
+	return fmt.Sprintf(template, index)
+}
+
+// freePoolName free the index used by the node, once it is released. Should
+// the node keep its name the index is recorded again when next listed.
+func freePoolName(id string) {
+	poolNames.Lock()
+	defer poolNames.Unlock()
+	for index, user := range poolNames.used {
+		if user == id {
+			delete(poolNames.used, index)
+		}
+	}
+}
+
+// namePoolNode rename the node to the next name from the name template, unless
+// it is already named from the template or is mapped to a hostname, returning
+// the node as updated by MAAS
+func namePoolNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (MaasNode, error) {
+	if options.NameTemplate == "" {
+		return node, nil
+	}
+	if _, ok := poolIndex(options.NameTemplate, shortHostname(node)); ok {
+		return node, nil
+	}
+	if _, ok := mappedHostname(node, options); ok {
+		return node, nil
+	}
+
+	// A preview does not rename the node, so does not use the name
+	name := poolName(options.NameTemplate, node.SystemID(), !options.Preview)
+	options.logf("RENAME '%s' to '%s'", node.Hostname(), name)
+	if options.Preview {
+		return node, nil
+	}
+	nodeObj := client.GetSubObject("nodes").GetSubObject(node.SystemID())
+	updated, err := updateObject(options, nodeObj, url.Values{"hostname": []string{name}})
+	if err != nil {
+		options.logf("ERROR: RENAME '%s' : '%s'", node.Hostname(), err)
+		return node, err
+	}
+	return MaasNode{updated}, nil
+}
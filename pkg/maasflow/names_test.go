@@ -0,0 +1,145 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPoolIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		ok    bool
+	}{
+		{"gpu-pool-001", 1, true},
+		{"gpu-pool-042", 42, true},
+		{"gpu-pool-1234", 1234, true},
+		{"gpu-pool-1", 0, false},
+		{"gpu-pool-001x", 0, false},
+		{"cpu-pool-001", 0, false},
+	}
+	for _, test := range tests {
+		index, ok := poolIndex("gpu-pool-%03d", test.name)
+		if index != test.index || ok != test.ok {
+			t.Errorf("%s: expected %d, %t, got %d, %t", test.name, test.index, test.ok, index, ok)
+		}
+	}
+}
+
+func TestValidNameTemplate(t *testing.T) {
+	for template, ok := range map[string]bool{
+		"gpu-pool-%03d":    true,
+		"rack-%d-compute":  true,
+		"gpu-pool":         false,
+		"gpu-%d-pool-%03d": false,
+		"gpu-%s-%d":        false,
+	} {
+		if err := validNameTemplate(template); (err == nil) != ok {
+			t.Errorf("%s: expected ok %t, got %v", template, ok, err)
+		}
+	}
+}
+
+func TestAllocatePoolNameConcurrently(t *testing.T) {
+	defer func() { poolNames.used = make(map[int]string) }()
+	recordPoolNames([]MaasNode{newTestNode(t, `{"system_id":"p0","hostname":"gpu-pool-002.maas"}`)}, "gpu-pool-%03d")
+
+	names := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names[i] = allocatePoolName("gpu-pool-%03d", fmt.Sprintf("p%d", i+1))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{"gpu-pool-002": true}
+	for _, name := range names {
+		if seen[name] {
+			t.Errorf("name '%s' allocated more than once in %v", name, names)
+		}
+		seen[name] = true
+	}
+	if got := allocatePoolName("gpu-pool-%03d", "p1"); got != names[0] {
+		t.Errorf("expected the node to keep its allocated name '%s', got '%s'", names[0], got)
+	}
+}
+
+func TestNamePoolNode(t *testing.T) {
+	defer func() { poolNames.used = make(map[int]string) }()
+	server := &fakeNodeServer{node: map[string]interface{}{}, posts: map[string][]string{}, params: map[string]string{}}
+	json.Unmarshal([]byte(`{"system_id":"n","hostname":"calm-otter","owner":"admin"}`), &server.node)
+	server.node["resource_uri"] = "/MAAS/api/1.0/nodes/n/"
+	client := newTestMAAS(t, server)
+	node := newTestNode(t, `{"system_id":"n","hostname":"calm-otter","owner":"admin"}`)
+	options := ProcessingOptions{NameTemplate: "gpu-pool-%03d", Owner: "admin"}
+
+	if _, err := Deploy(client, node, options); err != nil {
+		t.Fatalf("unexpected error deploying : %s", err)
+	}
+	if server.node["hostname"] != "gpu-pool-001" {
+		t.Errorf("expected the node to be renamed to 'gpu-pool-001' before it is deployed, got %v", server.node["hostname"])
+	}
+	if len(server.posts["start"]) != 1 {
+		t.Errorf("expected the node to be started once, got %v", server.posts["start"])
+	}
+
+	renamed := newTestNode(t, `{"system_id":"n","hostname":"gpu-pool-001","owner":"admin"}`)
+	server.updates = 0
+	if _, err := namePoolNode(client, renamed, options); err != nil || server.updates != 0 {
+		t.Errorf("expected a node already named from the template to be left, got %d updates, %v", server.updates, err)
+	}
+}
+
+func TestPoolNamePreviewed(t *testing.T) {
+	defer func() { poolNames.used = make(map[int]string) }()
+	options := ProcessingOptions{NameTemplate: "gpu-pool-%03d", Preview: true}
+	previewed := newTestNode(t, `{"system_id":"pv","hostname":"calm-otter"}`)
+	if _, err := namePoolNode(nil, previewed, options); err != nil {
+		t.Fatalf("unexpected error previewing the name : %s", err)
+	}
+
+	server := &fakeNodeServer{node: map[string]interface{}{}, posts: map[string][]string{}, params: map[string]string{}}
+	json.Unmarshal([]byte(`{"system_id":"n","hostname":"keen-heron"}`), &server.node)
+	server.node["resource_uri"] = "/MAAS/api/1.0/nodes/n/"
+	client := newTestMAAS(t, server)
+	options.Preview = false
+	if _, err := namePoolNode(client, newTestNode(t, `{"system_id":"n","hostname":"keen-heron"}`), options); err != nil {
+		t.Fatalf("unexpected error naming the node : %s", err)
+	}
+	if server.node["hostname"] != "gpu-pool-001" {
+		t.Errorf("expected a preview not to use an index, got '%v'", server.node["hostname"])
+	}
+
+	// Once released the index is free for another node
+	if _, err := Release(client, newTestNode(t, `{"system_id":"n","hostname":"keen-heron"}`), options); err != nil {
+		t.Fatalf("unexpected error releasing the node : %s", err)
+	}
+	if got := allocatePoolName(options.NameTemplate, "other"); got != "gpu-pool-001" {
+		t.Errorf("expected the released node's index to be freed, got '%s'", got)
+	}
+}
+
+func TestAcquireNameDeferred(t *testing.T) {
+	defer func() { poolNames.used = make(map[int]string) }()
+	for _, deferred := range []bool{false, true} {
+		id := fmt.Sprintf("defer-%t", deferred)
+		fake := newFakeMAAS(t, map[string]string{id: "calm-otter"})
+		options := ProcessingOptions{AgentName: "maas-flow", NameTemplate: "gpu-pool-%03d",
+			DeferAcquireName: deferred, NodeIDs: []string{id}}
+
+		// New, Commissioning and then Ready, when the node is aquired
+		runPasses(t, fake, 3, options, id)
+		if got := fake.hostname(id); (got == "calm-otter") != deferred {
+			t.Errorf("deferred %t: unexpected hostname '%s' once aquired", deferred, got)
+		}
+		runPasses(t, fake, 1, options, id)
+		if got := fake.hostname(id); got == "calm-otter" {
+			t.Errorf("deferred %t: expected the node to be named once deployed, got '%s'", deferred, got)
+		}
+	}
+}
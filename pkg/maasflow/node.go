@@ -0,0 +1,481 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// MaasNodeStatus MAAS lifecycle status for nodes
+type MaasNodeStatus int
+
+// MAAS Node Statuses
+const (
+	Invalid             MaasNodeStatus = -1
+	New                 MaasNodeStatus = 0
+	Commissioning       MaasNodeStatus = 1
+	FailedCommissioning MaasNodeStatus = 2
+	Missing             MaasNodeStatus = 3
+	Ready               MaasNodeStatus = 4
+	Reserved            MaasNodeStatus = 5
+	Deployed            MaasNodeStatus = 6
+	Retired             MaasNodeStatus = 7
+	Broken              MaasNodeStatus = 8
+	Deploying           MaasNodeStatus = 9
+	Allocated           MaasNodeStatus = 10
+	FailedDeployment    MaasNodeStatus = 11
+	Releasing           MaasNodeStatus = 12
+	FailedReleasing     MaasNodeStatus = 13
+	DiskErasing         MaasNodeStatus = 14
+	FailedDiskErasing   MaasNodeStatus = 15
+)
+
+var names = []string{"New", "Commissioning", "FailedCommissioning", "Missing", "Ready", "Reserved",
+	"Deployed", "Retired", "Broken", "Deploying", "Allocated", "FailedDeployment",
+	"Releasing", "FailedReleasing", "DiskErasing", "FailedDiskErasing"}
+
+// statusOverrides the names of MAAS statuses, by numeric code, that override
+// or add to the built in names, see SetStatusNames
+var statusOverrides = map[MaasNodeStatus]string{}
+
+// SetStatusNames override the names of the MAAS statuses by their numeric
+// code, so that the automation can be adapted to a MAAS release that numbers
+// or names its statuses differently without being rebuilt. Codes that are not
+// overridden keep their built in names. This should be called before any nodes
+// are processed.
+func SetStatusNames(overrides map[int]string) error {
+	set := make(map[MaasNodeStatus]string, len(overrides))
+	for code, name := range overrides {
+		if code < 0 {
+			return fmt.Errorf("invalid MAAS status code %d, codes must not be negative", code)
+		}
+		if name = normalizeStatusName(name); name == "" {
+			return fmt.Errorf("the name of MAAS status code %d must not be empty", code)
+		}
+		set[MaasNodeStatus(code)] = name
+	}
+	statusOverrides = set
+	return nil
+}
+
+// statusNames the names of all the known statuses, the built in names that
+// are not overridden along with the overrides
+func statusNames() []string {
+	var all []string
+	for i, name := range names {
+		if _, ok := statusOverrides[MaasNodeStatus(i)]; !ok {
+			all = append(all, name)
+		}
+	}
+	for _, name := range statusOverrides {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return all
+}
+
+func (v MaasNodeStatus) String() string {
+	if name, ok := statusOverrides[v]; ok {
+		return name
+	}
+	if v < 0 || int(v) >= len(names) {
+		return fmt.Sprintf("Unknown(%d)", int(v))
+	}
+	return names[v]
+}
+
+// FromString lookup the constant value for a given node state name
+func FromString(name string) (MaasNodeStatus, error) {
+	for code, v := range statusOverrides {
+		if v == name {
+			return code, nil
+		}
+	}
+	for i, v := range names {
+		if _, ok := statusOverrides[MaasNodeStatus(i)]; v == name && !ok {
+			return MaasNodeStatus(i), nil
+		}
+	}
+	return -1, fmt.Errorf("Unknown MAAS node state name, '%s'", name)
+}
+
+// MaasNode convenience wrapper for an MAAS node on top of a generic MAAS object
+type MaasNode struct {
+	maas.MAASObject
+}
+
+// GetString get attribute value as string
+func (n *MaasNode) GetString(key string) (string, error) {
+	return n.GetMap()[key].GetString()
+}
+
+// GetFloat64 get attribute value as float64
+func (n *MaasNode) GetFloat64(key string) (float64, error) {
+	return n.GetMap()[key].GetFloat64()
+}
+
+// SystemID get the system id of the node. This is the stable identifier of a
+// node used by the MAAS API, so it should be used for all API sub-object
+// lookups as well as to identify the node in logs and in-memory tracking.
+func (n *MaasNode) SystemID() string {
+	id, _ := n.GetString("system_id")
+	return id
+}
+
+// ID get the numeric id of the node. On MAAS 2.0 this is an internal
+// identifier and is not used by the API to address the node, use SystemID
+// instead. Nodes without a numeric id return 0.
+func (n *MaasNode) ID() int {
+	id, err := n.GetInteger("id")
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func (n *MaasNode) PowerState() string {
+	state, _ := n.GetString("power_state")
+	return state
+}
+
+// PowerType get the type of the node's power control, i.e. ipmi, amt, manual
+func (n *MaasNode) PowerType() string {
+	powerType, _ := n.GetString("power_type")
+	return powerType
+}
+
+// TestingStatus get the status of the node's hardware tests as named by MAAS,
+// i.e. Passed or Failed, empty for MAAS versions that do not report it
+func (n *MaasNode) TestingStatus() string {
+	status, _ := n.GetString("testing_status_name")
+	return status
+}
+
+// Owner get the name of the MAAS user to which the node is allocated, nodes
+// that are not allocated have no owner
+func (n *MaasNode) Owner() string {
+	owner, _ := n.GetString("owner")
+	return owner
+}
+
+// OwnedBy whether the node is allocated to the given MAAS user, i.e. the user
+// as which the automation is authenticated, see WhoAmI
+func (n *MaasNode) OwnedBy(username string) bool {
+	return n.Owner() != "" && n.Owner() == username
+}
+
+// AgentName get the name of the agent that aquired the node, if any, as
+// given when the node was aquired. MAAS only reports this for some versions.
+func (n *MaasNode) AgentName() string {
+	agent, _ := n.GetString("agent_name")
+	return agent
+}
+
+// Hostname get the hostname
+func (n *MaasNode) Hostname() string {
+	hn, _ := n.GetString("hostname")
+	return hn
+}
+
+// Link a link between a node's interface and a subnet, identified by its
+// CIDR, along with the VLAN id of the subnet
+type Link struct {
+	ID     int    `json:"id"`
+	Mode   string `json:"mode"`
+	Subnet string `json:"subnet,omitempty"`
+	VLAN   int    `json:"vlan,omitempty"`
+}
+
+// Interface a network interface on a node, along with the VLAN id of the
+// VLAN to which it is attached
+type Interface struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	MAC   string `json:"mac_address"`
+	VLAN  int    `json:"vlan,omitempty"`
+	Links []Link `json:"links"`
+}
+
+// vlanID the id of a VLAN object, 0 if the object is not a VLAN
+func vlanID(obj maas.JSONObject) int {
+	vlan, err := obj.GetMap()
+	if err != nil {
+		return 0
+	}
+	vid, err := vlan["vid"].GetFloat64()
+	if err != nil {
+		return 0
+	}
+	return int(vid)
+}
+
+// Interfaces get the network interfaces, nodes that do not expose an
+// interface set have no interfaces
+func (n *MaasNode) Interfaces() []Interface {
+	ifcsObj, ok := n.GetMap()["interface_set"]
+	if !ok {
+		return []Interface{}
+	}
+	ifcs, err := ifcsObj.GetArray()
+	if err != nil {
+		return []Interface{}
+	}
+
+	result := make([]Interface, 0, len(ifcs))
+	for _, ifc := range ifcs {
+		attrs, err := ifc.GetMap()
+		if err != nil {
+			continue
+		}
+		var entry Interface
+		if id, err := attrs["id"].GetFloat64(); err == nil {
+			entry.ID = int(id)
+		}
+		entry.Name, _ = attrs["name"].GetString()
+		entry.MAC, _ = attrs["mac_address"].GetString()
+		entry.VLAN = vlanID(attrs["vlan"])
+
+		links, _ := attrs["links"].GetArray()
+		entry.Links = make([]Link, 0, len(links))
+		for _, link := range links {
+			linkAttrs, err := link.GetMap()
+			if err != nil {
+				continue
+			}
+			var l Link
+			if id, err := linkAttrs["id"].GetFloat64(); err == nil {
+				l.ID = int(id)
+			}
+			l.Mode, _ = linkAttrs["mode"].GetString()
+			if subnet, err := linkAttrs["subnet"].GetMap(); err == nil {
+				l.Subnet, _ = subnet["cidr"].GetString()
+				l.VLAN = vlanID(subnet["vlan"])
+			}
+			entry.Links = append(entry.Links, l)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Subnets get the CIDRs of the subnets to which the node's interfaces are
+// linked, each only once
+func (n *MaasNode) Subnets() []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, ifc := range n.Interfaces() {
+		for _, link := range ifc.Links {
+			if link.Subnet != "" && !seen[link.Subnet] {
+				seen[link.Subnet] = true
+				result = append(result, link.Subnet)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// VLANs get the ids of the VLANs to which the node's interfaces are attached
+// or linked, each only once
+func (n *MaasNode) VLANs() []int {
+	seen := make(map[int]bool)
+	result := []int{}
+	add := func(vid int) {
+		if vid != 0 && !seen[vid] {
+			seen[vid] = true
+			result = append(result, vid)
+		}
+	}
+	for _, ifc := range n.Interfaces() {
+		add(ifc.VLAN)
+		for _, link := range ifc.Links {
+			add(link.VLAN)
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+// MACs get the MAC Addresses, preferring those of the node's interfaces and
+// falling back to the node's MAC address set
+func (n *MaasNode) MACs() []string {
+	if ifcs := n.Interfaces(); len(ifcs) > 0 {
+		result := make([]string, 0, len(ifcs))
+		for _, ifc := range ifcs {
+			if ifc.MAC != "" {
+				result = append(result, ifc.MAC)
+			}
+		}
+		return result
+	}
+
+	macsObj, _ := n.GetMap()["macaddress_set"]
+	macs, _ := macsObj.GetArray()
+	if len(macs) == 0 {
+		return []string{}
+	}
+	result := make([]string, len(macs))
+	for i, mac := range macs {
+		obj, _ := mac.GetMap()
+		addr, _ := obj["mac_address"]
+		s, _ := addr.GetString()
+		result[i] = s
+	}
+
+	return result
+}
+
+// defaultZone the zone in which MAAS places nodes that have not been assigned
+// to a zone
+const defaultZone = "default"
+
+// Zone get the zone, nodes without a zone, i.e. freshly enlisted nodes, are
+// in the MAAS default zone
+func (n *MaasNode) Zone() string {
+	zone := n.GetMap()["zone"]
+	attrs, _ := zone.GetMap()
+	v, err := attrs["name"].GetString()
+	if err != nil || v == "" {
+		return defaultZone
+	}
+	return v
+}
+
+// CPUCount get the number of CPUs of the node, zero if not known
+func (n *MaasNode) CPUCount() int {
+	count, err := n.GetInteger("cpu_count")
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// Memory get the memory of the node in MiB, zero if not known
+func (n *MaasNode) Memory() int {
+	memory, err := n.GetInteger("memory")
+	if err != nil {
+		return 0
+	}
+	return memory
+}
+
+// Tags get the names of the tags applied to the node
+func (n *MaasNode) Tags() []string {
+	tagsObj, ok := n.GetMap()["tag_names"]
+	if !ok {
+		return []string{}
+	}
+	tags, err := tagsObj.GetArray()
+	if err != nil {
+		return []string{}
+	}
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if name, err := tag.GetString(); err == nil {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// nodeSnapshot the fields of a node that are of interest when diagnosing the
+// automation, in a stable order
+type nodeSnapshot struct {
+	SystemID   string      `json:"system_id"`
+	Hostname   string      `json:"hostname"`
+	Zone       string      `json:"zone"`
+	Status     string      `json:"status"`
+	PowerState string      `json:"power_state"`
+	PowerType  string      `json:"power_type"`
+	Tags       []string    `json:"tags"`
+	Interfaces []Interface `json:"interfaces"`
+}
+
+// MarshalJSON serialize the parsed view of the node, rather than the
+// underlying MAAS object, so that a node can be dumped for diagnostics
+func (n MaasNode) MarshalJSON() ([]byte, error) {
+	status, err := n.StatusName()
+	if err != nil {
+		status = ""
+	}
+	return json.Marshal(nodeSnapshot{
+		SystemID:   n.SystemID(),
+		Hostname:   n.Hostname(),
+		Zone:       n.Zone(),
+		Status:     status,
+		PowerState: n.PowerState(),
+		PowerType:  n.PowerType(),
+		Tags:       n.Tags(),
+		Interfaces: n.Interfaces(),
+	})
+}
+
+// Debug a JSON snapshot of the node for use in log messages
+func (n *MaasNode) Debug() string {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Sprintf("{\"system_id\":%q,\"error\":%q}", n.SystemID(), err.Error())
+	}
+	return string(data)
+}
+
+// GetInteger get attribute value as integer
+func (n *MaasNode) GetInteger(key string) (int, error) {
+	v, err := n.GetMap()[key].GetFloat64()
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+// normalizeStatusName convert a textual status, i.e. "Failed commissioning",
+// into the form used by the transition table, i.e. "FailedCommissioning"
+func normalizeStatusName(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, "")
+}
+
+// StatusName get the name of the node's lifecycle status. A "substatus" or
+// "status" code overridden with SetStatusNames takes precedence, so that the
+// operator's mapping applies whatever the server names the status. Otherwise
+// the "status_name" provided by the server is preferred, so that statuses
+// introduced by MAAS are named without a code change, falling back to
+// converting the codes. The textual status is normalized to the form used by
+// the transition table. As different MAAS versions and node types provide
+// different fields an error, listing the fields present, is only returned if
+// none of them are present.
+func (n *MaasNode) StatusName() (string, error) {
+	for _, key := range []string{"substatus", "status"} {
+		if code, err := n.GetInteger(key); err == nil {
+			if name, ok := statusOverrides[MaasNodeStatus(code)]; ok {
+				return name, nil
+			}
+		}
+	}
+	if name, err := n.GetString("status_name"); err == nil && name != "" {
+		return normalizeStatusName(name), nil
+	}
+	for _, key := range []string{"substatus", "status"} {
+		if code, err := n.GetInteger(key); err == nil {
+			return MaasNodeStatus(code).String(), nil
+		}
+	}
+
+	keys := make([]string, 0, len(n.GetMap()))
+	for key := range n.GetMap() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return "", fmt.Errorf("node '%s' has none of the status fields substatus, status or status_name, fields present are %v",
+		n.SystemID(), keys)
+}
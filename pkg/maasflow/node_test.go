@@ -0,0 +1,81 @@
+package maasflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZone(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs string
+		want  string
+	}{
+		{"explicit zone", `{"system_id":"a","zone":{"name":"rack-1"}}`, "rack-1"},
+		{"default zone", `{"system_id":"a","zone":{"name":"default"}}`, "default"},
+		{"no zone", `{"system_id":"a"}`, "default"},
+		{"zone without name", `{"system_id":"a","zone":{}}`, "default"},
+		{"empty zone name", `{"system_id":"a","zone":{"name":""}}`, "default"},
+		{"null zone", `{"system_id":"a","zone":null}`, "default"},
+	}
+	for _, test := range tests {
+		node := newTestNode(t, test.attrs)
+		if got := node.Zone(); got != test.want {
+			t.Errorf("%s: Zone = '%s', want '%s'", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStatusNameOverrides(t *testing.T) {
+	if err := SetStatusNames(map[int]string{16: "Rescue Mode", 6: "Deployed"}); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	defer SetStatusNames(nil)
+
+	tests := []struct {
+		name  string
+		attrs string
+		want  string
+	}{
+		{"status name", `{"system_id":"a","status_name":"Failed disk erasing","status":15}`, "FailedDiskErasing"},
+		{"overridden status", `{"system_id":"a","status_name":"Entering rescue mode","status":16}`, "RescueMode"},
+		{"overridden substatus", `{"system_id":"a","status_name":"Unknown","substatus":16,"status":4}`, "RescueMode"},
+		{"status code", `{"system_id":"a","status":4}`, "Ready"},
+		{"no status", `{"system_id":"a"}`, ""},
+	}
+	for _, test := range tests {
+		node := newTestNode(t, test.attrs)
+		got, err := node.StatusName()
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got '%s'", test.name, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: StatusName = '%s', %v, want '%s'", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestSubnetsAndVLANs(t *testing.T) {
+	node := newTestNode(t, `{"system_id":"a","interface_set":[
+		{"id":1,"name":"eth0","mac_address":"aa","vlan":{"vid":10},"links":[
+			{"id":1,"mode":"auto","subnet":{"cidr":"10.1.2.0/24","vlan":{"vid":10}}},
+			{"id":2,"mode":"static","subnet":{"cidr":"10.1.2.0/24","vlan":{"vid":10}}}]},
+		{"id":2,"name":"eth1","mac_address":"ab","vlan":{"vid":20},"links":[
+			{"id":3,"mode":"dhcp","subnet":{"cidr":"192.168.0.0/16","vlan":{"vid":30}}},
+			{"id":4,"mode":"link_up"}]}]}`)
+
+	if got, want := node.Subnets(), []string{"10.1.2.0/24", "192.168.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Subnets = %v, want %v", got, want)
+	}
+	if got, want := node.VLANs(), []int{10, 20, 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VLANs = %v, want %v", got, want)
+	}
+
+	bare := newTestNode(t, `{"system_id":"b"}`)
+	if len(bare.Subnets()) != 0 || len(bare.VLANs()) != 0 {
+		t.Errorf("expected a node without interfaces to have no subnets or VLANs")
+	}
+}
@@ -0,0 +1,223 @@
+package maasflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event a notification of an action the automation took on a node, or of an
+// action that failed
+type Event struct {
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"run_id,omitempty"`
+	SystemID string    `json:"system_id"`
+	Hostname string    `json:"hostname"`
+	State    string    `json:"state"`
+	Action   string    `json:"action"`
+	Error    string    `json:"error,omitempty"`
+
+	// Summary, Count and SystemIDs describe identical failures coalesced
+	// into a single event, see SetNotificationWindow, when the event is for
+	// no single node
+	Summary   string   `json:"summary,omitempty"`
+	Count     int      `json:"count,omitempty"`
+	SystemIDs []string `json:"system_ids,omitempty"`
+}
+
+// Notifier delivers events to an external system, giving up once the context
+// is done
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Webhook a notifier that posts each event, as JSON, to a URL
+type Webhook struct {
+	URL string
+}
+
+// Notify post the event to the webhook, any status other than 2xx is an error
+func (w Webhook) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyQueueSize the number of events buffered for delivery, once full
+// further events are dropped rather than holding up the pass
+const notifyQueueSize = 256
+
+// notifyBackoff the delay before the first retry of a failed delivery, which
+// is doubled for each further retry
+var notifyBackoff = time.Second
+
+// notifications the notifiers to which events are delivered in the background,
+// the events queued for delivery and whether delivery has stopped
+var notifications = struct {
+	sync.Mutex
+	notifiers []Notifier
+	timeout   time.Duration
+	retries   int
+	queue     chan Event
+	pending   sync.WaitGroup
+	stopped   bool
+}{queue: make(chan Event, notifyQueueSize)}
+
+// SetNotifiers set the notifiers to which the events are delivered, each
+// delivery is given the timeout and a failed delivery is retried up to the
+// given number of times, with a backoff, before the event is dropped. The
+// events are only delivered once StartNotifications is called.
+func SetNotifiers(notifiers []Notifier, timeout time.Duration, retries int) {
+	notifications.Lock()
+	defer notifications.Unlock()
+	notifications.notifiers = notifiers
+	notifications.timeout = timeout
+	notifications.retries = retries
+}
+
+// StartNotifications deliver the queued events in the background until the
+// context is cancelled, i.e. on shutdown, when any delivery in progress is
+// abandoned and the events still queued are dropped. The summaries of the
+// coalesced failures are queued as each window ends.
+func StartNotifications(ctx context.Context) {
+	var ticker Ticker
+	var ended <-chan time.Time
+	if window := notificationWindow(); window > 0 {
+		ticker = clock.NewTicker(window)
+		ended = ticker.Chan()
+	}
+	go func() {
+		for {
+			select {
+			case event := <-notifications.queue:
+				deliver(ctx, event)
+				notifications.pending.Done()
+			case now := <-ended:
+				for _, summary := range endedWindows(now) {
+					enqueue(summary)
+				}
+			case <-ctx.Done():
+				if ticker != nil {
+					ticker.Stop()
+				}
+				stopNotifications()
+				return
+			}
+		}
+	}()
+}
+
+// stopNotifications stop queuing events, dropping those still queued
+func stopNotifications() {
+	notifications.Lock()
+	defer notifications.Unlock()
+	notifications.stopped = true
+	dropped := len(notifications.queue)
+	for i := 0; i < dropped; i++ {
+		<-notifications.queue
+		notificationsDropped.inc("reason", "shutdown")
+		notifications.pending.Done()
+	}
+	if dropped > 0 {
+		log.Printf("[warn] dropped %d queued notifications on shutdown", dropped)
+	}
+}
+
+// FlushNotifications wait for the queued events to be delivered, or dropped
+func FlushNotifications() {
+	notifications.pending.Wait()
+}
+
+// notify queue the event for delivery, coalescing a failure identical to one
+// delivered within the window, see SetNotificationWindow
+func notify(event Event) {
+	if event.Error == "" {
+		enqueue(event)
+		return
+	}
+	now := clock.Now()
+	for _, summary := range endedWindows(now) {
+		enqueue(summary)
+	}
+	if admitFailure(event, now) {
+		enqueue(event)
+	} else {
+		notificationsCoalesced.inc("action", event.Action)
+	}
+}
+
+// enqueue queue the event for delivery, dropping it if the queue is full so a
+// slow notifier never holds up a pass
+func enqueue(event Event) {
+	notifications.Lock()
+	defer notifications.Unlock()
+	if len(notifications.notifiers) == 0 || notifications.stopped {
+		return
+	}
+
+	notifications.pending.Add(1)
+	select {
+	case notifications.queue <- event:
+	default:
+		notifications.pending.Done()
+		notificationsDropped.inc("reason", "queue_full")
+		log.Printf("[warn] notification queue full, dropping the notification of %s for node '%s'", event.Action, event.Hostname)
+	}
+}
+
+// deliver deliver the event to each notifier, retrying a failed delivery with
+// a backoff, and giving up on the event if the context is cancelled
+func deliver(ctx context.Context, event Event) {
+	notifications.Lock()
+	notifiers, timeout, retries := notifications.notifiers, notifications.timeout, notifications.retries
+	notifications.Unlock()
+
+	for _, notifier := range notifiers {
+		var err error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-clock.After(notifyBackoff << uint(attempt-1)):
+				case <-ctx.Done():
+					notificationsDropped.inc("reason", "shutdown")
+					return
+				}
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+			err = notifier.Notify(attemptCtx, event)
+			cancel()
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				notificationsDropped.inc("reason", "shutdown")
+				return
+			}
+		}
+		if err != nil {
+			notificationsDropped.inc("reason", "failed")
+			log.Printf("[warn] dropping the notification of %s for node '%s' after %d attempts : %s",
+				event.Action, event.Hostname, retries+1, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package maasflow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useNotifiers deliver events to the notifiers for the duration of the test
+func useNotifiers(t *testing.T, notifiers []Notifier, timeout time.Duration, retries int) context.CancelFunc {
+	previous := notifyBackoff
+	notifyBackoff = time.Millisecond
+	SetNotifiers(notifiers, timeout, retries)
+	ctx, cancel := context.WithCancel(context.Background())
+	StartNotifications(ctx)
+	t.Cleanup(func() {
+		cancel()
+		FlushNotifications()
+		SetNotifiers(nil, 0, 0)
+
+		// Delivery stops in the background, so wait for it before the
+		// next test starts delivering again
+		for {
+			notifications.Lock()
+			stopped := notifications.stopped
+			notifications.stopped = false
+			notifications.Unlock()
+			if stopped {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		notifyBackoff = previous
+	})
+	return cancel
+}
+
+func TestWebhookRetried(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	useNotifiers(t, []Notifier{Webhook{URL: server.URL}}, time.Second, 3)
+
+	notify(Event{SystemID: "w", Hostname: "w", State: "Ready", Action: "Aquire"})
+	FlushNotifications()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected the delivery to succeed on the third attempt, got %d attempts", attempts)
+	}
+	if received.SystemID != "w" || received.Action != "Aquire" {
+		t.Errorf("expected the event to be delivered, got %+v", received)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	useNotifiers(t, []Notifier{Webhook{URL: server.URL}}, 10*time.Millisecond, 1)
+	before := notificationsDropped.values[labelKey([]string{"reason", "failed"})]
+
+	done := make(chan struct{})
+	go func() {
+		notify(Event{SystemID: "h", Hostname: "h", Action: "Deploy"})
+		FlushNotifications()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a hung webhook to time out")
+	}
+	if got := notificationsDropped.values[labelKey([]string{"reason", "failed"})] - before; got != 1 {
+		t.Errorf("expected the notification to be dropped once its retries were used, got %v", got)
+	}
+}
+
+func TestNotificationsStopOnShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	cancel := useNotifiers(t, []Notifier{Webhook{URL: server.URL}}, time.Minute, 3)
+
+	for i := 0; i < 3; i++ {
+		notify(Event{SystemID: "s", Hostname: "s", Action: "Deploy"})
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		FlushNotifications()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the notifications to be abandoned on shutdown")
+	}
+	notify(Event{SystemID: "s", Hostname: "s", Action: "Deploy"})
+	if len(notifications.queue) != 0 {
+		t.Errorf("expected no notifications to be queued after shutdown")
+	}
+}
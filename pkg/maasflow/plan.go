@@ -0,0 +1,114 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// planSchemaVersion the version of the plan file, to be incremented whenever
+// its form changes
+const planSchemaVersion = 1
+
+// PlannedAction the action planned for a single node, along with the state
+// of the node when the plan was made. The plan also records whether the node
+// is to be reconciled with its mapping and tagged as managed, which may be
+// all that is planned for a node that is otherwise skipped.
+type PlannedAction struct {
+	Hostname  string `json:"hostname"`
+	State     string `json:"state"`
+	Action    string `json:"action,omitempty"`
+	Reconcile bool   `json:"reconcile,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+}
+
+// Plan the actions planned for the nodes by a preview pass, keyed by system
+// id, so that the plan can be reviewed and then executed exactly
+type Plan struct {
+	Version int                      `json:"version"`
+	Created time.Time                `json:"created"`
+	Nodes   map[string]PlannedAction `json:"nodes"`
+}
+
+// NewPlan the plan of the actions from the results of a preview pass. Nodes
+// that were skipped or could not be processed are only part of the plan if
+// they were reconciled with their mapping or tagged.
+func NewPlan(results []NodeResult) Plan {
+	plan := Plan{Version: planSchemaVersion, Created: clock.Now().UTC(), Nodes: make(map[string]PlannedAction)}
+	for _, result := range results {
+		entry := PlannedAction{
+			Hostname:  result.Hostname,
+			State:     result.FromState,
+			Reconcile: result.Reconciled,
+			Tag:       result.Tagged,
+		}
+		if !result.Skipped && result.Err == nil {
+			entry.Action = result.Action
+		}
+		if entry.Action == "" && !entry.Reconcile && entry.Tag == "" {
+			continue
+		}
+		plan.Nodes[result.SystemID] = entry
+	}
+	return plan
+}
+
+// WritePlan write the plan to the named file
+func WritePlan(name string, plan Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// LoadPlan read a plan from the named file
+func LoadPlan(name string) (Plan, error) {
+	var plan Plan
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return plan, fmt.Errorf("unable to parse plan file '%s' : %s", name, err)
+	}
+	if plan.Version != planSchemaVersion {
+		return plan, fmt.Errorf("plan file '%s' has unsupported schema version %d, expected %d",
+			name, plan.Version, planSchemaVersion)
+	}
+	return plan, nil
+}
+
+// planned whether the action determined for the node is the one planned for
+// it, logging a warning if the node has drifted since the plan was made.
+// Nodes that are not in the plan are not acted on.
+func (p *Plan) planned(node MaasNode, state string, action string, options ProcessingOptions) bool {
+	entry, ok := p.Nodes[node.SystemID()]
+	switch {
+	case !ok || entry.Action == "":
+		if options.verbose() {
+			options.logf("[info] skipping node '%s' as no action is planned for it", node.Hostname())
+		}
+		return false
+	case entry.State != state:
+		options.logf("[warn] skipping node '%s' as its state has drifted from '%s' to '%s' since the plan was made",
+			node.Hostname(), entry.State, state)
+		return false
+	case entry.Action != action:
+		options.logf("[warn] skipping node '%s' as its action has changed from %s to %s since the plan was made",
+			node.Hostname(), entry.Action, action)
+		return false
+	}
+	return true
+}
+
+// reconciles whether the plan reconciles the node with its mapping
+func (p *Plan) reconciles(node MaasNode) bool {
+	return p.Nodes[node.SystemID()].Reconcile
+}
+
+// tags whether the plan adds the tag to the node
+func (p *Plan) tags(node MaasNode, tag string) bool {
+	return p.Nodes[node.SystemID()].Tag == tag
+}
@@ -0,0 +1,46 @@
+package maasflow
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPlanRecordsReconcileAndTag(t *testing.T) {
+	client := newTestMAAS(t, http.NotFoundHandler())
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"n1","status_name":"Deployed","macaddress_set":[{"mac_address":"aa"}]}`),
+		newTestNode(t, `{"system_id":"b","hostname":"n2","status_name":"Deployed","tag_names":["managed"]}`),
+	}
+	options := ProcessingOptions{Preview: true, AlwaysRename: true, EnsureTag: "managed",
+		Mappings: map[string]interface{}{"aa": "mapped"}}
+
+	plan := NewPlan(ProcessAll(client, nodes, options))
+	if entry := plan.Nodes["a"]; !entry.Reconcile || entry.Tag != "managed" || entry.Action != "Done" {
+		t.Errorf("expected node 'a' to be reconciled, tagged and done, got %+v", entry)
+	}
+	if entry := plan.Nodes["b"]; entry.Reconcile || entry.Tag != "" {
+		t.Errorf("expected node 'b' to be neither reconciled nor tagged, got %+v", entry)
+	}
+}
+
+func TestExecutePlanOnlyReconcilesAndTagsPlannedNodes(t *testing.T) {
+	client := newTestMAAS(t, http.NotFoundHandler())
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a","hostname":"n1","status_name":"Deployed","macaddress_set":[{"mac_address":"aa"}]}`),
+		newTestNode(t, `{"system_id":"b","hostname":"n2","status_name":"Deployed","macaddress_set":[{"mac_address":"bb"}]}`),
+	}
+	plan := Plan{Version: planSchemaVersion, Nodes: map[string]PlannedAction{
+		"a": {Hostname: "n1", State: "Deployed", Action: "Done", Reconcile: true, Tag: "managed"},
+		"b": {Hostname: "n2", State: "Deployed", Action: "Done"},
+	}}
+	options := ProcessingOptions{Preview: true, AlwaysRename: true, EnsureTag: "managed", Plan: &plan,
+		Mappings: map[string]interface{}{"aa": "mapped-a", "bb": "mapped-b"}}
+
+	results := ProcessAll(client, nodes, options)
+	if !results[0].Reconciled || results[0].Tagged != "managed" {
+		t.Errorf("expected the planned node to be reconciled and tagged, got %+v", results[0])
+	}
+	if results[1].Reconciled || results[1].Tagged != "" {
+		t.Errorf("expected the node not planned to be reconciled or tagged to be left alone, got %+v", results[1])
+	}
+}
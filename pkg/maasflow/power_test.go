@@ -0,0 +1,100 @@
+package maasflow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPowerCycleCountsOnlyIssuedAttempts(t *testing.T) {
+	useFakeClock(t)
+	node := newTestNode(t, `{"system_id":"pc","hostname":"pc"}`)
+	current := tracker.observe("pc", "Deploying", clock.Now())
+	defer delete(tracker.powerCycles, "pc")
+
+	if _, err := PowerCycle(nil, node, ProcessingOptions{Preview: true}); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	if record := tracker.powerCycled("pc", current); record.Attempts != 0 {
+		t.Errorf("expected a preview power cycle not to count, got %d attempts", record.Attempts)
+	}
+
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	if _, err := PowerCycle(client, node, ProcessingOptions{}); err == nil {
+		t.Fatalf("expected the failure powering off to be returned")
+	}
+	if record := tracker.powerCycled("pc", current); record.Attempts != 0 {
+		t.Errorf("expected a power cycle that failed to power off not to count, got %d attempts", record.Attempts)
+	}
+}
+
+// slotProbeClock a fake clock recording the slots in flight while sleeping
+type slotProbeClock struct {
+	*fakeClock
+	held []int
+}
+
+func (c *slotProbeClock) Sleep(d time.Duration) {
+	inFlight.Lock()
+	c.held = append(c.held, inFlight.held)
+	inFlight.Unlock()
+	c.fakeClock.Sleep(d)
+}
+
+func TestPowerCycleReleasesSlotWhileOff(t *testing.T) {
+	probe := &slotProbeClock{fakeClock: useFakeClock(t)}
+	SetClock(probe)
+	node := newTestNode(t, `{"system_id":"pc-slot","hostname":"pc-slot"}`)
+	server := &fakeNodeServer{node: map[string]interface{}{"system_id": "pc-slot"}, posts: map[string][]string{}, params: map[string]string{}}
+	server.node["resource_uri"] = "/MAAS/api/1.0/nodes/pc-slot/"
+	client := newTestMAAS(t, server)
+
+	if _, err := PowerCycle(client, node, ProcessingOptions{}); err != nil {
+		t.Fatalf("unexpected error : %s", err)
+	}
+	if len(probe.held) != 1 || probe.held[0] != 0 {
+		t.Errorf("expected no slot to be held while the node is powered off, got %v", probe.held)
+	}
+	if len(server.posts["stop"]) != 1 || len(server.posts["start"]) != 1 {
+		t.Errorf("expected the node to be powered off and on, got %v", server.posts)
+	}
+}
+
+func TestStuckNodeIsPowerCycledAsMutatingAction(t *testing.T) {
+	useFakeClock(t)
+	node := newTestNode(t, `{"system_id":"stuck","hostname":"stuck","status_name":"Deploying"}`)
+	tracker.observe("stuck", "Deploying", clock.Now().Add(-time.Hour))
+	defer delete(tracker.nodes, "stuck")
+	defer delete(tracker.powerCycles, "stuck")
+
+	options := ProcessingOptions{Preview: true, PowerCycleStuck: true, ArmDestructive: true,
+		StuckTimeout: 45 * time.Minute, PowerCycleAttempts: 2}
+	if result := processNode(nil, node, options); result.Action != "PowerCycle" || result.Skipped {
+		t.Errorf("expected the stuck node to be power cycled, got %+v", result)
+	}
+
+	// As power cycling is new, disruptive, work it is not started when cordoned
+	SetCordoned(true)
+	result := processNode(nil, node, options)
+	SetCordoned(false)
+	if result.Action != "PowerCycle" || !result.Skipped {
+		t.Errorf("expected the power cycle to be skipped when cordoned, got %+v", result)
+	}
+
+	// No attempts disables power cycling
+	options.PowerCycleAttempts = 0
+	if result := processNode(nil, node, options); result.Action != "Wait" {
+		t.Errorf("expected the node to wait with no power cycle attempts, got %+v", result)
+	}
+}
+
+func TestValidatePowerCycleAttempts(t *testing.T) {
+	if err := (ProcessingOptions{PowerCycleAttempts: -1}).Validate(); err == nil {
+		t.Errorf("expected negative power cycle attempts to be rejected")
+	}
+	if err := (ProcessingOptions{PowerCycleAttempts: 0}).Validate(); err != nil {
+		t.Errorf("expected no power cycle attempts to be valid : %s", err)
+	}
+}
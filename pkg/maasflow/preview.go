@@ -0,0 +1,121 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// planEntry what a preview pass planned for a single node
+type planEntry struct {
+	Hostname string
+	State    string
+	Action   string
+	Matched  bool
+}
+
+// previousPlan the plan of the last preview pass, against which the next
+// preview pass is compared. A nil plan means there has been no preview pass.
+var previousPlan = struct {
+	sync.Mutex
+	nodes map[string]planEntry
+}{}
+
+// buildPlan capture the plan for each node from the results of a pass
+func buildPlan(nodes []MaasNode, results []NodeResult, matched []int) map[string]planEntry {
+	plan := make(map[string]planEntry, len(nodes))
+	for i, node := range nodes {
+		state, _ := node.StatusName()
+		plan[node.SystemID()] = planEntry{
+			Hostname: node.Hostname(),
+			State:    state,
+			Action:   results[i].Action,
+		}
+	}
+	for _, i := range matched {
+		entry := plan[nodes[i].SystemID()]
+		entry.Matched = true
+		plan[nodes[i].SystemID()] = entry
+	}
+	return plan
+}
+
+// describeAction the planned action in a form suited to the changelog
+func describeAction(action string) string {
+	if action == "" {
+		return "no action"
+	}
+	return "will " + strings.ToLower(action)
+}
+
+// diffPlans describe the changes between two plans, ordered by hostname
+func diffPlans(previous map[string]planEntry, current map[string]planEntry) []string {
+	type change struct {
+		hostname string
+		message  string
+	}
+	var changes []change
+	for id, cur := range current {
+		prev, ok := previous[id]
+		switch {
+		case !ok:
+			changes = append(changes, change{cur.Hostname, fmt.Sprintf("node '%s' newly present in state %s (%s)",
+				cur.Hostname, cur.State, describeAction(cur.Action))})
+		case cur.Matched && !prev.Matched:
+			changes = append(changes, change{cur.Hostname, fmt.Sprintf("node '%s' newly matched in state %s (%s)",
+				cur.Hostname, cur.State, describeAction(cur.Action))})
+		case !cur.Matched && prev.Matched:
+			changes = append(changes, change{cur.Hostname, fmt.Sprintf("node '%s' no longer matched", cur.Hostname)})
+		case !cur.Matched:
+			// Changes to nodes that are not acted on are not of interest
+		case cur.State != prev.State:
+			changes = append(changes, change{cur.Hostname, fmt.Sprintf("node '%s' newly %s (%s)",
+				cur.Hostname, cur.State, describeAction(cur.Action))})
+		case cur.Action != prev.Action:
+			changes = append(changes, change{cur.Hostname, fmt.Sprintf("node '%s' in state %s now %s",
+				cur.Hostname, cur.State, describeAction(cur.Action))})
+		}
+	}
+	for id, prev := range previous {
+		if _, ok := current[id]; !ok {
+			changes = append(changes, change{prev.Hostname, fmt.Sprintf("node '%s' no longer present", prev.Hostname)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].hostname != changes[j].hostname {
+			return changes[i].hostname < changes[j].hostname
+		}
+		return changes[i].message < changes[j].message
+	})
+	messages := make([]string, len(changes))
+	for i, c := range changes {
+		messages[i] = c.message
+	}
+	return messages
+}
+
+// logPlanChanges log the changes in the plan since the previous preview pass
+// and remember the plan for the next
+func logPlanChanges(plan map[string]planEntry, options ProcessingOptions) {
+	previousPlan.Lock()
+	defer previousPlan.Unlock()
+	if previousPlan.nodes != nil {
+		// Passes that only fetch the nodes not yet at the target state omit
+		// those that are, which should not be reported as having gone
+		for id, prev := range previousPlan.nodes {
+			if _, ok := plan[id]; !ok && prev.State == targetState {
+				plan[id] = prev
+			}
+		}
+		changes := diffPlans(previousPlan.nodes, plan)
+		if len(changes) == 0 {
+			options.logf("[info] no changes since the previous preview pass")
+		}
+		for _, change := range changes {
+			options.logf("CHANGE: %s", change)
+		}
+	}
+	previousPlan.nodes = plan
+}
@@ -0,0 +1,102 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// baseFields the fields of a node used however the automation is configured
+var baseFields = []string{
+	"system_id", "resource_uri", "hostname", "status", "substatus", "status_name",
+	"zone", "pool", "power_state", "power_type", "owner", "agent_name",
+	"testing_status_name", "memory", "tag_names",
+}
+
+// NodeFields the fields of a node used given the options, onto which the nodes
+// fetched can be projected, see FetchNodes. The interfaces are only used to
+// match the mappings and the subnets filter, and the comment when annotating
+// the nodes. Every field is used when tracing, nil.
+func (o ProcessingOptions) NodeFields() []string {
+	if len(o.TraceNodes) > 0 {
+		return nil
+	}
+	fields := append([]string{}, baseFields...)
+	if len(o.Mappings) > 0 || len(o.Filter.Subnets.Include) > 0 || len(o.Filter.Subnets.Exclude) > 0 {
+		fields = append(fields, "interface_set", "macaddress_set")
+	}
+	if o.AnnotateNodes {
+		fields = append(fields, "comment")
+	}
+	return fields
+}
+
+// rawClients the MAAS client from which each client object was created, used
+// to make requests whose responses are processed before they are parsed
+var rawClients = struct {
+	sync.Mutex
+	clients map[*maas.MAASObject]maas.Client
+}{clients: make(map[*maas.MAASObject]maas.Client)}
+
+// newMAAS create the client object for the client, recording the client
+func newMAAS(client maas.Client) *maas.MAASObject {
+	obj := maas.NewMAAS(client)
+	rawClients.Lock()
+	defer rawClients.Unlock()
+	rawClients.clients[obj] = client
+	return obj
+}
+
+// rawClient the MAAS client from which the client object was created, if it
+// was created by NewClient or NewAnonymousClient
+func rawClient(obj *maas.MAASObject) (maas.Client, bool) {
+	rawClients.Lock()
+	defer rawClients.Unlock()
+	client, ok := rawClients.clients[obj]
+	return client, ok
+}
+
+// callGetProjected invoke an idempotent API method that returns a list of
+// objects, as callGet, keeping only the given fields of each object. MAAS
+// offers no way to request only some fields, so the full response is still
+// transferred, but the fields that are not kept are never parsed.
+func callGetProjected(options ProcessingOptions, client maas.Client, obj maas.MAASObject, operation string, params url.Values, fields []string) (maas.JSONObject, error) {
+	throttle(options)
+	start := clock.Now()
+	body, err := client.Get(obj.URI(), operation, params)
+	pressure.record(start, err)
+	var result maas.JSONObject
+	if err == nil {
+		result, err = maas.Parse(client, project(body, fields))
+	}
+	traceRequest(options, "GET", obj, operation, params, result, err)
+	return result, checkAuth(err, options)
+}
+
+// project keep only the given fields of each object of a JSON list, a
+// response that is not a list of objects is left as it is so that it can be
+// reported as such
+func project(body []byte, fields []string) []byte {
+	var listing []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return body
+	}
+	keep := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		keep[field] = true
+	}
+	for _, entry := range listing {
+		for field := range entry {
+			if !keep[field] {
+				delete(entry, field)
+			}
+		}
+	}
+	projected, err := json.Marshal(listing)
+	if err != nil {
+		return body
+	}
+	return projected
+}
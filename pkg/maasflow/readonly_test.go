@@ -0,0 +1,40 @@
+package maasflow
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	var lock sync.Mutex
+	var writes []string
+	client := newTestMAAS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method != http.MethodGet {
+			writes = append(writes, r.Method+" "+r.URL.String())
+		}
+		http.Error(w, "read only", http.StatusForbidden)
+	}))
+	defer delete(tracker.nodes, "ready")
+	defer delete(tracker.nodes, "deployed")
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"ready","hostname":"n1","status_name":"Ready","macaddress_set":[{"mac_address":"aa"}]}`),
+		newTestNode(t, `{"system_id":"deployed","hostname":"n2","status_name":"Deployed","owner":"maas"}`),
+	}
+	options := ProcessingOptions{ReadOnly: true, AlwaysRename: true, EnsureTag: "managed", LockNodes: true,
+		Mappings: map[string]interface{}{"aa": "mapped"}}
+
+	results := ProcessAll(client, nodes, options)
+	WaitForActions()
+	if !results[0].Skipped || results[0].Action != "Aquire" {
+		t.Errorf("expected the aquire to be skipped, got %+v", results[0])
+	}
+	if results[1].Skipped || results[1].Action != "Done" {
+		t.Errorf("expected the deployed node to be reported as done, got %+v", results[1])
+	}
+	if len(writes) != 0 {
+		t.Errorf("expected no requests that modify MAAS, got %v", writes)
+	}
+}
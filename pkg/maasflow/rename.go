@@ -0,0 +1,61 @@
+package maasflow
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The rename modes, when a node whose hostname has drifted from its mapping
+// is renamed
+const (
+	// RenameNever never rename the nodes, the drift is only logged
+	RenameNever = "never"
+
+	// RenameOnce only rename the nodes whose hostnames look generated by
+	// MAAS, i.e. when they are enlisted, the drift of others is only logged
+	RenameOnce = "once"
+
+	// RenameAlways rename the nodes whenever their hostnames drift, i.e.
+	// correcting a manual rename in MAAS
+	RenameAlways = "always"
+)
+
+// generatedHostname the hostnames MAAS generates for the nodes it enlists,
+// either a maas- prefix or an adjective and an animal, i.e. calm-otter
+var generatedHostname = regexp.MustCompile(`^(maas-.*|[a-z]+-[a-z]+)$`)
+
+// validRenameMode verify the rename mode is one of those supported, or empty
+// to use AlwaysRename
+func validRenameMode(mode string) error {
+	switch mode {
+	case "", RenameNever, RenameOnce, RenameAlways:
+		return nil
+	}
+	return fmt.Errorf("unknown rename mode '%s', expected '%s', '%s' or '%s'",
+		mode, RenameNever, RenameOnce, RenameAlways)
+}
+
+// renameMode the rename mode, when none is given always renaming if
+// AlwaysRename and otherwise renaming once, which is how the nodes were
+// renamed before the rename modes
+func (o ProcessingOptions) renameMode() string {
+	switch {
+	case o.RenameMode != "":
+		return o.RenameMode
+	case o.AlwaysRename:
+		return RenameAlways
+	}
+	return RenameOnce
+}
+
+// renames whether a node whose hostname has drifted from its mapping is
+// renamed given the rename mode
+func (o ProcessingOptions) renames(node MaasNode) bool {
+	switch o.renameMode() {
+	case RenameAlways:
+		return true
+	case RenameOnce:
+		return generatedHostname.MatchString(shortHostname(node))
+	}
+	return false
+}
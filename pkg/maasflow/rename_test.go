@@ -0,0 +1,57 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRenameMode(t *testing.T) {
+	cases := []struct {
+		options  ProcessingOptions
+		hostname string
+		renames  bool
+	}{
+		{ProcessingOptions{RenameMode: RenameAlways}, "cord-r1-s1", true},
+		{ProcessingOptions{RenameMode: RenameOnce}, "maas-enlisting-node", true},
+		{ProcessingOptions{RenameMode: RenameOnce}, "calm-otter", true},
+		{ProcessingOptions{RenameMode: RenameOnce}, "cord-r1-s1", false},
+		{ProcessingOptions{RenameMode: RenameNever}, "calm-otter", false},
+		{ProcessingOptions{AlwaysRename: true}, "cord-r1-s1", true},
+		{ProcessingOptions{AlwaysRename: false}, "cord-r1-s1", false},
+		{ProcessingOptions{AlwaysRename: true, RenameMode: RenameNever}, "calm-otter", false},
+	}
+	for _, c := range cases {
+		node := newTestNode(t, `{"system_id":"r","hostname":"`+c.hostname+`.maas"}`)
+		if got := c.options.renames(node); got != c.renames {
+			t.Errorf("%+v, %s: expected renames %t, got %t", c.options, c.hostname, c.renames, got)
+		}
+	}
+
+	if err := (ProcessingOptions{RenameMode: "sometimes"}).Validate(); err == nil {
+		t.Errorf("expected an unknown rename mode to be rejected")
+	}
+}
+
+func TestProcessAllRenameOnce(t *testing.T) {
+	mappings := map[string]interface{}{"aa:bb:cc:dd:ee:ff": map[string]interface{}{"hostname": "cord-r1-s1"}}
+	for _, c := range []struct {
+		hostname string
+		updates  int
+	}{
+		{"calm-otter", 1},
+		{"manual", 0},
+		{"cord-r1-s1", 0},
+	} {
+		attrs := `{"system_id":"r","hostname":"` + c.hostname + `","status_name":"Deployed","zone":{"name":"default"},` +
+			`"macaddress_set":[{"mac_address":"aa:bb:cc:dd:ee:ff"}],"resource_uri":"/MAAS/api/1.0/nodes/r/"}`
+		server := &fakeNodeServer{node: map[string]interface{}{}, posts: map[string][]string{}, params: map[string]string{}}
+		json.Unmarshal([]byte(attrs), &server.node)
+		client := newTestMAAS(t, server)
+
+		options := ProcessingOptions{RenameMode: RenameOnce, Mappings: mappings}
+		ProcessAll(client, []MaasNode{newTestNode(t, attrs)}, options)
+		if server.updates != c.updates {
+			t.Errorf("%s: expected %d updates, got %d", c.hostname, c.updates, server.updates)
+		}
+	}
+}
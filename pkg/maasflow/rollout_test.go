@@ -0,0 +1,21 @@
+package maasflow
+
+import (
+	"testing"
+)
+
+func TestSerialRolloutUnreadableNode(t *testing.T) {
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"a1","hostname":"a1","zone":{"name":"a"}}`),
+		newTestNode(t, `{"system_id":"b1","hostname":"b1","zone":{"name":"b"},"status_name":"Deployed"}`),
+	}
+	options := ProcessingOptions{Preview: true, Rollout: RolloutSerialByZone}
+
+	results := ProcessAll(nil, nodes, options)
+	if results[0].Err == nil {
+		t.Errorf("expected an error for the node whose state cannot be read")
+	}
+	if results[1].Skipped || results[1].Action != "Done" {
+		t.Errorf("expected zone 'b' to be processed, got %+v", results[1])
+	}
+}
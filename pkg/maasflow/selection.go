@@ -0,0 +1,189 @@
+package maasflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// selectionStrategy order the candidate nodes to aquire, given all the
+// matched nodes, by returning a comparison of two candidates that is negative
+// when a is preferred, positive when b is preferred and zero when neither is
+type selectionStrategy func(matched []MaasNode) func(a MaasNode, b MaasNode) int
+
+// committedStates the states of the nodes that count towards the target
+// number of deployed nodes, those deployed or on their way to being deployed
+var committedStates = map[string]bool{"Allocated": true, "Deploying": true, "Deployed": true}
+
+// selectionStrategies the strategies by which the nodes to aquire are chosen
+var selectionStrategies = map[string]selectionStrategy{
+	// hostname prefer nodes in the order of their hostnames
+	"hostname": func(matched []MaasNode) func(a MaasNode, b MaasNode) int {
+		return func(a MaasNode, b MaasNode) int {
+			return strings.Compare(a.Hostname(), b.Hostname())
+		}
+	},
+
+	// least-loaded-zone prefer nodes in the zones with the fewest nodes
+	// deployed, or on their way to being deployed
+	"least-loaded-zone": func(matched []MaasNode) func(a MaasNode, b MaasNode) int {
+		load := make(map[string]int)
+		for _, node := range matched {
+			if state, err := node.StatusName(); err == nil && committedStates[state] {
+				load[node.Zone()]++
+			}
+		}
+		return func(a MaasNode, b MaasNode) int {
+			return load[a.Zone()] - load[b.Zone()]
+		}
+	},
+
+	// most-memory prefer the nodes with the most memory
+	"most-memory": func(matched []MaasNode) func(a MaasNode, b MaasNode) int {
+		return func(a MaasNode, b MaasNode) int {
+			return b.Memory() - a.Memory()
+		}
+	},
+}
+
+// validSelectionStrategy verify each of the strategies is known
+func validSelectionStrategy(names []string) error {
+	for _, name := range names {
+		if _, ok := selectionStrategies[name]; !ok {
+			known := make([]string, 0, len(selectionStrategies))
+			for name := range selectionStrategies {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown selection strategy '%s', expected one of %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// orderCandidates order the candidate nodes by the strategies, each strategy
+// breaking the ties of those before it, with any remaining ties broken by
+// system id so that the order is stable from pass to pass
+func orderCandidates(candidates []MaasNode, matched []MaasNode, names []string) {
+	compares := make([]func(a MaasNode, b MaasNode) int, 0, len(names))
+	for _, name := range names {
+		compares = append(compares, selectionStrategies[name](matched))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		for _, compare := range compares {
+			if c := compare(candidates[i], candidates[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return candidates[i].SystemID() < candidates[j].SystemID()
+	})
+}
+
+// capAquires determine the matched nodes that are not to be aquired this pass
+// as enough nodes are already deployed, or on their way to being deployed, to
+// reach the target. The nodes ready to be aquired are ordered by the selection
+// strategy and only as many as are needed to reach the target are aquired.
+func capAquires(nodes []MaasNode, matched []int, options ProcessingOptions) map[int]bool {
+	held := make(map[int]bool)
+	if options.TargetDeployed <= 0 {
+		return held
+	}
+
+	all := make([]MaasNode, len(matched))
+	index := make(map[string]int, len(matched))
+	var candidates []MaasNode
+	committed := 0
+	for n, i := range matched {
+		node := nodes[i]
+		all[n] = node
+		index[node.SystemID()] = i
+		state, err := node.StatusName()
+		switch {
+		case err != nil:
+		case committedStates[state] || tracker.running(node.SystemID()):
+			committed++
+		case state == "Ready":
+			candidates = append(candidates, node)
+		}
+	}
+
+	orderCandidates(candidates, all, options.SelectionStrategy)
+	needed := options.TargetDeployed - committed
+	if needed < 0 {
+		needed = 0
+	}
+	for n, node := range candidates {
+		if n >= needed {
+			held[index[node.SystemID()]] = true
+		}
+	}
+	if len(held) > 0 && options.verbose() {
+		options.logf("[info] %d nodes deployed or deploying of the target of %d, aquiring %d of the %d ready nodes",
+			committed, options.TargetDeployed, len(candidates)-len(held), len(candidates))
+	}
+	return held
+}
+
+// scaleDown determine the matched nodes to release this pass as more nodes
+// are deployed, or on their way to being deployed, than the target. Only
+// deployed nodes with no action in flight are released, those carrying the
+// reclaimable tag when one is given, the most recently deployed first, and no
+// more than the maximum number of releases per pass. Releasing is new work, so
+// no nodes are released while cordoned.
+func scaleDown(nodes []MaasNode, matched []int, options ProcessingOptions) map[int]bool {
+	reclaim := make(map[int]bool)
+	if !options.ScaleDown || options.TargetDeployed <= 0 || Cordoned() {
+		return reclaim
+	}
+
+	type candidate struct {
+		index int
+		since time.Time
+	}
+	var candidates []candidate
+	committed := 0
+	for _, i := range matched {
+		node := nodes[i]
+		state, err := node.StatusName()
+		if err != nil || !(committedStates[state] || tracker.running(node.SystemID())) {
+			continue
+		}
+		committed++
+
+		// The time a node has been deployed is only known once it has been
+		// observed deployed, so nodes not yet observed are left
+		current, ok := tracker.get(node.SystemID())
+		if state != "Deployed" || tracker.running(node.SystemID()) || !ok || current.State != state {
+			continue
+		}
+		if options.ReclaimableTag != "" && !hasTag(node, options.ReclaimableTag) {
+			continue
+		}
+		candidates = append(candidates, candidate{i, current.Since})
+	}
+
+	excess := committed - options.TargetDeployed
+	if excess <= 0 {
+		return reclaim
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		if !candidates[a].since.Equal(candidates[b].since) {
+			return candidates[a].since.After(candidates[b].since)
+		}
+		return nodes[candidates[a].index].SystemID() < nodes[candidates[b].index].SystemID()
+	})
+	release := excess
+	if release > options.MaxReleasesPerPass {
+		release = options.MaxReleasesPerPass
+	}
+	if release > len(candidates) {
+		release = len(candidates)
+	}
+	for _, c := range candidates[:release] {
+		reclaim[c.index] = true
+	}
+	options.logf("[info] %d nodes deployed or deploying of the target of %d, releasing %d of the %d reclaimable nodes",
+		committed, options.TargetDeployed, release, len(candidates))
+	return reclaim
+}
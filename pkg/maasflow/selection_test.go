@@ -0,0 +1,65 @@
+package maasflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaleDown(t *testing.T) {
+	useFakeClock(t)
+	var nodes []MaasNode
+	for i, id := range []string{"s1", "s2", "s3", "s4"} {
+		node := newTestNode(t, `{"system_id":"`+id+`","hostname":"`+id+`","status_name":"Deployed","tag_names":["reclaimable"]}`)
+		nodes = append(nodes, node)
+		tracker.observe(id, "Deployed", clock.Now().Add(time.Duration(i)*time.Hour))
+		defer delete(tracker.nodes, id)
+	}
+	nodes = append(nodes, newTestNode(t, `{"system_id":"s5","hostname":"s5","status_name":"Deployed"}`))
+	defer delete(tracker.nodes, "s5")
+	options := ProcessingOptions{Preview: true, ArmDestructive: true, ScaleDown: true, TargetDeployed: 2, MaxReleasesPerPass: 2}
+
+	// The node not yet observed deployed is not released, the most recently
+	// deployed are, up to the cap
+	results := ProcessAll(nil, nodes, options)
+	for i, action := range []string{"Done", "Done", "Release", "Release", "Done"} {
+		if results[i].Action != action {
+			t.Errorf("%s: expected %s, got %+v", results[i].Hostname, action, results[i])
+		}
+	}
+
+	options.MaxReleasesPerPass = 1
+	options.ReclaimableTag = "reclaimable"
+	results = ProcessAll(nil, nodes, options)
+	for i, action := range []string{"Done", "Done", "Done", "Release", "Done"} {
+		if results[i].Action != action {
+			t.Errorf("capped %s: expected %s, got %+v", results[i].Hostname, action, results[i])
+		}
+	}
+
+	options.TargetDeployed = 5
+	results = ProcessAll(nil, nodes, options)
+	for _, result := range results {
+		if result.Action != "Done" {
+			t.Errorf("at target %s: expected Done, got %+v", result.Hostname, result)
+		}
+	}
+}
+
+func TestValidateScaleDown(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ProcessingOptions
+		ok      bool
+	}{
+		{"armed", ProcessingOptions{ScaleDown: true, ArmDestructive: true, TargetDeployed: 1, MaxReleasesPerPass: 1}, true},
+		{"not armed", ProcessingOptions{ScaleDown: true, TargetDeployed: 1, MaxReleasesPerPass: 1}, false},
+		{"no target", ProcessingOptions{ScaleDown: true, ArmDestructive: true, MaxReleasesPerPass: 1}, false},
+		{"no releases", ProcessingOptions{ScaleDown: true, ArmDestructive: true, TargetDeployed: 1}, false},
+		{"tag without scale down", ProcessingOptions{ReclaimableTag: "reclaimable"}, false},
+	}
+	for _, test := range tests {
+		if err := test.options.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %t, got %v", test.name, test.ok, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package maasflow
+
+import (
+	"sync"
+)
+
+// semaphore a counting semaphore used to bound the number of concurrent
+// holders. The bound can be lowered while the semaphore is held, i.e. under
+// backpressure, in which case the existing holders complete and new holders
+// wait until the number held is below the bound. A bound of zero places no
+// bound.
+type semaphore struct {
+	sync.Mutex
+	available *sync.Cond
+	bound     int
+	held      int
+}
+
+func newSemaphore(bound int) *semaphore {
+	s := &semaphore{bound: bound}
+	s.available = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// acquire block until a slot is available in the semaphore
+func (s *semaphore) acquire() {
+	s.Lock()
+	defer s.Unlock()
+	for s.bound > 0 && s.held >= s.bound {
+		s.available.Wait()
+	}
+	s.held++
+}
+
+// release return a slot to the semaphore
+func (s *semaphore) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.held--
+	s.available.Broadcast()
+}
+
+// setBound change the bound of the semaphore, waking the waiters if it is
+// raised
+func (s *semaphore) setBound(bound int) {
+	s.Lock()
+	defer s.Unlock()
+	s.bound = bound
+	s.available.Broadcast()
+}
+
+// inFlight bounds the total number of mutating actions in flight against the
+// MAAS server across all zones and processing passes
+var inFlight = newSemaphore(0)
+
+// globalConcurrency the configured bound on the mutating actions in flight,
+// which backpressure may lower, 0 for no bound
+var globalConcurrency int
+
+// SetGlobalConcurrency set the maximum number of mutating actions that may be
+// in flight against the MAAS server at any one time, a limit of zero or less
+// removes the bound. This should be called before any nodes are processed.
+func SetGlobalConcurrency(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	globalConcurrency = limit
+	inFlight.setBound(limit)
+}
@@ -0,0 +1,1981 @@
+package maasflow
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// ActionResult what an action did to a node
+type ActionResult struct {
+	// Mutated whether the action modified the node, or in preview mode would
+	// have, as opposed to only reporting on it
+	Mutated bool
+
+	// NextState the state to which the node is expected to move as a result
+	// of the action, empty if not known or the node is not expected to move
+	NextState string
+}
+
+// Action how to get from there to here
+type Action func(*maas.MAASObject, MaasNode, ProcessingOptions) (ActionResult, error)
+
+// Transition the map from where i want to be from where i might be. When
+// set, Validate is checked before the action is taken and an error skips it.
+type Transition struct {
+	Target   string
+	Current  string
+	Using    Action
+	Validate Validator
+}
+
+// ProcessingOptions used to determine on what hosts to operate
+type ProcessingOptions struct {
+	Filter   Filter
+	Mappings map[string]interface{}
+	Verbose  bool
+	Preview  bool
+
+	// AlwaysRename Deprecated: use RenameMode, when no rename mode is given
+	// true is the same as RenameAlways and false as RenameOnce
+	AlwaysRename bool
+
+	// RenameMode when a node whose hostname has drifted from its mapping is
+	// renamed, one of the rename modes, see RenameAlways
+	RenameMode string
+
+	// ReadOnly never modify the nodes, whatever the other options, so that
+	// an anonymous client or a read only API key can be used to observe them.
+	// The actions that would modify a node are skipped and the rest are
+	// taken as in preview mode.
+	ReadOnly bool
+
+	// TraceNodes the system ids or hostnames of the nodes for which to log
+	// in full detail, i.e. the requests made to MAAS and their responses,
+	// regardless of Verbose
+	TraceNodes []string
+
+	// Plan when not nil, the only actions to take, those planned by a
+	// previous preview pass, see NewPlan. Nodes whose state or action has
+	// drifted since the plan was made are skipped.
+	Plan *Plan
+
+	// trace whether the node being processed is one of the TraceNodes, set
+	// for each node as it is processed
+	trace bool
+
+	// reclaim whether the node being processed is to be released as more
+	// nodes are deployed than the target, see ScaleDown, set for each node as
+	// it is processed
+	reclaim bool
+
+	// AnnotateNodes record on each node a comment describing the action the
+	// automation took and when
+	AnnotateNodes bool
+
+	// ResourcePool the resource pool into which nodes are aquired, if empty
+	// nodes are aquired into the default pool
+	ResourcePool string
+
+	// ZoneResourcePools per zone overrides of the resource pool into which
+	// nodes are aquired
+	ZoneResourcePools map[string]string
+
+	// Guards the names of the validators, see Validators, checked before the
+	// action of the transition from a state is taken, by state
+	Guards map[string][]string
+
+	// DeployKernelOpts the kernel command line options with which nodes are
+	// deployed, i.e. hugepages=64, if empty those configured in MAAS are used
+	DeployKernelOpts string
+
+	// ZoneDeployKernelOpts per zone overrides of the kernel command line
+	// options with which nodes are deployed
+	ZoneDeployKernelOpts map[string]string
+
+	// AcquireParams additional parameters passed verbatim when aquiring a
+	// node, i.e. MAAS constraints the automation has no option for
+	AcquireParams map[string]string
+
+	// ReleaseErase how the disks of a node are erased when it is released,
+	// one of the Erase modes, if empty the MAAS configuration is used
+	ReleaseErase string
+
+	// ZoneReleaseErase per zone overrides of how the disks of a node are
+	// erased when it is released
+	ZoneReleaseErase map[string]string
+
+	// FastRelease release nodes without erasing their disks, regardless of
+	// the erase modes and the MAAS configuration, so that any data left on
+	// the disks survives into the next deployment. This is destructive so
+	// requires ArmDestructive.
+	FastRelease bool
+
+	// StrictTransitions treat a node in a state with no transition to the
+	// target state as an error rather than skipping it
+	StrictTransitions bool
+
+	// ActionCooldown how long to wait after an action for a node fails before
+	// the action is attempted again, zero to attempt it every pass
+	ActionCooldown time.Duration
+
+	// Rollout how the automation proceeds across zones, one of the Rollout
+	// modes, if empty the nodes in all zones are processed at once
+	Rollout string
+
+	// ZoneOrder the order in which zones are processed in a serial rollout,
+	// zones not listed are processed after those listed in alphabetical order
+	ZoneOrder []string
+
+	// PartialFetch whether the nodes of a pass are only those still being
+	// driven, see PendingNodeIDs, rather than the full list of nodes. The
+	// metrics and status that describe the whole fleet are only updated by
+	// passes that fetch the full list.
+	PartialFetch bool
+
+	// RunID identifies a single processing pass, it is generated at the start
+	// of each pass and included in every message logged during the pass
+	RunID string
+
+	// StateTimeouts how long a node may remain in a given (waiting) state
+	// before the automation attempts to remediate it
+	StateTimeouts map[string]time.Duration
+
+	// NodeIDs when not empty, the system ids of the only nodes on which the
+	// automation operates, applied before the filter
+	NodeIDs []string
+
+	// SkipExternallyAllocated leave allocated nodes that are not owned by
+	// Owner, i.e. those allocated by a human, to their owner rather than
+	// deploying them
+	SkipExternallyAllocated bool
+
+	// SkipTestFailed leave the nodes that failed their hardware tests for
+	// manual attention rather than aquiring or deploying them
+	SkipTestFailed bool
+
+	// Owner the name of the MAAS user as which the automation aquires nodes
+	Owner string
+
+	// AgentName when not empty, the agent name given when the automation
+	// aquires a node, which distinguishes the nodes aquired by the automation
+	// from those aquired by a human or other tools using the same MAAS user
+	AgentName string
+
+	// LockNodes lock a node before taking a mutating action on it so that,
+	// when several instances of the automation are running, only one acts on
+	// the node at a time
+	LockNodes bool
+
+	// InstanceID identifies this instance of the automation when locking nodes
+	InstanceID string
+
+	// CommissionOptions the options included when commissioning a node, i.e.
+	// {"enable_ssh": "true"}, see commissionOptionKinds for those supported
+	CommissionOptions map[string]string
+
+	// ZoneTestingScripts per zone overrides of the testing scripts, a comma
+	// separated list of script names, run when commissioning a node, i.e. to
+	// run stress tests during burn in
+	ZoneTestingScripts map[string]string
+
+	// ArmDestructive allow the actions that are disruptive to a node, i.e.
+	// power cycling it, that are otherwise refused
+	ArmDestructive bool
+
+	// PowerCycleStuck power cycle the nodes that have been deploying for
+	// longer than StuckTimeout, this is destructive so requires ArmDestructive
+	PowerCycleStuck bool
+
+	// DeployPoll when greater than zero, how long to poll the state of a node
+	// after it is started, every DeployPollInterval, so that its progress is
+	// logged and an early failure is seen without waiting for the next pass.
+	// With LockNodes no longer than the lease of a lock.
+	DeployPoll time.Duration
+
+	// DeployPollInterval the time between the polls of a deploy
+	DeployPollInterval time.Duration
+
+	// StuckTimeout how long a node may be deploying before it is considered
+	// stuck and is power cycled, also the time between power cycles
+	StuckTimeout time.Duration
+
+	// PowerCycleAttempts the maximum number of times a stuck node is power
+	// cycled before it is left for manual attention, 0 disables power cycling
+	PowerCycleAttempts int
+
+	// ReleaseFailedErase release the nodes that failed to erase their disks
+	// again, without erasing them, so that they can be deployed again. When
+	// false such nodes are left for manual attention. Requires ArmDestructive.
+	ReleaseFailedErase bool
+
+	// EnsureTag when not empty, the MAAS tag added to every node that matches
+	// the filter, so the nodes the automation manages can be found from MAAS
+	EnsureTag string
+
+	// ManagedTag when not empty, the MAAS tag a node must carry for the
+	// automation to operate on it, applied with the filter
+	ManagedTag string
+
+	// NameTemplate when not empty, the template from which the names of the
+	// nodes the automation aquires are generated, i.e. gpu-pool-%03d, each
+	// node being given the name with the lowest unused index. Nodes already
+	// named from the template, or mapped to a hostname, keep their names.
+	NameTemplate string
+
+	// DeferAcquireName do not name a node from the NameTemplate when it is
+	// aquired, only when it is deployed, so that the node is aquired by its
+	// system id alone and can be inventoried before it is named
+	DeferAcquireName bool
+
+	// StabilityPasses the number of consecutive passes in which a node must
+	// be observed in the same state before a mutating action is taken on it,
+	// values of one or less act on the first observation
+	StabilityPasses int
+
+	// TargetDeployed when greater than zero, the number of matched nodes to
+	// have deployed, only enough ready nodes are aquired to reach it
+	TargetDeployed int
+
+	// SelectionStrategy the strategies, in order of precedence, by which the
+	// ready nodes to aquire are chosen when TargetDeployed is given, see
+	// selectionStrategies
+	SelectionStrategy []string
+
+	// ScaleDown release the deployed nodes in excess of TargetDeployed, the
+	// most recently deployed first, this is destructive so requires
+	// ArmDestructive
+	ScaleDown bool
+
+	// ReclaimableTag when not empty, the MAAS tag a deployed node must carry
+	// to be released by ScaleDown
+	ReclaimableTag string
+
+	// MaxReleasesPerPass the maximum number of nodes released by ScaleDown
+	// in a pass
+	MaxReleasesPerPass int
+
+	// OscillationPasses when greater than zero, a node whose states repeat
+	// the same cycle twice within this many passes, i.e. Ready, Allocated,
+	// Ready, Allocated, is reported as oscillating
+	OscillationPasses int
+
+	// NoProgressPasses when greater than zero, the number of passes in a row
+	// that take actions without the matched nodes advancing towards the
+	// target state after which the fleet is reported as making no progress
+	NoProgressPasses int
+}
+
+// targetState the state to which the automation drives nodes
+const targetState = "Deployed"
+
+// Validate verify the options are consistent with each other and with the
+// transition table, without contacting the MAAS server
+func (o ProcessingOptions) Validate() error {
+	if err := o.Filter.Validate(); err != nil {
+		return err
+	}
+
+	switch o.Rollout {
+	case "", RolloutParallel, RolloutSerialByZone:
+	default:
+		return fmt.Errorf("unknown rollout mode '%s', expected '%s' or '%s'", o.Rollout, RolloutParallel, RolloutSerialByZone)
+	}
+
+	if err := validSelectionStrategy(o.SelectionStrategy); err != nil {
+		return err
+	}
+
+	if err := validRenameMode(o.RenameMode); err != nil {
+		return err
+	}
+
+	if err := validEraseMode(o.ReleaseErase); err != nil {
+		return err
+	}
+	for zone, mode := range o.ZoneReleaseErase {
+		if mode == "" {
+			return fmt.Errorf("release erase mode for zone '%s' must not be empty", zone)
+		}
+		if err := validEraseMode(mode); err != nil {
+			return fmt.Errorf("zone '%s' : %s", zone, err)
+		}
+	}
+
+	if o.FastRelease {
+		if !o.ArmDestructive {
+			return fmt.Errorf("releasing nodes without erasing their disks is destructive and must be armed with arm-destructive")
+		}
+		if o.ReleaseErase != "" && o.ReleaseErase != EraseNone {
+			return fmt.Errorf("fast release never erases the disks, so conflicts with the release erase mode '%s'", o.ReleaseErase)
+		}
+		for zone, mode := range o.ZoneReleaseErase {
+			if mode != EraseNone {
+				return fmt.Errorf("fast release never erases the disks, so conflicts with the release erase mode '%s' for zone '%s'", mode, zone)
+			}
+		}
+	}
+
+	if o.ReleaseFailedErase && !o.ArmDestructive {
+		return fmt.Errorf("releasing nodes that failed to erase their disks without erasing them is destructive and must be armed with arm-destructive")
+	}
+
+	if o.NameTemplate != "" {
+		if err := validNameTemplate(o.NameTemplate); err != nil {
+			return err
+		}
+	}
+
+	if o.ScaleDown {
+		if !o.ArmDestructive {
+			return fmt.Errorf("scaling down releases deployed nodes, which is destructive and must be armed with arm-destructive")
+		}
+		if o.TargetDeployed <= 0 {
+			return fmt.Errorf("scaling down requires a target number of deployed nodes greater than zero")
+		}
+		if o.MaxReleasesPerPass <= 0 {
+			return fmt.Errorf("the maximum number of releases per pass must be greater than zero to scale down")
+		}
+	} else if o.ReclaimableTag != "" {
+		return fmt.Errorf("a reclaimable tag is only used when scaling down")
+	}
+
+	if o.DeployPoll < 0 {
+		return fmt.Errorf("the deploy poll budget must not be negative, 0 disables polling")
+	}
+	if o.DeployPoll > 0 && (o.DeployPollInterval <= 0 || o.DeployPollInterval > o.DeployPoll) {
+		return fmt.Errorf("the deploy poll interval must be greater than zero and no more than the deploy poll budget")
+	}
+	if o.LockNodes && o.DeployPoll > lockLease {
+		return fmt.Errorf("the deploy poll budget must be no more than the %s lease of a node lock when locking nodes", lockLease)
+	}
+
+	if o.OscillationPasses < 0 || o.NoProgressPasses < 0 {
+		return fmt.Errorf("the oscillation and no progress passes must not be negative, 0 disables the detection")
+	}
+
+	if o.PowerCycleAttempts < 0 {
+		return fmt.Errorf("the number of power cycle attempts must not be negative, 0 disables power cycling")
+	}
+	if o.PowerCycleStuck {
+		if !o.ArmDestructive {
+			return fmt.Errorf("power cycling stuck nodes is destructive and must be armed with arm-destructive")
+		}
+		if o.StuckTimeout <= 0 {
+			return fmt.Errorf("a stuck timeout greater than zero is required to power cycle stuck nodes")
+		}
+	}
+
+	for key := range o.AcquireParams {
+		switch key {
+		case "":
+			return fmt.Errorf("acquire parameter names must not be empty")
+		case "system_id":
+			return fmt.Errorf("the acquire parameter 'system_id' is set by the automation and cannot be specified")
+		}
+	}
+
+	for zone, opts := range o.ZoneDeployKernelOpts {
+		if strings.TrimSpace(opts) == "" {
+			return fmt.Errorf("deploy kernel options for zone '%s' must not be empty", zone)
+		}
+	}
+
+	for zone, scripts := range o.ZoneTestingScripts {
+		if strings.TrimSpace(scripts) == "" {
+			return fmt.Errorf("testing scripts for zone '%s' must not be empty, specify 'none' to run no tests", zone)
+		}
+	}
+	for key, value := range o.CommissionOptions {
+		boolean, ok := commissionOptionKinds[key]
+		if !ok {
+			return fmt.Errorf("unknown commission option '%s'", key)
+		}
+		if _, err := strconv.ParseBool(value); boolean && err != nil {
+			return fmt.Errorf("commission option '%s' must be true or false, not '%s'", key, value)
+		}
+	}
+
+	targets, ok := Transitions[targetState]
+	if !ok {
+		return fmt.Errorf("no transitions are defined to the target state '%s'", targetState)
+	}
+	for code, state := range statusOverrides {
+		if _, ok := targets[state]; !ok {
+			return fmt.Errorf("the status '%s' mapped from MAAS status code %d is not used in the transition table",
+				state, code)
+		}
+	}
+	for _, state := range statusNames() {
+		if _, ok := targets[state]; !ok {
+			return fmt.Errorf("no transition is defined from the MAAS state '%s' to the target state '%s'",
+				state, targetState)
+		}
+	}
+	if err := o.validateGuards(targets); err != nil {
+		return err
+	}
+	for state := range o.StateTimeouts {
+		if _, ok := targets[state]; !ok {
+			return fmt.Errorf("state timeout specified for state '%s' from which no transition to the target state '%s' is defined",
+				state, targetState)
+		}
+	}
+	return nil
+}
+
+// commissionOptionKinds the options supported when commissioning a node and
+// whether each is a boolean, options that are not boolean are passed as is
+var commissionOptionKinds = map[string]bool{
+	"enable_ssh":            true,
+	"skip_networking":       true,
+	"skip_storage":          true,
+	"commissioning_scripts": false,
+	"testing_scripts":       false,
+}
+
+// commissionParams the parameters with which to commission a node in the
+// given zone, boolean options are normalized to the form MAAS expects
+func (o ProcessingOptions) commissionParams(zone string) url.Values {
+	params := url.Values{}
+	for key, value := range o.CommissionOptions {
+		if commissionOptionKinds[key] {
+			if b, err := strconv.ParseBool(value); err == nil {
+				value = strconv.FormatBool(b)
+			}
+		}
+		params.Set(key, value)
+	}
+	if scripts, ok := o.ZoneTestingScripts[zone]; ok {
+		params.Set("testing_scripts", scripts)
+	}
+	return params
+}
+
+// allocatedBySelf whether the node was allocated by the automation. When MAAS
+// reports the agent name with which a node was aquired that is definitive,
+// otherwise the node is considered allocated by the automation if it is owned
+// by the user as which the automation aquires nodes.
+func (o ProcessingOptions) allocatedBySelf(node MaasNode) bool {
+	if agent := node.AgentName(); agent != "" && o.AgentName != "" {
+		return agent == o.AgentName
+	}
+	return node.OwnedBy(o.Owner)
+}
+
+// logf log a message, prefixed by the identifier of the processing pass
+func (o ProcessingOptions) logf(format string, v ...interface{}) {
+	if o.RunID != "" {
+		format = "[run:" + o.RunID + "] " + format
+	}
+	log.Printf(format, v...)
+}
+
+// newRunID generate a short identifier for a processing pass
+func newRunID() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(clock.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// The erase modes, how the disks of a node are erased when it is released
+const (
+	EraseNone   = "none"
+	EraseQuick  = "quick"
+	EraseSecure = "secure"
+)
+
+// validEraseMode verify the erase mode is one of those supported, or empty to
+// use the MAAS configuration
+func validEraseMode(mode string) error {
+	switch mode {
+	case "", EraseNone, EraseQuick, EraseSecure:
+		return nil
+	}
+	return fmt.Errorf("unknown release erase mode '%s', expected '%s', '%s' or '%s'",
+		mode, EraseNone, EraseQuick, EraseSecure)
+}
+
+// releaseParams the parameters with which to release a node in the given zone.
+// A quick or secure erase implies erasing, and a secure erase is preferred by
+// MAAS over a quick one, so only one of the two is ever given. A fast release
+// always explicitly skips erasing, overriding the MAAS configuration.
+func (o ProcessingOptions) releaseParams(zone string) url.Values {
+	mode := o.ReleaseErase
+	if override, ok := o.ZoneReleaseErase[zone]; ok {
+		mode = override
+	}
+	if o.FastRelease {
+		mode = EraseNone
+	}
+	params := url.Values{}
+	switch mode {
+	case EraseNone:
+		params.Set("erase", "false")
+	case EraseQuick:
+		params.Set("erase", "true")
+		params.Set("quick_erase", "true")
+	case EraseSecure:
+		params.Set("erase", "true")
+		params.Set("secure_erase", "true")
+	}
+	return params
+}
+
+// acquireParams the parameters with which to aquire the node, the additional
+// parameters along with those the automation sets itself, which take
+// precedence
+func (o ProcessingOptions) acquireParams(node MaasNode) url.Values {
+	params := url.Values{}
+	for key, value := range o.AcquireParams {
+		params.Set(key, value)
+	}
+	// Aquire the node by its system id rather than its hostname, as the
+	// system id uniquely identifies the machine even when hostnames are
+	// duplicated or the node has just been renamed
+	params.Set("system_id", node.SystemID())
+	if pool := o.resourcePool(node.Zone()); pool != "" {
+		params.Set("pool", pool)
+	}
+	if o.AgentName != "" {
+		params.Set("agent_name", o.AgentName)
+	}
+	return params
+}
+
+// kernelOpts the kernel command line options with which to deploy a node in
+// the given zone
+func (o ProcessingOptions) kernelOpts(zone string) string {
+	if opts, ok := o.ZoneDeployKernelOpts[zone]; ok {
+		return opts
+	}
+	return o.DeployKernelOpts
+}
+
+// resourcePool the resource pool into which to aquire a node in the given zone
+func (o ProcessingOptions) resourcePool(zone string) string {
+	if pool, ok := o.ZoneResourcePools[zone]; ok {
+		return pool
+	}
+	return o.ResourcePool
+}
+
+// Transitions the actual map
+//
+// Currently this is a hand compiled / optimized "next step" table. This should
+// really be generated from the state machine chart input. Once this has been
+// accomplished you should be able to determine the action to take given your
+// target state and your current state.
+var Transitions = map[string]map[string]Action{
+	"Deployed": {
+		"New":                 Commission,
+		"Deployed":            Done,
+		"Ready":               Aquire,
+		"Allocated":           Deploy,
+		"Retired":             AdminState,
+		"Reserved":            AdminState,
+		"Releasing":           Wait,
+		"DiskErasing":         Wait,
+		"Deploying":           Wait,
+		"Commissioning":       Wait,
+		"Missing":             Fail,
+		"FailedReleasing":     Fail,
+		"FailedDiskErasing":   ReleaseWithoutErase,
+		"FailedDeployment":    Fail,
+		"Broken":              Fail,
+		"FailedCommissioning": Fail,
+	},
+}
+
+// Remediations the corrective action to take when a node has been waiting in
+// a state longer than the timeout configured for that state. Waiting states
+// without a remediation, or whose release is not armed, are reported as
+// requiring manual attention.
+var Remediations = map[string]Action{
+	"Deploying":     Release,
+	"Commissioning": Abort,
+}
+
+const (
+	// defaultStateMachine Would be nice to drive from a graph language
+	defaultStateMachine string = `
+        (New)->(Commissioning)
+        (Commissioning)->(FailedCommissioning)
+        (FailedCommissioning)->(New)
+        (Commissioning)->(Ready)
+        (Ready)->(Deploying)
+        (Ready)->(Allocated)
+        (Allocated)->(Deploying)
+        (Deploying)->(Deployed)
+        (Deploying)->(FailedDeployment)
+        (FailedDeployment)->(Broken)
+        (Deployed)->(Releasing)
+        (Releasing)->(FailedReleasing)
+        (FailedReleasing)->(Broken)
+        (Releasing)->(DiskErasing)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)->(Releasing)
+        (FailedDiskErasing)->(Broken)
+        (Releasing)->(Ready)
+        (DiskErasing)->(Ready)
+        (Broken)->(Ready)`
+)
+
+// shortHostname the node's hostname with any domain name stripped off
+func shortHostname(node MaasNode) string {
+	current := node.Hostname()
+	if i := strings.IndexRune(current, '.'); i != -1 {
+		current = current[:i]
+	}
+	return current
+}
+
+// Mapping what the configuration specifies for the node with a given MAC
+// address. A mapping is either an object with any of the "hostname", "zone"
+// and "tags" fields or, for compatibility, just the hostname as a string.
+type Mapping struct {
+	Hostname string
+	Zone     string
+	Tags     []string
+}
+
+// parseMapping convert an entry in the mappings into a mapping, according to
+// the type of the entry
+func parseMapping(entry interface{}) Mapping {
+	var mapping Mapping
+	switch value := entry.(type) {
+	case string:
+		mapping.Hostname = value
+	case map[string]interface{}:
+		mapping.Hostname, _ = value["hostname"].(string)
+		mapping.Zone, _ = value["zone"].(string)
+		if tags, ok := value["tags"].([]interface{}); ok {
+			for _, tag := range tags {
+				if name, ok := tag.(string); ok && name != "" {
+					mapping.Tags = append(mapping.Tags, name)
+				}
+			}
+		}
+	}
+	return mapping
+}
+
+// mappingFor the mapping of one of the node's MAC addresses, if any
+func mappingFor(node MaasNode, options ProcessingOptions) (Mapping, bool) {
+	for _, mac := range node.MACs() {
+		if entry, ok := options.Mappings[mac]; ok {
+			return parseMapping(entry), true
+		}
+	}
+	return Mapping{}, false
+}
+
+// mappedHostname the hostname to which one of the node's MAC addresses is
+// mapped by the configuration, if any
+func mappedHostname(node MaasNode, options ProcessingOptions) (string, bool) {
+	mapping, ok := mappingFor(node, options)
+	if !ok || mapping.Hostname == "" {
+		return "", false
+	}
+	return mapping.Hostname, true
+}
+
+// mappingDrifted whether the node's hostname, zone or tags differ from those
+// to which it is mapped by the configuration
+func mappingDrifted(node MaasNode, options ProcessingOptions) bool {
+	mapping, ok := mappingFor(node, options)
+	if !ok {
+		return false
+	}
+	return hostnameDrifted(node, options) || placementDrifted(node, mapping)
+}
+
+// placementDrifted whether the node's zone or tags have drifted from those to
+// which it is mapped
+func placementDrifted(node MaasNode, mapping Mapping) bool {
+	if mapping.Zone != "" && node.Zone() != mapping.Zone {
+		return true
+	}
+	for _, tag := range mapping.Tags {
+		if !hasTag(node, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateNodeMapping reconcile the node's hostname, zone and tags with those to
+// which it is mapped by the configuration, returning the node as updated by
+// MAAS
+func updateNodeMapping(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (MaasNode, error) {
+	node, err := updateNodeName(client, node, options)
+	if err != nil {
+		return node, err
+	}
+	mapping, ok := mappingFor(node, options)
+	if !ok {
+		return node, nil
+	}
+
+	if mapping.Zone != "" && node.Zone() != mapping.Zone {
+		options.logf("ZONE '%s' to '%s'", node.Hostname(), mapping.Zone)
+		if !options.Preview {
+			nodeObj := client.GetSubObject("nodes").GetSubObject(node.SystemID())
+			updated, err := updateObject(options, nodeObj, url.Values{"zone": []string{mapping.Zone}})
+			if err != nil {
+				options.logf("ERROR: ZONE '%s' : '%s'", node.Hostname(), err)
+				return node, err
+			}
+			node = MaasNode{updated}
+		}
+	}
+
+	for _, tag := range mapping.Tags {
+		if err := ensureTag(client, []MaasNode{node}, tag, options); err != nil {
+			return node, err
+		}
+	}
+	return node, nil
+}
+
+// hostnameDrifted whether the node's hostname differs from the hostname to
+// which it is mapped by the configuration
+func hostnameDrifted(node MaasNode, options ProcessingOptions) bool {
+	name, ok := mappedHostname(node, options)
+	return ok && shortHostname(node) != name
+}
+
+// updateName - changes the name of the MAAS node based on the configuration
+// file, returning the node as updated by MAAS
+func updateNodeName(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (MaasNode, error) {
+	if !hostnameDrifted(node, options) || !options.renames(node) {
+		return node, nil
+	}
+
+	name, _ := mappedHostname(node, options)
+	nodesObj := client.GetSubObject("nodes")
+	nodeObj := nodesObj.GetSubObject(node.SystemID())
+	options.logf("RENAME '%s' to '%s'\n", node.Hostname(), name)
+
+	if !options.Preview {
+		updated, err := updateObject(options, nodeObj, url.Values{"hostname": []string{name}})
+		if err != nil {
+			options.logf("ERROR: RENAME '%s' : '%s'", node.Hostname(), err)
+			return node, err
+		}
+		return MaasNode{updated}, nil
+	}
+	return node, nil
+}
+
+// annotateNode append a comment to the node recording the action the
+// automation took and when, so operators browsing MAAS can see which nodes are
+// under automation control
+func annotateNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions, action string) error {
+	if !options.AnnotateNodes || options.Preview {
+		return nil
+	}
+
+	comment := fmt.Sprintf("auto-%s by maas-flow at %s", action, clock.Now().UTC().Format(time.RFC3339))
+	if existing, err := node.GetString("comment"); err == nil && existing != "" {
+		comment = existing + "\n" + comment
+	}
+
+	nodesObj := client.GetSubObject("nodes")
+	nodeObj := nodesObj.GetSubObject(node.SystemID())
+	_, err := updateObject(options, nodeObj, url.Values{"comment": []string{comment}})
+	if err != nil {
+		options.logf("[warn] unable to annotate node '%s' : %s", node.Hostname(), err)
+	}
+	return err
+}
+
+// Done we are at the target state, nothing to do
+var Done = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	// As devices are normally in the "COMPLETED" state this is only logged
+	// when the device transitions into it from another state, or every pass
+	// in verbose mode
+	if entered(node) || options.verbose() {
+		options.logf("COMPLETE: %s", node.Hostname())
+	}
+
+	return ActionResult{}, nil
+}
+
+// entered whether the node was first observed in its current state this
+// pass, having been observed in another state before
+func entered(node MaasNode) bool {
+	current, ok := tracker.get(node.SystemID())
+	return ok && current.Passes == 1 && current.Previous != ""
+}
+
+// Deploy cause a node to deploy
+var Deploy = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("DEPLOY: %s", node.Hostname())
+
+	// Polling the deploy does not modify the node, so does not hold one of
+	// the mutating actions in flight
+	release := func() {}
+	if !options.Preview {
+		inFlight.acquire()
+		var once sync.Once
+		release = func() { once.Do(inFlight.release) }
+		defer release()
+	}
+
+	// A node aquired by the automation that was not named when it was
+	// aquired, as naming was deferred or failed, is named before it is
+	// started
+	if options.allocatedBySelf(node) {
+		renamed, err := namePoolNode(client, node, options)
+		if err != nil {
+			return ActionResult{}, err
+		}
+		node = renamed
+	}
+
+	// MAAS applies kernel options through tags, so the node is tagged with
+	// its options before it is started
+	if opts := options.kernelOpts(node.Zone()); opts != "" {
+		options.logf("KERNEL OPTS: %s '%s'", node.Hostname(), opts)
+		if err := applyKernelOpts(client, node, opts, options); err != nil {
+			options.logf("ERROR: DEPLOY '%s' : unable to apply the kernel options '%s' : '%s'", node.Hostname(), opts, err)
+			return ActionResult{}, err
+		}
+	}
+
+	if !options.Preview {
+		nodesObj := client.GetSubObject("nodes")
+		myNode := nodesObj.GetSubObject(node.SystemID())
+		// Start the node with the trusty distro. This should really be looked up or
+		// a parameter default
+		_, err := callPost(options, myNode, "start", url.Values{"distro_series": []string{"trusty"}})
+		if err != nil {
+			if classifyMaasError(err) == ErrorClient {
+				options.logf("ERROR: DEPLOY '%s' : MAAS rejected the deploy, check the kernel options and boot parameters : '%s'",
+					node.Hostname(), err)
+				return ActionResult{}, err
+			}
+			options.logf("ERROR: DEPLOY '%s' : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, "deployed")
+		if options.DeployPoll > 0 {
+			release()
+			return deployOutcome(node, pollDeploy(client, node, options), options)
+		}
+	}
+	return ActionResult{Mutated: true, NextState: "Deploying"}, nil
+}
+
+// Aquire aquire a machine to a specific operator
+var Aquire = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("AQUIRE: %s", node.Hostname())
+	nodesObj := client.GetSubObject("nodes")
+	params := options.acquireParams(node)
+	if options.verbose() {
+		options.logf("[info] aquiring '%s' with parameters %s", node.Hostname(), params.Encode())
+	}
+
+	if !options.Preview {
+		inFlight.acquire()
+		defer inFlight.release()
+
+		// With a new version of MAAS we have to make sure the node is linked
+		// to the subnet vid DHCP before we move to the Aquire state. To do this
+		// We need to unlink the interface to the subnet and then relink it.
+		//
+		// Iterate through all the interfaces on the node, searching for ones
+		// that are valid and not DHCP and move them to DHCP
+		ifcsObj := client.GetSubObject("nodes").GetSubObject(node.SystemID()).GetSubObject("interfaces")
+		ifcsListObj, err := callGet(options, ifcsObj, "", url.Values{})
+		if err != nil {
+			return ActionResult{}, err
+		}
+
+		ifcsArray, err := ifcsListObj.GetArray()
+		if err != nil {
+			return ActionResult{}, err
+		}
+
+		for _, ifc := range ifcsArray {
+			ifcMap, err := ifc.GetMap()
+			if err != nil {
+				return ActionResult{}, err
+			}
+
+			// Iterate over the links assocated with the interface, looking for
+			// links with a subnect as well as a mode of "auto"
+			links, ok := ifcMap["links"]
+			if ok {
+				linkArray, err := links.GetArray()
+				if err != nil {
+					return ActionResult{}, err
+				}
+
+				for _, link := range linkArray {
+					linkMap, err := link.GetMap()
+					if err != nil {
+						return ActionResult{}, err
+					}
+					subnet, ok := linkMap["subnet"]
+					if ok {
+						subnetMap, err := subnet.GetMap()
+						if err != nil {
+							return ActionResult{}, err
+						}
+
+						val, err := linkMap["mode"].GetString()
+						if err != nil {
+							return ActionResult{}, err
+						}
+
+						if val == "auto" {
+							// Found one we like, so grab the subnet from the data and
+							// then relink this as DHCP
+							cidr, err := subnetMap["cidr"].GetString()
+							if err != nil {
+								return ActionResult{}, err
+							}
+
+							fifcID, err := ifcMap["id"].GetFloat64()
+							if err != nil {
+								return ActionResult{}, err
+							}
+							ifcID := strconv.Itoa(int(fifcID))
+
+							flID, err := linkMap["id"].GetFloat64()
+							if err != nil {
+								return ActionResult{}, err
+							}
+							lID := strconv.Itoa(int(flID))
+
+							ifcObj := ifcsObj.GetSubObject(ifcID)
+							_, err = callPost(options, ifcObj, "unlink_subnet", url.Values{"id": []string{lID}})
+							if err != nil {
+								return ActionResult{}, err
+							}
+							_, err = callPost(options, ifcObj, "link_subnet", url.Values{"mode": []string{"DHCP"}, "subnet": []string{cidr}})
+							if err != nil {
+								return ActionResult{}, err
+							}
+						}
+					}
+				}
+			}
+		}
+		_, err = acquireWithRetry(nodesObj, node, params, options)
+		if err != nil {
+			options.logf("ERROR: AQUIRE '%s' : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, "aquired")
+	}
+
+	// A node aquired into a pool is named from the pool's template as it
+	// is aquired, unless naming is deferred until it is deployed
+	if !options.DeferAcquireName {
+		if _, err := namePoolNode(client, node, options); err != nil {
+			return ActionResult{}, err
+		}
+	}
+	return ActionResult{Mutated: true, NextState: "Allocated"}, nil
+}
+
+// The bounds on retrying an aquire that conflicts with another
+const (
+	acquireRetries = 3
+	acquireBackoff = 500 * time.Millisecond
+)
+
+// acquireWithRetry aquire the node, retrying with a jittered backoff when
+// MAAS reports a conflict. When many nodes are aquired in quick succession
+// MAAS occasionally reports conflicts due to its internal contention, and as
+// aquiring is time sensitive they are retried within the pass rather than
+// waiting for the next pass.
+func acquireWithRetry(nodesObj maas.MAASObject, node MaasNode, params url.Values, options ProcessingOptions) (maas.JSONObject, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := callPost(options, nodesObj, "acquire", params)
+		if classifyMaasError(err) != ErrorConflict || attempt > acquireRetries {
+			return result, err
+		}
+		backoff := acquireBackoff << uint(attempt-1)
+		delay := backoff/2 + time.Duration(mathrand.Int63n(int64(backoff)))
+		options.logf("[info] contention aquiring '%s', retrying in %s (retry %d of %d)",
+			node.Hostname(), delay.Round(time.Millisecond), attempt, acquireRetries)
+		clock.Sleep(delay)
+	}
+}
+
+// Commission cause a node to be commissioned
+var Commission = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	if !options.Preview {
+		inFlight.acquire()
+		defer inFlight.release()
+	}
+
+	// The node is commissioned with the hostname, zone and tags to which it
+	// is mapped, as the zone determines the testing scripts that are run. Any
+	// failure has been logged, and the node is commissioned on a later pass.
+	node, err := updateNodeMapping(client, node, options)
+	if err != nil {
+		return ActionResult{}, err
+	}
+
+	// Need to understand the power state of the node. We only want to move to "Commissioning" if the node
+	// power is off. If the node power is not off, then turn it off.
+	state := node.PowerState()
+	switch state {
+	case "on":
+		// Attempt to turn the node off
+		options.logf("POWER DOWN: %s", node.Hostname())
+		if !options.Preview {
+			//POST /api/1.0/nodes/{system_id}/ op=stop
+			nodesObj := client.GetSubObject("nodes")
+			nodeObj := nodesObj.GetSubObject(node.SystemID())
+			_, err := callPost(options, nodeObj, "stop", url.Values{"stop_mode": []string{"soft"}})
+			if err != nil {
+				options.logf("ERROR: Commission '%s' : changing power start to off : '%s'", node.Hostname(), err)
+				return ActionResult{}, err
+			}
+			annotateNode(client, node, options, "powered-down")
+		}
+		return ActionResult{Mutated: true}, nil
+	case "off":
+		// We are off so move to commissioning
+		options.logf("COMISSION: %s", node.Hostname())
+		if !options.Preview {
+			nodesObj := client.GetSubObject("nodes")
+			nodeObj := nodesObj.GetSubObject(node.SystemID())
+			params := options.commissionParams(node.Zone())
+			_, err := callPost(options, nodeObj, "commission", params)
+			if err != nil {
+				// MAAS rejects the request outright if any of the scripts
+				// do not exist, which is otherwise easily mistaken for a
+				// problem with the node
+				if scripts := params.Get("testing_scripts"); scripts != "" && classifyMaasError(err) == ErrorClient {
+					err = fmt.Errorf("MAAS rejected commissioning with testing scripts '%s', check the scripts exist : %s",
+						scripts, err)
+				}
+				options.logf("ERROR: Commission '%s' : '%s'", node.Hostname(), err)
+				return ActionResult{}, err
+			}
+			annotateNode(client, node, options, "commissioned")
+		}
+		return ActionResult{Mutated: true, NextState: "Commissioning"}, nil
+	default:
+		// We are in a state from which we can't move forward.
+		options.logf("ERROR: %s has invalid power state '%s'", node.Hostname(), state)
+	}
+	return ActionResult{}, nil
+}
+
+// Wait a do nothing state, while work is being done. A node that has been
+// waiting too long is remediated instead, see waitRemedy.
+var Wait = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("WAIT: %s", node.Hostname())
+	return ActionResult{}, nil
+}
+
+// waitRemedy the action to take, instead of waiting, for a node that has been
+// waiting longer than the timeout for its state, or that is stuck deploying,
+// or nil to keep waiting. The remedy modifies the node so it is determined
+// before the action is taken, to be subject to the same checks as any other
+// mutating action, i.e. locking the node.
+func waitRemedy(node MaasNode, options ProcessingOptions) Action {
+	current, ok := tracker.get(node.SystemID())
+	if !ok {
+		return nil
+	}
+	waited := clock.Now().Sub(current.Since)
+	timeout, ok := options.StateTimeouts[current.State]
+	if !ok || waited <= timeout {
+		return stuckRemedy(node, current, options)
+	}
+
+	// Releasing a node is disruptive, and erases its disks by default, so is
+	// only done when armed
+	remedy, ok := options.remediation(current.State)
+	if !ok {
+		options.logf("[warn] %s has been in state '%s' for %s, longer than its timeout of %s, and requires manual attention",
+			node.Hostname(), current.State, waited, timeout)
+		return nil
+	}
+	options.logf("[warn] %s has been in state '%s' for %s, longer than its timeout of %s, attempting remediation",
+		node.Hostname(), current.State, waited, timeout)
+	return remedy
+}
+
+// remediation the corrective action for a node that has waited in the given
+// state longer than its timeout, if any, releasing only when armed
+func (o ProcessingOptions) remediation(state string) (Action, bool) {
+	remedy, ok := Remediations[state]
+	if !ok || sameAction(remedy, Release) && !o.ArmDestructive {
+		return nil, false
+	}
+	return remedy, true
+}
+
+// powerCycleDelay how long to wait between powering a node off and back on
+const powerCycleDelay = 10 * time.Second
+
+// stuckRemedy power cycle the node if it has been deploying for longer than
+// the stuck timeout, up to the maximum number of attempts, waiting the stuck
+// timeout between attempts. No attempts disables power cycling.
+func stuckRemedy(node MaasNode, current nodeState, options ProcessingOptions) Action {
+	if !options.PowerCycleStuck || !options.ArmDestructive || options.PowerCycleAttempts <= 0 ||
+		current.State != "Deploying" {
+		return nil
+	}
+	now := clock.Now()
+	if now.Sub(current.Since) <= options.StuckTimeout {
+		return nil
+	}
+	record := tracker.powerCycled(node.SystemID(), current)
+	if record.Attempts > 0 && now.Sub(record.Last) <= options.StuckTimeout {
+		return nil
+	}
+	if record.Attempts >= options.PowerCycleAttempts {
+		if record.Attempts == options.PowerCycleAttempts {
+			options.logf("[warn] %s is still stuck in state '%s' after %d power cycles and requires manual attention",
+				node.Hostname(), current.State, record.Attempts)
+			// Count the warning as an attempt so that it is only logged once
+			tracker.powerCycling(node.SystemID(), current, now)
+		}
+		return nil
+	}
+	options.logf("[warn] %s has been in state '%s' for %s, longer than the stuck timeout of %s, power cycling (attempt %d of %d)",
+		node.Hostname(), current.State, now.Sub(current.Since).Round(time.Second), options.StuckTimeout,
+		record.Attempts+1, options.PowerCycleAttempts)
+	return PowerCycle
+}
+
+// PowerCycle power a node off and then back on, i.e. to recover a node that is
+// stuck deploying
+var PowerCycle = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("POWER CYCLE: %s", node.Hostname())
+
+	if !options.Preview {
+		nodesObj := client.GetSubObject("nodes")
+		nodeObj := nodesObj.GetSubObject(node.SystemID())
+		inFlight.acquire()
+		_, err := callPost(options, nodeObj, "stop", url.Values{"stop_mode": []string{"hard"}})
+		inFlight.release()
+		if err != nil {
+			options.logf("ERROR: POWER CYCLE '%s' : powering off : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+
+		// Only a power cycle that was actually started counts towards the
+		// attempts, so that preview passes do not use them up
+		if current, ok := tracker.get(node.SystemID()); ok {
+			tracker.powerCycling(node.SystemID(), current, clock.Now())
+		}
+		// The slot is not held while the node is left powered off, so that
+		// other actions are not held up
+		clock.Sleep(powerCycleDelay)
+
+		inFlight.acquire()
+		defer inFlight.release()
+		_, err = callPost(options, nodeObj, "start", url.Values{})
+		if err != nil {
+			options.logf("ERROR: POWER CYCLE '%s' : powering on : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, "power-cycled")
+	}
+	return ActionResult{Mutated: true}, nil
+}
+
+// Release release a node back to the pool of available machines, from where it
+// will be aquired and deployed again. With FastRelease the node's disks are
+// not erased.
+var Release = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	annotation := "released"
+	if options.FastRelease {
+		annotation = "fast-released"
+		options.logf("FAST RELEASE: %s", node.Hostname())
+	} else {
+		options.logf("RELEASE: %s", node.Hostname())
+	}
+
+	if !options.Preview {
+		inFlight.acquire()
+		defer inFlight.release()
+
+		nodesObj := client.GetSubObject("nodes")
+		nodeObj := nodesObj.GetSubObject(node.SystemID())
+		_, err := callPost(options, nodeObj, "release", options.releaseParams(node.Zone()))
+		if err != nil {
+			options.logf("ERROR: RELEASE '%s' : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, annotation)
+		freePoolName(node.SystemID())
+	}
+	return ActionResult{Mutated: true, NextState: "Releasing"}, nil
+}
+
+// ReleaseWithoutErase release a node that failed to erase its disks, this
+// time without erasing them, as the node is to be deployed again regardless.
+// Unless enabled with ReleaseFailedErase the node is left for manual attention.
+var ReleaseWithoutErase = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	if !options.ReleaseFailedErase {
+		options.logf("FAIL: %s, failed erasing its disks", node.Hostname())
+		return ActionResult{}, nil
+	}
+	options.logf("RELEASE WITHOUT ERASE: %s", node.Hostname())
+
+	if !options.Preview {
+		inFlight.acquire()
+		defer inFlight.release()
+
+		nodesObj := client.GetSubObject("nodes")
+		nodeObj := nodesObj.GetSubObject(node.SystemID())
+		_, err := callPost(options, nodeObj, "release", url.Values{"erase": []string{"false"}})
+		if err != nil {
+			options.logf("ERROR: RELEASE WITHOUT ERASE '%s' : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, "released-without-erase")
+		freePoolName(node.SystemID())
+	}
+	return ActionResult{Mutated: true, NextState: "Releasing"}, nil
+}
+
+// Abort abort the operation currently being performed on a node, returning it
+// to its previous state so that the operation can be attempted again
+var Abort = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("ABORT: %s", node.Hostname())
+
+	if !options.Preview {
+		inFlight.acquire()
+		defer inFlight.release()
+
+		nodesObj := client.GetSubObject("nodes")
+		nodeObj := nodesObj.GetSubObject(node.SystemID())
+		_, err := callPost(options, nodeObj, "abort_operation", url.Values{})
+		if err != nil {
+			options.logf("ERROR: ABORT '%s' : '%s'", node.Hostname(), err)
+			return ActionResult{}, err
+		}
+		annotateNode(client, node, options, "aborted")
+	}
+	return ActionResult{Mutated: true}, nil
+}
+
+// Fail a state from which we cannot, currently, automatically recover
+var Fail = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("FAIL: %s", node.Hostname())
+	return ActionResult{}, nil
+}
+
+// AdminState an administrative state from which we should make no automatic transition
+var AdminState = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) (ActionResult, error) {
+	options.logf("ADMIN: %s", node.Hostname())
+	return ActionResult{}, nil
+}
+
+// ErrNoTransition the error returned when no transition is defined from a
+// node's current state to the target state. This is expected for terminal and
+// unknown states and is distinct from a failure to process a node.
+type ErrNoTransition struct {
+	Current string
+	Target  string
+}
+
+func (e ErrNoTransition) Error() string {
+	return fmt.Sprintf("Could not find transition from current state '%s' to target state '%s'",
+		e.Current, e.Target)
+}
+
+// noTransitionLogInterval how often the lack of a transition is logged for any
+// one node, as a node in such a state will remain there pass after pass
+const noTransitionLogInterval = 5 * time.Minute
+
+// noTransitionLogged when the lack of a transition was last logged for each node
+var noTransitionLogged = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// logNoTransition log, at most once every noTransitionLogInterval for each
+// node, that no transition is defined for the node's state
+func logNoTransition(node MaasNode, err ErrNoTransition, options ProcessingOptions) {
+	noTransitionLogged.Lock()
+	defer noTransitionLogged.Unlock()
+
+	if last, ok := noTransitionLogged.at[node.SystemID()]; ok && clock.Now().Sub(last) < noTransitionLogInterval {
+		return
+	}
+	noTransitionLogged.at[node.SystemID()] = clock.Now()
+	options.logf("[info] no transition defined for node '%s' from current state '%s' to target state '%s'",
+		node.Hostname(), err.Current, err.Target)
+}
+
+func findAction(target string, current string) (Action, error) {
+	targets, ok := Transitions[target]
+	if !ok {
+		return nil, fmt.Errorf("Could not find transition to target state '%s'", target)
+	}
+
+	action, ok := targets[current]
+	if !ok {
+		return nil, ErrNoTransition{Current: current, Target: target}
+	}
+
+	return action, nil
+}
+
+// NodeResult the outcome of processing a single node in a pass
+type NodeResult struct {
+	SystemID  string
+	Hostname  string
+	FromState string
+
+	// Action the name of the action taken for the node, if any
+	Action string
+
+	// Skipped whether the node was skipped, i.e. it did not match the filter,
+	// was cooling down or is in a state with no transition
+	Skipped bool
+
+	// Outcome what the action did to the node. As actions are performed in
+	// the background, except in preview mode, this is only known in preview
+	// mode.
+	Outcome ActionResult
+
+	// Err the error processing the node, if any. As actions are performed
+	// in the background, except in preview mode, this only reflects errors
+	// that occurred before the action was started.
+	Err error
+
+	// Reconciled whether the node's hostname, zone and tags were reconciled
+	// with its mapping, or would have been in preview mode
+	Reconciled bool
+
+	// Tagged the tag added to the node to mark it as managed, or that would
+	// have been in preview mode, see ProcessingOptions.EnsureTag, if any
+	Tagged string
+}
+
+// actionNames the names of the built in actions
+var actionNames = []struct {
+	name   string
+	action Action
+}{
+	{"Commission", Commission},
+	{"Done", Done},
+	{"Aquire", Aquire},
+	{"Deploy", Deploy},
+	{"Wait", Wait},
+	{"Fail", Fail},
+	{"AdminState", AdminState},
+	{"Release", Release},
+	{"ReleaseWithoutErase", ReleaseWithoutErase},
+	{"Abort", Abort},
+	{"PowerCycle", PowerCycle},
+}
+
+// ActionName the name of the given action, or "Custom" if it is not one of
+// the built in actions
+func ActionName(action Action) string {
+	for _, entry := range actionNames {
+		if sameAction(entry.action, action) {
+			return entry.name
+		}
+	}
+	return "Custom"
+}
+
+// ProcessNode determine and take the action for a single node, as a pass of
+// its own with its own run ID unless one is given
+func ProcessNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	if options.RunID == "" {
+		options.RunID = newRunID()
+	}
+	return processNode(client, node, options).Err
+}
+
+// processNode determine and take the action for the node from its current
+// state towards the target state
+func processNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) NodeResult {
+	options = options.withTrace(node)
+	if options.ReadOnly {
+		options.Preview = true
+	}
+	options.tracef("processing node %s", node.Debug())
+	result := NodeResult{SystemID: node.SystemID(), Hostname: node.Hostname()}
+	state, err := node.StatusName()
+	if err != nil {
+		if options.verbose() {
+			options.logf("[info] unable to determine the state of node %s", node.Debug())
+		}
+		result.Err = err
+		return result
+	}
+	result.FromState = state
+	observed := tracker.observe(node.SystemID(), state, clock.Now())
+	tracker.drive(node.SystemID(), false)
+	action, err := findAction(targetState, state)
+	if noTransition, ok := err.(ErrNoTransition); ok {
+		// Not being able to move a node forward from its current state is
+		// expected, so note it and move on
+		noTransitions.inc("state", noTransition.Current)
+		if options.StrictTransitions {
+			options.logf("[error] %s : %s", node.Hostname(), noTransition)
+			result.Err = noTransition
+			return result
+		}
+		logNoTransition(node, noTransition, options)
+		result.Skipped = true
+		return result
+	}
+	if err != nil {
+		options.logf("[warn] unable to find transitions to target state '%s'", targetState)
+		result.Err = err
+		return result
+	}
+
+	// A node allocated by someone else is theirs to deploy, or not
+	if state == "Allocated" && options.SkipExternallyAllocated && !options.allocatedBySelf(node) {
+		if options.verbose() {
+			options.logf("[info] leaving node '%s' to '%s' who allocated it", node.Hostname(), node.Owner())
+		}
+		action = AdminState
+	}
+
+	// A deployed node in excess of the target is released, see scaleDown
+	if options.reclaim && sameAction(action, Done) {
+		action = Release
+	}
+
+	// A node that has waited too long is remediated, which modifies the node
+	// and so is subject to the checks below like any other mutating action
+	if sameAction(action, Wait) {
+		if remedy := waitRemedy(node, options); remedy != nil {
+			action = remedy
+		}
+	}
+	result.Action = ActionName(action)
+	tracker.drive(node.SystemID(), !settledActions[result.Action])
+	options.tracef("%s in state '%s', observed for %d passes, transition to '%s' is %s",
+		node.Hostname(), state, observed.Passes, targetState, result.Action)
+
+	// When executing a plan only the approved actions are taken
+	if options.Plan != nil && !options.Plan.planned(node, state, result.Action, options) {
+		result.Skipped = true
+		return result
+	}
+
+	// When read only nothing is done that would modify the node
+	if options.ReadOnly && mutatingAction(action) {
+		options.logf("[info] read only, not taking %s for node '%s' in state '%s'", result.Action, node.Hostname(), state)
+		result.Skipped = true
+		return result
+	}
+
+	// When cordoned only the nodes already mid-transition are driven
+	if Cordoned() && initiatingAction(action) {
+		if options.verbose() {
+			options.logf("[info] cordoned, not starting new work on node '%s' in state '%s'", node.Hostname(), state)
+		}
+		result.Skipped = true
+		return result
+	}
+
+	// A guarded transition is only taken once the node passes its checks
+	transition := Transition{Target: targetState, Current: state, Using: action, Validate: options.guard(state)}
+	if transition.Validate != nil {
+		if err := transition.Validate(node, options); err != nil {
+			options.logf("[info] not taking %s for node '%s' in state '%s' as %s", result.Action, node.Hostname(), state, err)
+			result.Skipped = true
+			return result
+		}
+	}
+
+	// A node can be ready yet have failed its hardware tests, which must
+	// not be put into service
+	if options.SkipTestFailed && (sameAction(action, Aquire) || sameAction(action, Deploy)) && testsFailed(node) {
+		options.logf("[warn] %s failed its hardware tests, status '%s', not taking %s, requires manual attention",
+			node.Hostname(), node.TestingStatus(), result.Action)
+		needsAttention.inc("reason", "tests_failed")
+		result.Skipped = true
+		return result
+	}
+
+	// Freshly enlisted nodes can flap between states momentarily, so don't
+	// act on a transient reading
+	if options.StabilityPasses > 1 && mutatingAction(action) && observed.Passes < options.StabilityPasses {
+		if options.verbose() {
+			options.logf("[info] waiting for node '%s' to be stable in state '%s', observed for %d of %d passes",
+				node.Hostname(), state, observed.Passes, options.StabilityPasses)
+		}
+		result.Skipped = true
+		return result
+	}
+
+	// After a failed action, retrying on the very next pass usually fails the
+	// same way, so space the attempts out by the cooldown
+	if options.ActionCooldown > 0 {
+		if until, ok := tracker.coolingDown(node.SystemID(), state, options.ActionCooldown, clock.Now()); ok {
+			options.logf("[info] %s cooling down after a failed action until %s", node.Hostname(),
+				until.Format(time.RFC3339))
+			result.Skipped = true
+			return result
+		}
+	}
+
+	// When another instance holds the lock on the node leave it to that
+	// instance this pass
+	locked := false
+	if options.LockNodes && !options.Preview && mutatingAction(action) {
+		ok, err := lockNode(client, node, options)
+		if err != nil {
+			options.logf("[warn] unable to lock node '%s', skipping it this pass : %s", node.Hostname(), err)
+			result.Skipped = true
+			return result
+		}
+		if !ok {
+			options.logf("[info] skipping node '%s' this pass as it is locked by another instance", node.Hostname())
+			result.Skipped = true
+			return result
+		}
+		locked = true
+	}
+
+	// The action is recorded as in flight before it is started so that it is
+	// seen as such as soon as this function returns
+	tracker.begin(node.SystemID())
+	run := func() (ActionResult, error) {
+		defer tracker.end(node.SystemID())
+		if locked {
+			defer unlockNode(client, node, options)
+		}
+		outcome, err := transition.Using(client, node, options)
+		options.tracef("%s completed %s, mutated %t, next state '%s', error %v",
+			node.Hostname(), result.Action, outcome.Mutated, outcome.NextState, err)
+		tracker.completed(node.SystemID(), result.Action, err, clock.Now())
+		if err != nil && options.ActionCooldown > 0 {
+			tracker.failed(node.SystemID(), state, clock.Now())
+		}
+		if err == nil {
+			actionsTaken.inc("action", result.Action, "mutated", strconv.FormatBool(outcome.Mutated))
+		}
+		if !options.Preview && (outcome.Mutated || err != nil) {
+			event := Event{Time: clock.Now(), RunID: options.RunID, SystemID: node.SystemID(),
+				Hostname: node.Hostname(), State: state, Action: result.Action}
+			if err != nil {
+				event.Error = err.Error()
+			}
+			notify(event)
+		}
+		return outcome, err
+	}
+	if options.Preview {
+		result.Outcome, result.Err = run()
+	} else {
+		actions.Add(1)
+		go func() {
+			defer actions.Done()
+			run()
+		}()
+	}
+	return result
+}
+
+// actions the actions running in the background
+var actions sync.WaitGroup
+
+// WaitForActions wait for the actions started by processing the nodes, which
+// run in the background, to complete
+func WaitForActions() {
+	actions.Wait()
+}
+
+// The rollout modes, how the automation proceeds across zones
+const (
+	// RolloutParallel process the nodes in all zones at once
+	RolloutParallel = "parallel"
+
+	// RolloutSerialByZone process one zone at a time, not acting on the next
+	// zone until the nodes in the current zone have settled
+	RolloutSerialByZone = "serial-by-zone"
+)
+
+// sameAction whether the two actions are the same function
+func sameAction(a Action, b Action) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// nodeSettled whether a node is not in transition, i.e. no action is in flight
+// for it and it is at the target state or in a state from which the automation
+// makes no automatic transition
+func nodeSettled(node MaasNode) bool {
+	if tracker.running(node.SystemID()) {
+		return false
+	}
+	current, ok := tracker.get(node.SystemID())
+	if !ok {
+		return false
+	}
+	action, err := findAction(targetState, current.State)
+	if err != nil {
+		// With no transition the automation will not move the node
+		_, ok := err.(ErrNoTransition)
+		return ok
+	}
+	return sameAction(action, Done) || sameAction(action, Fail) || sameAction(action, AdminState)
+}
+
+// matchedNone whether the last pass matched no nodes while nodes existed, used
+// to warn only when the filter starts, or stops, matching nothing
+var matchedNone = struct {
+	sync.Mutex
+	warned bool
+}{}
+
+// checkMatched warn, prominently, when a pass matches no nodes while nodes
+// exist, as this is usually a misconfigured filter. To avoid repeating the
+// warning every pass it is only given when the pass changes from matching
+// nodes to matching none.
+func checkMatched(matched int, total int, options ProcessingOptions) {
+	matchedNodes.set(float64(matched))
+
+	matchedNone.Lock()
+	defer matchedNone.Unlock()
+	switch {
+	case matched == 0 && total > 0 && !matchedNone.warned:
+		matchedNone.warned = true
+		options.logf("[warn] ******************************************************************")
+		options.logf("[warn] none of the %d nodes matched the filter, the filter may be misconfigured : %+v",
+			total, options.Filter)
+		options.logf("[warn] ******************************************************************")
+	case matched > 0 && matchedNone.warned:
+		matchedNone.warned = false
+		options.logf("[info] %d of the %d nodes now match the filter", matched, total)
+	}
+}
+
+// summarizeZones log, and record as metrics, the number of nodes in each zone
+// in each state so that, for example, a zone with many nodes stuck in a
+// failed state stands out
+func summarizeZones(nodes []MaasNode, options ProcessingOptions) {
+	counts := make(map[string]map[string]int)
+	for _, node := range nodes {
+		state, err := node.StatusName()
+		if err != nil {
+			state = "Unknown"
+		}
+		zone := node.Zone()
+		if counts[zone] == nil {
+			counts[zone] = make(map[string]int)
+		}
+		counts[zone][state]++
+	}
+
+	zoneNodes.reset()
+	zones := make([]string, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		states := make([]string, 0, len(counts[zone]))
+		for state := range counts[zone] {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		summary := make([]string, len(states))
+		for i, state := range states {
+			summary[i] = fmt.Sprintf("%s=%d", state, counts[zone][state])
+			zoneNodes.set(float64(counts[zone][state]), "zone", zone, "state", state)
+		}
+		options.logf("[info] zone '%s' : %s", zone, strings.Join(summary, " "))
+	}
+}
+
+// ProcessAll something
+func ProcessAll(client *maas.MAASObject, nodes []MaasNode, options ProcessingOptions) []NodeResult {
+	start := clock.Now()
+	defer func() {
+		passDuration.observe(clock.Now().Sub(start).Seconds())
+	}()
+	options.RunID = newRunID()
+	if options.ReadOnly {
+		options.Preview = true
+	}
+	pressure.adjust(options)
+	if !options.PartialFetch {
+		passNodes.set(float64(len(nodes)))
+		tracker.resetDriving()
+	}
+
+	// Every node has a result, those that don't match the filter are skipped
+	results := make([]NodeResult, len(nodes))
+	for i, node := range nodes {
+		results[i] = NodeResult{SystemID: node.SystemID(), Hostname: node.Hostname(), Skipped: true}
+	}
+	// The names used by any node, matched or not, are never given to another
+	if options.NameTemplate != "" {
+		recordPoolNames(nodes, options.NameTemplate)
+	}
+
+	// Determine the nodes that match the filter. When restricted to a list of
+	// nodes, or to the nodes carrying the managed tag, the others are skipped
+	// silently, as they are expected to be the vast majority.
+	var targeted map[string]bool
+	if len(options.NodeIDs) > 0 {
+		targeted = make(map[string]bool, len(options.NodeIDs))
+		for _, id := range options.NodeIDs {
+			targeted[id] = true
+		}
+	}
+	// The filter is validated when it is loaded, see Validate, a filter that
+	// is nonetheless invalid matches no nodes and the nodes record the error
+	var matched []int
+	var invalid error
+	considered := 0
+	unmatched := make(map[string]bool)
+	for i, node := range nodes {
+		if targeted != nil && !targeted[node.SystemID()] {
+			continue
+		}
+		if options.ManagedTag != "" && !hasTag(node, options.ManagedTag) {
+			continue
+		}
+		considered++
+		reason, ok, err := options.Filter.explain(node)
+		if err != nil {
+			results[i].Err = err
+			invalid = err
+		}
+		if ok {
+			matched = append(matched, i)
+			continue
+		}
+		unmatched[node.SystemID()] = true
+		if options.withTrace(node).verbose() {
+			options.logf("[info] ignoring node '%s' as %s", node.Hostname(), reason)
+		}
+	}
+	if invalid != nil {
+		nodeErrors.inc("reason", "invalid_filter")
+		options.logf("[error] invalid filter, no nodes are processed : %s", invalid)
+	}
+
+	// A pass that only fetched the nodes still being driven has not seen the
+	// whole fleet, so leaves the fleet wide metrics and status as they are
+	if !options.PartialFetch {
+		checkMatched(len(matched), considered, options)
+		recordMatched(nodes, matched)
+		summarizeZones(nodes, options)
+		checkDuplicateHostnames(nodes, options)
+
+		// The nodes no longer listed have been deleted from MAAS, and those
+		// the filter no longer matches are no longer driven, so neither is
+		// tracked. An invalid filter matches nothing, so forgets nothing.
+		listed := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			if invalid == nil && unmatched[node.SystemID()] {
+				continue
+			}
+			listed[node.SystemID()] = true
+		}
+		tracker.forget(listed)
+	}
+	// When executing a plan only the nodes the plan tags are tagged. Tagging
+	// modifies the nodes, so like a mutating action it is not done while
+	// cordoned, holds one of the actions in flight and locks each node.
+	var tagged []int
+	if options.EnsureTag != "" && !Cordoned() {
+		if !options.Preview {
+			inFlight.acquire()
+		}
+		var managed []MaasNode
+		var unlocks []func()
+		for _, index := range matched {
+			if hasTag(nodes[index], options.EnsureTag) {
+				continue
+			}
+			if options.Plan != nil && !options.Plan.tags(nodes[index], options.EnsureTag) {
+				continue
+			}
+			unlock, ok := lockToUpdate(client, nodes[index], options.withTrace(nodes[index]), "tagging")
+			if !ok {
+				continue
+			}
+			unlocks = append(unlocks, unlock)
+			managed = append(managed, nodes[index])
+			tagged = append(tagged, index)
+		}
+		ensureTag(client, managed, options.EnsureTag, options)
+		for _, unlock := range unlocks {
+			unlock()
+		}
+		if !options.Preview {
+			inFlight.release()
+		}
+	}
+
+	held := capAquires(nodes, matched, options)
+	reclaim := scaleDown(nodes, matched, options)
+
+	drifted := 0
+	process := func(i int) {
+		node := nodes[i]
+		options := options.withTrace(node)
+
+		// Reconcile the hostname, zone and tags against the mappings,
+		// correcting any drift, i.e. a manual rename in MAAS, unless never
+		// renaming. The hostname itself is only corrected as the rename mode
+		// allows, otherwise the drift is logged.
+		renamed := hostnameDrifted(node, options)
+		if renamed {
+			drifted++
+		}
+		reconciled := false
+		if mappingDrifted(node, options) {
+			reconciles := options.renameMode() != RenameNever
+			if renamed && !options.renames(node) {
+				name, _ := mappedHostname(node, options)
+				options.logf("[warn] hostname of node '%s' has drifted from its mapped hostname '%s'",
+					node.Hostname(), name)
+				mapping, _ := mappingFor(node, options)
+				reconciles = reconciles && placementDrifted(node, mapping)
+			}
+			if reconciles && options.Plan != nil && !options.Plan.reconciles(node) {
+				options.logf("[warn] not reconciling node '%s' with its mapping as the plan does not", node.Hostname())
+			} else if reconciles {
+				if done, ok := holdToUpdate(client, node, options, "reconciling"); ok {
+					node, _ = updateNodeMapping(client, node, options)
+					done()
+					reconciled = true
+				}
+			}
+		}
+
+		// Once enough nodes are deployed, or on their way, no more are
+		// aquired
+		if held[i] {
+			if options.verbose() {
+				options.logf("[info] not aquiring node '%s' as enough nodes are deployed or deploying", node.Hostname())
+			}
+			results[i].FromState = "Ready"
+			results[i].Reconciled = reconciled
+			return
+		}
+
+		options.reclaim = reclaim[i]
+		results[i] = processNode(client, node, options)
+		results[i].Reconciled = reconciled
+		if err := results[i].Err; err != nil {
+			if _, ok := err.(ErrNoTransition); ok {
+				nodeErrors.inc("reason", "no_transition")
+			} else {
+				nodeErrors.inc("reason", "processing")
+			}
+		}
+	}
+
+	switch options.Rollout {
+	case RolloutSerialByZone:
+		// Process one zone at a time, in order, and don't begin acting on
+		// the next zone until every node in the current zone has settled
+		zones, byZone := groupByZone(nodes, matched, options.ZoneOrder)
+		holding := ""
+		for _, zone := range zones {
+			if holding != "" {
+				if options.verbose() {
+					options.logf("[info] holding zone '%s' until the nodes in zone '%s' have settled", zone, holding)
+				}
+				continue
+			}
+			settled := true
+			for _, i := range byZone[zone] {
+				process(i)
+				if held[i] {
+					continue
+				}
+				// A node whose state cannot be read would otherwise hold
+				// back the later zones forever, so it is reported instead
+				if _, err := nodes[i].StatusName(); err != nil {
+					options.logf("[warn] unable to determine the state of node '%s', not holding the rollout for it : %s",
+						nodes[i].Hostname(), err)
+					continue
+				}
+				if !nodeSettled(nodes[i]) {
+					settled = false
+				}
+			}
+			if !settled {
+				holding = zone
+			}
+		}
+	default:
+		for _, i := range matched {
+			process(i)
+		}
+	}
+
+	for _, i := range tagged {
+		results[i].Tagged = options.EnsureTag
+	}
+
+	if !options.PartialFetch {
+		hostnameDrift.set(float64(drifted))
+		checkConverged(results, matched, held, options)
+	}
+	checkChurn(nodes, results, matched, options)
+	if drifted > 0 {
+		options.logf("[info] %d node(s) found with hostname drift from their mappings", drifted)
+	}
+
+	// So reviewers need not re-read the full plan, each preview pass reports
+	// what has changed since the previous one
+	if options.Preview {
+		logPlanChanges(buildPlan(nodes, results, matched), options)
+	}
+	return results
+}
+
+// groupByZone group the indexes of the given nodes by zone, returning the
+// zones in the order they should be processed, those in the given order first
+// followed by any others alphabetically
+func groupByZone(nodes []MaasNode, indexes []int, order []string) ([]string, map[string][]int) {
+	byZone := make(map[string][]int)
+	for _, i := range indexes {
+		zone := nodes[i].Zone()
+		byZone[zone] = append(byZone[zone], i)
+	}
+
+	zones := make([]string, 0, len(byZone))
+	ordered := make(map[string]bool)
+	for _, zone := range order {
+		if _, ok := byZone[zone]; ok && !ordered[zone] {
+			zones = append(zones, zone)
+			ordered[zone] = true
+		}
+	}
+	var rest []string
+	for zone := range byZone {
+		if !ordered[zone] {
+			rest = append(rest, zone)
+		}
+	}
+	sort.Strings(rest)
+	return append(zones, rest...), byZone
+}
@@ -0,0 +1,156 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NodeStatus the status of a single node as reported by the status command
+type NodeStatus struct {
+	SystemID string `json:"system_id"`
+	Hostname string `json:"hostname"`
+	Zone     string `json:"zone"`
+	Status   string `json:"status"`
+
+	// Since when the node entered its current state, if known
+	Since *time.Time `json:"since,omitempty"`
+
+	// TimeInState how long the node has been in its current state, if known
+	TimeInState string `json:"time_in_state,omitempty"`
+
+	// Approximate whether the time in state is derived from a timestamp
+	// provided by MAAS, which may be updated for reasons other than a change
+	// of state, rather than from the state tracked by the automation
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// maasTimestampFields the node fields, in order of preference, from which the
+// time the node entered its state is approximated when the automation has no
+// history for the node
+var maasTimestampFields = []string{"status_changed", "updated"}
+
+// maasTimestampLayouts the layouts in which MAAS provides timestamps
+var maasTimestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02T15:04:05"}
+
+// maasTimestamp the time the node last changed according to MAAS, if provided
+func maasTimestamp(node MaasNode) (time.Time, bool) {
+	for _, field := range maasTimestampFields {
+		value, err := node.GetString(field)
+		if err != nil || value == "" {
+			continue
+		}
+		for _, layout := range maasTimestampLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Status report the status of each node, including how long it has been in
+// its current state. This is derived from the state tracked by the automation
+// when the node was last observed in its current state, otherwise from any
+// timestamp provided by MAAS, in which case it is marked as approximate.
+func Status(nodes []MaasNode, now time.Time) []NodeStatus {
+	report := make([]NodeStatus, len(nodes))
+	for i, node := range nodes {
+		state, _ := node.StatusName()
+		entry := NodeStatus{
+			SystemID: node.SystemID(),
+			Hostname: node.Hostname(),
+			Zone:     node.Zone(),
+			Status:   state,
+		}
+
+		since, ok := time.Time{}, false
+		if tracked, found := tracker.get(node.SystemID()); found && tracked.State == state {
+			since, ok = tracked.Since, true
+		} else if since, ok = maasTimestamp(node); ok {
+			entry.Approximate = true
+		}
+		if ok {
+			entry.Since = &since
+			entry.TimeInState = now.Sub(since).Round(time.Second).String()
+		}
+		report[i] = entry
+	}
+	return report
+}
+
+// LiveStatus the status of a matched node as served by the status endpoint,
+// including the last action taken for the node and whether one is in flight
+type LiveStatus struct {
+	NodeStatus
+
+	// LastAction the last action completed for the node, if any
+	LastAction string `json:"last_action,omitempty"`
+
+	// LastActionAt when the last action for the node completed
+	LastActionAt *time.Time `json:"last_action_at,omitempty"`
+
+	// LastError the error returned by the last action, if it failed
+	LastError string `json:"last_error,omitempty"`
+
+	// InFlight whether an action for the node is currently running
+	InFlight bool `json:"in_flight"`
+}
+
+// lastMatched the nodes that matched the filter in the last pass
+var lastMatched = struct {
+	sync.Mutex
+	nodes []MaasNode
+}{}
+
+// recordMatched remember the nodes that matched the filter in a pass
+func recordMatched(nodes []MaasNode, matched []int) {
+	snapshot := make([]MaasNode, len(matched))
+	for i, index := range matched {
+		snapshot[i] = nodes[index]
+	}
+	lastMatched.Lock()
+	defer lastMatched.Unlock()
+	lastMatched.nodes = snapshot
+}
+
+// LiveStatusReport the status of each node that matched the filter in the
+// last pass, ordered by hostname
+func LiveStatusReport(now time.Time) []LiveStatus {
+	lastMatched.Lock()
+	nodes := lastMatched.nodes
+	lastMatched.Unlock()
+
+	statuses := Status(nodes, now)
+	report := make([]LiveStatus, len(statuses))
+	for i, status := range statuses {
+		entry := LiveStatus{NodeStatus: status, InFlight: tracker.running(status.SystemID)}
+		if outcome, ok := tracker.lastOutcome(status.SystemID); ok {
+			at := outcome.At
+			entry.LastAction = outcome.Action
+			entry.LastActionAt = &at
+			entry.LastError = outcome.Err
+		}
+		report[i] = entry
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Hostname < report[j].Hostname })
+	return report
+}
+
+// StatusHandler a read only HTTP handler that reports, as JSON, the status of
+// each node that matched the filter in the last pass
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(LiveStatusReport(clock.Now()))
+	})
+}
@@ -0,0 +1,105 @@
+package maasflow
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// hasTag whether the node carries the named tag
+func hasTag(node MaasNode, tag string) bool {
+	for _, name := range node.Tags() {
+		if name == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureTag add the tag to each of the nodes that does not already carry it,
+// creating the tag if it does not exist, so that the nodes the automation is
+// managing can be found directly from MAAS
+func ensureTag(client *maas.MAASObject, nodes []MaasNode, tag string, options ProcessingOptions) error {
+	return addTag(client, nodes, tag, url.Values{"name": []string{tag}}, options)
+}
+
+// addTag add the tag to each of the nodes that does not already carry it,
+// creating the tag with the given parameters if it does not exist
+func addTag(client *maas.MAASObject, nodes []MaasNode, tag string, create url.Values, options ProcessingOptions) error {
+	params := url.Values{}
+	for _, node := range nodes {
+		if !hasTag(node, tag) {
+			options.logf("TAG: %s", node.Hostname())
+			params.Add("add", node.SystemID())
+		}
+	}
+	if len(params) == 0 || options.Preview {
+		return nil
+	}
+
+	tagsObj := client.GetSubObject("tags")
+	tagObj := tagsObj.GetSubObject(tag)
+	if _, err := getObject(options, tagObj); err != nil {
+		if classifyMaasError(err) != ErrorNotFound {
+			options.logf("ERROR: TAG '%s' : '%s'", tag, err)
+			return err
+		}
+		_, err = callPost(options, tagsObj, "new", create)
+		if err != nil {
+			options.logf("ERROR: TAG unable to create tag '%s' : '%s'", tag, err)
+			return err
+		}
+	}
+
+	_, err := callPost(options, tagObj, "update_nodes", params)
+	if err != nil {
+		options.logf("ERROR: TAG '%s' : '%s'", tag, err)
+	}
+	return err
+}
+
+// kernelOptsTagPrefix the prefix of the tags through which the automation
+// applies kernel options to a node, see kernelOptsTag
+const kernelOptsTagPrefix = "maas-flow-kernel-"
+
+// kernelOptsTag the name of the tag that carries the given kernel options.
+// MAAS applies kernel options to a node through its tags, so each distinct
+// set of options has its own tag, named from a hash of the options.
+func kernelOptsTag(opts string) string {
+	sum := sha1.Sum([]byte(opts))
+	return kernelOptsTagPrefix + hex.EncodeToString(sum[:4])
+}
+
+// applyKernelOpts tag the node with the tag carrying the kernel options,
+// creating the tag if needed, and remove any tag carrying other kernel
+// options applied previously, so that only these options apply when the node
+// is next deployed
+func applyKernelOpts(client *maas.MAASObject, node MaasNode, opts string, options ProcessingOptions) error {
+	tag := kernelOptsTag(opts)
+	create := url.Values{
+		"name":        []string{tag},
+		"kernel_opts": []string{opts},
+		"comment":     []string{"kernel options applied by maas-flow"},
+	}
+	if err := addTag(client, []MaasNode{node}, tag, create, options); err != nil {
+		return err
+	}
+	for _, stale := range node.Tags() {
+		if !strings.HasPrefix(stale, kernelOptsTagPrefix) || stale == tag {
+			continue
+		}
+		options.logf("UNTAG: %s '%s'", node.Hostname(), stale)
+		if options.Preview {
+			continue
+		}
+		tagObj := client.GetSubObject("tags").GetSubObject(stale)
+		if _, err := callPost(options, tagObj, "update_nodes", url.Values{"remove": []string{node.SystemID()}}); err != nil {
+			options.logf("ERROR: UNTAG '%s' : '%s'", stale, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// traced the system ids of the nodes being traced, so that the requests made
+// to MAAS concerning them are logged in full
+var traced = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// withTrace the options with which to process the node, tracing the node if it
+// is one of the TraceNodes, by system id or hostname
+func (o ProcessingOptions) withTrace(node MaasNode) ProcessingOptions {
+	o.trace = false
+	for _, name := range o.TraceNodes {
+		if name == node.SystemID() || name == node.Hostname() || name == shortHostname(node) {
+			o.trace = true
+			break
+		}
+	}
+
+	traced.Lock()
+	defer traced.Unlock()
+	if o.trace {
+		traced.ids[node.SystemID()] = true
+	} else {
+		delete(traced.ids, node.SystemID())
+	}
+	return o
+}
+
+// verbose whether to log in detail, either for all nodes or for the node
+// being traced
+func (o ProcessingOptions) verbose() bool {
+	return o.Verbose || o.trace
+}
+
+// tracef log a message only when tracing the node being processed
+func (o ProcessingOptions) tracef(format string, v ...interface{}) {
+	if o.trace {
+		o.logf("[trace] "+format, v...)
+	}
+}
+
+// tracedRequest the system id of the traced node that the request concerns,
+// if any, determined from the path of the MAAS object or a system_id parameter
+func tracedRequest(obj maas.MAASObject, params url.Values) (string, bool) {
+	traced.Lock()
+	defer traced.Unlock()
+	if len(traced.ids) == 0 {
+		return "", false
+	}
+	if id := params.Get("system_id"); traced.ids[id] {
+		return id, true
+	}
+	segments := strings.Split(strings.Trim(obj.URL().Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if (segments[i] == "nodes" || segments[i] == "machines") && traced.ids[segments[i+1]] {
+			return segments[i+1], true
+		}
+	}
+	return "", false
+}
+
+// traceRequest log a request made to MAAS, with its parameters and the raw
+// response, when it concerns a traced node
+func traceRequest(options ProcessingOptions, method string, obj maas.MAASObject, operation string, params url.Values, result interface{}, err error) {
+	id, ok := tracedRequest(obj, params)
+	if !ok {
+		return
+	}
+	if err != nil {
+		options.logf("[trace] %s %s %s op=%s params=%v : error : %s", id, method, obj.URL().Path, operation, params, err)
+		return
+	}
+	response, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		response = []byte(jsonErr.Error())
+	}
+	options.logf("[trace] %s %s %s op=%s params=%v : response : %s", id, method, obj.URL().Path, operation, params, response)
+}
@@ -0,0 +1,347 @@
+package maasflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nodeState the state in which a node was last observed, when it was first
+// observed in that state, in how many consecutive passes it has been
+// observed in that state and the state in which it was observed before, if
+// any
+type nodeState struct {
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Passes   int       `json:"passes,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+}
+
+// stateTracker remembers, across processing passes, the state of each node
+// keyed by the node's system id, see MaasNode.SystemID
+type stateTracker struct {
+	sync.Mutex
+	nodes       map[string]nodeState
+	failures    map[string]nodeState
+	inFlight    map[string]int
+	powerCycles map[string]powerCycleRecord
+	outcomes    map[string]actionOutcome
+	driving     map[string]bool
+}
+
+// actionOutcome the last action completed for a node, when it completed and
+// any error it returned
+type actionOutcome struct {
+	Action string
+	At     time.Time
+	Err    string
+}
+
+// powerCycleRecord the power cycles attempted for a node stuck in a state,
+// identified by when the node entered the state
+type powerCycleRecord struct {
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+	Last     time.Time `json:"last"`
+}
+
+// tracker the state tracking shared by all processing passes
+var tracker = &stateTracker{
+	nodes:       make(map[string]nodeState),
+	failures:    make(map[string]nodeState),
+	inFlight:    make(map[string]int),
+	powerCycles: make(map[string]powerCycleRecord),
+	outcomes:    make(map[string]actionOutcome),
+	driving:     make(map[string]bool),
+}
+
+// observe record that the node was seen in the given state, returning when the
+// node entered that state
+func (t *stateTracker) observe(id string, state string, now time.Time) nodeState {
+	t.Lock()
+	defer t.Unlock()
+
+	entry, ok := t.nodes[id]
+	if !ok || entry.State != state {
+		entry = nodeState{State: state, Since: now, Previous: entry.State}
+	}
+	entry.Passes++
+	t.nodes[id] = entry
+	return entry
+}
+
+// get return the last observed state of the node
+func (t *stateTracker) get(id string) (nodeState, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	entry, ok := t.nodes[id]
+	return entry, ok
+}
+
+// drive record whether the automation is driving the node towards the target
+// state, i.e. the node matched the filter and the action for its state leaves
+// work to do, rather than the node being at the target state or in a terminal
+// state that needs an operator
+func (t *stateTracker) drive(id string, driving bool) {
+	t.Lock()
+	defer t.Unlock()
+	if driving {
+		t.driving[id] = true
+	} else {
+		delete(t.driving, id)
+	}
+}
+
+// resetDriving forget which nodes are being driven, done at the start of each
+// pass that fetches the full list of nodes so that nodes that no longer match
+// the filter are forgotten
+func (t *stateTracker) resetDriving() {
+	t.Lock()
+	defer t.Unlock()
+	t.driving = make(map[string]bool)
+}
+
+// forget the tracked state of the nodes that are not kept, i.e. nodes deleted
+// from MAAS or that no longer match the filter, so that it is neither
+// persisted nor reported. A node with an action in flight is kept until the
+// action completes.
+func (t *stateTracker) forget(keep map[string]bool) {
+	t.Lock()
+	defer t.Unlock()
+	for _, states := range []map[string]nodeState{t.nodes, t.failures} {
+		for id := range states {
+			if !keep[id] && t.inFlight[id] == 0 {
+				delete(states, id)
+			}
+		}
+	}
+	for id := range t.powerCycles {
+		if !keep[id] && t.inFlight[id] == 0 {
+			delete(t.powerCycles, id)
+		}
+	}
+	for id := range t.outcomes {
+		if !keep[id] && t.inFlight[id] == 0 {
+			delete(t.outcomes, id)
+		}
+	}
+}
+
+// PendingNodeIDs the system ids of the nodes the automation is still driving
+// towards the target state, or that have an action in flight, as of the last
+// pass. Nodes at the target state, in a terminal state or that did not match
+// the filter are not included.
+func PendingNodeIDs() []string {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	ids := make([]string, 0, len(tracker.driving)+len(tracker.inFlight))
+	for id := range tracker.driving {
+		ids = append(ids, id)
+	}
+	for id := range tracker.inFlight {
+		if !tracker.driving[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// failed record that the action taken for the node in the given state failed
+func (t *stateTracker) failed(id string, state string, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.failures[id] = nodeState{State: state, Since: now}
+}
+
+// powerCycled the power cycles attempted for the node since it entered the
+// given state
+func (t *stateTracker) powerCycled(id string, current nodeState) powerCycleRecord {
+	t.Lock()
+	defer t.Unlock()
+
+	record, ok := t.powerCycles[id]
+	if !ok || !record.Since.Equal(current.Since) {
+		return powerCycleRecord{Since: current.Since}
+	}
+	return record
+}
+
+// powerCycling record that a power cycle was attempted for the node
+func (t *stateTracker) powerCycling(id string, current nodeState, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	record, ok := t.powerCycles[id]
+	if !ok || !record.Since.Equal(current.Since) {
+		record = powerCycleRecord{Since: current.Since}
+	}
+	record.Attempts++
+	record.Last = now
+	t.powerCycles[id] = record
+}
+
+// coolingDown whether the action for the node in the given state failed
+// within the cooldown period, returning when the cooldown ends. A failure
+// for a different state does not apply, as a different action is taken.
+func (t *stateTracker) coolingDown(id string, state string, cooldown time.Duration, now time.Time) (time.Time, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	failure, ok := t.failures[id]
+	if !ok || failure.State != state {
+		return time.Time{}, false
+	}
+	until := failure.Since.Add(cooldown)
+	if now.After(until) {
+		delete(t.failures, id)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// begin record that an action for the node is in flight
+func (t *stateTracker) begin(id string) {
+	t.Lock()
+	defer t.Unlock()
+	t.inFlight[id]++
+}
+
+// end record that an action for the node has completed
+func (t *stateTracker) end(id string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.inFlight[id]--; t.inFlight[id] <= 0 {
+		delete(t.inFlight, id)
+	}
+}
+
+// running whether an action for the node is in flight
+func (t *stateTracker) running(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.inFlight[id] > 0
+}
+
+// completed record the outcome of the last action completed for the node
+func (t *stateTracker) completed(id string, action string, err error, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	outcome := actionOutcome{Action: action, At: now}
+	if err != nil {
+		outcome.Err = err.Error()
+	}
+	t.outcomes[id] = outcome
+}
+
+// lastOutcome the outcome of the last action completed for the node
+func (t *stateTracker) lastOutcome(id string) (actionOutcome, bool) {
+	t.Lock()
+	defer t.Unlock()
+	outcome, ok := t.outcomes[id]
+	return outcome, ok
+}
+
+// stateSchemaVersion the version of the persisted state, to be incremented,
+// with a migration in LoadState, whenever the persisted form changes
+const stateSchemaVersion = 2
+
+// persistedState the form in which the tracked state is persisted, keyed by
+// node system id. Version 2 added the power cycles, so that the attempts to
+// power cycle a stuck node are still bounded across a restart.
+type persistedState struct {
+	Version     int                         `json:"version"`
+	Nodes       map[string]nodeState        `json:"nodes"`
+	Failures    map[string]nodeState        `json:"failures"`
+	PowerCycles map[string]powerCycleRecord `json:"power_cycles"`
+}
+
+// SaveState persist the state tracked across processing passes, such as how
+// long nodes have been in a state, recent action failures and the power
+// cycles attempted for stuck nodes, to the named file so that it survives a
+// restart. The file is replaced atomically.
+func SaveState(name string) error {
+	tracker.Lock()
+	state := persistedState{
+		Version:     stateSchemaVersion,
+		Nodes:       make(map[string]nodeState, len(tracker.nodes)),
+		Failures:    make(map[string]nodeState, len(tracker.failures)),
+		PowerCycles: make(map[string]powerCycleRecord, len(tracker.powerCycles)),
+	}
+	for id, entry := range tracker.nodes {
+		state.Nodes[id] = entry
+	}
+	for id, entry := range tracker.failures {
+		state.Failures[id] = entry
+	}
+	for id, record := range tracker.powerCycles {
+		state.PowerCycles[id] = record
+	}
+	tracker.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// LoadState restore the state tracked across processing passes from the
+// named file, as written by SaveState. A missing file is not an error, as
+// there is no state to restore the first time the automation is run.
+func LoadState(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("unable to parse state file '%s' : %s", name, err)
+	}
+	// Version 1 state has no power cycles, which is the same as none having
+	// been attempted
+	if state.Version == 1 {
+		state.Version = 2
+	}
+	if state.Version != stateSchemaVersion {
+		return fmt.Errorf("state file '%s' has unsupported schema version %d, expected %d",
+			name, state.Version, stateSchemaVersion)
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	for id, entry := range state.Nodes {
+		tracker.nodes[id] = entry
+	}
+	for id, entry := range state.Failures {
+		tracker.failures[id] = entry
+	}
+	for id, record := range state.PowerCycles {
+		tracker.powerCycles[id] = record
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package maasflow
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPendingNodeIDs(t *testing.T) {
+	tracker.resetDriving()
+	defer tracker.resetDriving()
+
+	tracker.drive("deploying", true)
+	tracker.drive("deployed", false)
+	tracker.drive("broken", true)
+	tracker.drive("broken", false)
+	tracker.begin("inflight")
+	defer tracker.end("inflight")
+
+	want := []string{"deploying", "inflight"}
+	if got := PendingNodeIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingNodeIDs = %v, want %v", got, want)
+	}
+
+	tracker.resetDriving()
+	want = []string{"inflight"}
+	if got := PendingNodeIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingNodeIDs after reset = %v, want %v", got, want)
+	}
+}
+
+func TestSaveStatePowerCycles(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "state.json")
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := powerCycleRecord{Since: since, Attempts: 2, Last: since.Add(time.Hour)}
+
+	tracker.Lock()
+	tracker.powerCycles["stuck"] = record
+	tracker.Unlock()
+	if err := SaveState(name); err != nil {
+		t.Fatalf("unable to save state : %s", err)
+	}
+
+	tracker.Lock()
+	delete(tracker.powerCycles, "stuck")
+	tracker.Unlock()
+	defer delete(tracker.powerCycles, "stuck")
+	if err := LoadState(name); err != nil {
+		t.Fatalf("unable to load state : %s", err)
+	}
+	if got := tracker.powerCycled("stuck", nodeState{Since: since}); got != record {
+		t.Errorf("power cycles after a restart = %+v, want %+v", got, record)
+	}
+}
+
+func TestLoadStateVersion1(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "state.json")
+	data := `{"version":1,"nodes":{"v1":{"state":"Deploying","since":"2026-01-02T03:04:05Z"}},"failures":{}}`
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(tracker.nodes, "v1")
+	if err := LoadState(name); err != nil {
+		t.Fatalf("unable to load version 1 state : %s", err)
+	}
+	if entry, ok := tracker.get("v1"); !ok || entry.State != "Deploying" {
+		t.Errorf("expected the node state to be migrated, got %+v", entry)
+	}
+}
+
+func TestActionCooldown(t *testing.T) {
+	fake := useFakeClock(t)
+	client := newTestMAAS(t, http.NotFoundHandler())
+	node := newTestNode(t, `{"system_id":"cool","hostname":"cool","status_name":"Ready"}`)
+	defer delete(tracker.nodes, "cool")
+	defer delete(tracker.failures, "cool")
+
+	options := ProcessingOptions{Preview: true, ActionCooldown: 10 * time.Minute}
+	tracker.failed("cool", "Ready", clock.Now())
+
+	fake.Advance(5 * time.Minute)
+	if result := processNode(client, node, options); !result.Skipped {
+		t.Errorf("expected the node to be cooling down, got %+v", result)
+	}
+	if _, ok := tracker.coolingDown("cool", "Deploying", options.ActionCooldown, clock.Now()); ok {
+		t.Errorf("expected a failure in another state not to cool the node down")
+	}
+
+	fake.Advance(5*time.Minute + time.Second)
+	if result := processNode(client, node, options); result.Skipped || result.Action != "Aquire" {
+		t.Errorf("expected the node to be aquired after the cooldown, got %+v", result)
+	}
+}
+
+func TestStabilityPasses(t *testing.T) {
+	fake := useFakeClock(t)
+	client := newTestMAAS(t, http.NotFoundHandler())
+	node := newTestNode(t, `{"system_id":"flap","hostname":"flap","status_name":"Ready"}`)
+	defer delete(tracker.nodes, "flap")
+
+	options := ProcessingOptions{Preview: true, StabilityPasses: 2}
+	start := clock.Now()
+	if result := processNode(client, node, options); !result.Skipped {
+		t.Errorf("expected the node not to be acted on in its first pass, got %+v", result)
+	}
+
+	fake.Advance(time.Minute)
+	if result := processNode(client, node, options); result.Skipped || result.Action != "Aquire" {
+		t.Errorf("expected the node to be aquired once stable, got %+v", result)
+	}
+	if entry, _ := tracker.get("flap"); !entry.Since.Equal(start) || entry.Passes != 2 {
+		t.Errorf("expected the node to be observed since %s for 2 passes, got %+v", start, entry)
+	}
+}
+
+func TestForgetUnlistedNodes(t *testing.T) {
+	useFakeClock(t)
+	for _, id := range []string{"forget-gone", "forget-excluded", "forget-kept"} {
+		tracker.observe(id, "Deployed", clock.Now())
+		tracker.failed(id, "Deployed", clock.Now())
+		defer delete(tracker.nodes, id)
+		defer delete(tracker.failures, id)
+	}
+	nodes := []MaasNode{
+		newTestNode(t, `{"system_id":"forget-kept","hostname":"kept","status_name":"Deployed"}`),
+		newTestNode(t, `{"system_id":"forget-excluded","hostname":"excluded","status_name":"Deployed"}`),
+	}
+	options := ProcessingOptions{Preview: true}
+	options.Filter.Hosts.Exclude = []string{"excluded"}
+
+	// A partial pass has not seen the whole fleet, so forgets nothing
+	options.PartialFetch = true
+	ProcessAll(nil, nodes[:1], options)
+	if _, ok := tracker.get("forget-gone"); !ok {
+		t.Errorf("expected a partial pass not to forget the nodes it did not list")
+	}
+
+	options.PartialFetch = false
+	ProcessAll(nil, nodes, options)
+	for id, kept := range map[string]bool{"forget-gone": false, "forget-excluded": false, "forget-kept": true} {
+		if _, ok := tracker.get(id); ok != kept {
+			t.Errorf("%s: expected tracked %t, got %t", id, kept, ok)
+		}
+		tracker.Lock()
+		_, ok := tracker.failures[id]
+		tracker.Unlock()
+		if ok != kept {
+			t.Errorf("%s: expected failure tracked %t, got %t", id, kept, ok)
+		}
+	}
+}
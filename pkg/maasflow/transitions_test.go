@@ -0,0 +1,125 @@
+package maasflow
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransitions(t *testing.T) {
+	cases := []struct {
+		current string
+		action  Action
+	}{
+		{"New", Commission},
+		{"Ready", Aquire},
+		{"Allocated", Deploy},
+		{"Deployed", Done},
+		{"DiskErasing", Wait},
+		{"FailedReleasing", Fail},
+		{"FailedDiskErasing", ReleaseWithoutErase},
+	}
+	for _, c := range cases {
+		action, err := findAction("Deployed", c.current)
+		if err != nil {
+			t.Errorf("%s: unexpected error : %s", c.current, err)
+			continue
+		}
+		if !sameAction(action, c.action) {
+			t.Errorf("%s: expected action %s, got %s", c.current, ActionName(c.action), ActionName(action))
+		}
+	}
+}
+
+func TestEveryStatusHasTransition(t *testing.T) {
+	for _, state := range statusNames() {
+		if _, err := findAction("Deployed", state); err != nil {
+			t.Errorf("no transition from status '%s' : %s", state, err)
+		}
+	}
+
+	states := regexp.MustCompile(`\((\w+)\)`).FindAllStringSubmatch(defaultStateMachine, -1)
+	for _, state := range states {
+		if _, ok := Transitions["Deployed"][state[1]]; !ok {
+			t.Errorf("state '%s' of the state machine has no transition", state[1])
+		}
+	}
+}
+
+func TestFailedDiskErasingLeftUnlessEnabled(t *testing.T) {
+	node := newTestNode(t, `{"system_id":"erase","hostname":"erase","status_name":"FailedDiskErasing"}`)
+
+	result, err := ReleaseWithoutErase(nil, node, ProcessingOptions{Preview: true})
+	if err != nil || result.Mutated {
+		t.Errorf("expected the node to be left for manual attention, got %+v, %v", result, err)
+	}
+
+	result, err = ReleaseWithoutErase(nil, node, ProcessingOptions{Preview: true, ReleaseFailedErase: true})
+	if err != nil || !result.Mutated || result.NextState != "Releasing" {
+		t.Errorf("expected the node to be released, got %+v, %v", result, err)
+	}
+}
+
+func TestReleaseFailedEraseRequiresArm(t *testing.T) {
+	if err := (ProcessingOptions{ReleaseFailedErase: true}).Validate(); err == nil {
+		t.Errorf("expected releasing without erase to require arm-destructive")
+	}
+	if err := (ProcessingOptions{ReleaseFailedErase: true, ArmDestructive: true}).Validate(); err != nil {
+		t.Errorf("unexpected error releasing without erase when armed : %s", err)
+	}
+}
+
+func TestDoneLogsOnlyOnEntry(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	useFakeClock(t)
+
+	node := newTestNode(t, `{"system_id":"done","hostname":"done","status_name":"Deployed"}`)
+	passes := []struct {
+		state  string
+		logged bool
+	}{
+		{"Deployed", false},
+		{"Deploying", false},
+		{"Deployed", true},
+		{"Deployed", false},
+	}
+	for i, pass := range passes {
+		buf.Reset()
+		tracker.observe("done", pass.state, clock.Now())
+		if pass.state == "Deployed" {
+			Done(nil, node, ProcessingOptions{})
+		}
+		if got := strings.Contains(buf.String(), "COMPLETE: done"); got != pass.logged {
+			t.Errorf("pass %d in %s: expected logged %t, got %q", i, pass.state, pass.logged, buf.String())
+		}
+	}
+}
+
+func TestDeployingTimeoutReleaseRequiresArm(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	useFakeClock(t)
+	node := newTestNode(t, `{"system_id":"late","hostname":"late","status_name":"Deploying"}`)
+	tracker.observe("late", "Deploying", clock.Now().Add(-time.Hour))
+	defer delete(tracker.nodes, "late")
+
+	options := ProcessingOptions{Preview: true, StateTimeouts: map[string]time.Duration{"Deploying": 30 * time.Minute}}
+	if result := processNode(nil, node, options); result.Action != "Wait" {
+		t.Errorf("expected an unarmed timed out node not to be released, got %+v", result)
+	}
+	if !strings.Contains(buf.String(), "requires manual attention") {
+		t.Errorf("expected the node to be reported as requiring manual attention, got %q", buf.String())
+	}
+
+	options.ArmDestructive = true
+	if result := processNode(nil, node, options); result.Action != "Release" {
+		t.Errorf("expected an armed timed out node to be released, got %+v", result)
+	}
+}